@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/stacktrace"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// BillingProvider takes payment for paid plans. StripeProvider takes payment
+// through Stripe, while ManualProvider issues invoices that are settled
+// outside of notebrew and marked paid by an admin. Either way the provider
+// keeps the local subscription table up to date, and entitlements are
+// computed from it.
+type BillingProvider interface {
+	// Checkout starts a subscription to (or a one-time purchase of) a plan
+	// and returns the URL that the user should be redirected to.
+	Checkout(ctx context.Context, params CheckoutParams) (redirectURL string, err error)
+
+	// Portal returns the URL of a page where the customer can manage their
+	// payment details and subscriptions.
+	Portal(ctx context.Context, customerID, returnURL string) (portalURL string, err error)
+
+	// VerifyWebhook verifies the signature of a webhook event, returning the
+	// event along with the label of the secret that verified it.
+	VerifyWebhook(payload []byte, header http.Header) (event stripe.Event, label string, err error)
+
+	// Subscriptions looks up a customer's subscriptions that have not been
+	// canceled from the provider's own records, which may be ahead of the
+	// local subscription table.
+	Subscriptions(ctx context.Context, customerID string) ([]Subscription, error)
+}
+
+// CheckoutParams are the parameters of BillingProvider.Checkout. Whether the
+// user may buy the plan, and whether they get a trial or coupon, is decided
+// by the caller.
+type CheckoutParams struct {
+	User     User
+	Plan     Plan
+	PriceID  string
+	Quantity int64
+	// Coupon, if not nil, is pre-applied to the checkout.
+	Coupon *Coupon
+	// TrialDays is the length of the free trial, or zero for no trial.
+	TrialDays int64
+	// SuccessURL is where the user is sent once they have paid. Stripe
+	// replaces {CHECKOUT_SESSION_ID} in it with the checkout session ID.
+	SuccessURL string
+	// ReturnURL is where the user is sent if they leave checkout without
+	// paying. Providers that take payment outside of checkout send the user
+	// there straight away.
+	ReturnURL string
+}
+
+// newBillingProvider returns the billing provider configured by
+// stripeConfig.Provider.
+func newBillingProvider(nbrew *notebrew.Notebrew, stripeConfig StripeConfig) BillingProvider {
+	if stripeConfig.Provider == "manual" {
+		return &ManualProvider{
+			Notebrew:     nbrew,
+			StripeConfig: stripeConfig,
+		}
+	}
+	return &StripeProvider{
+		Notebrew:     nbrew,
+		StripeConfig: stripeConfig,
+	}
+}
+
+// StripeProvider takes payment through Stripe Checkout and the Stripe
+// customer portal, and is kept up to date by Stripe webhook events.
+type StripeProvider struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+}
+
+func (provider *StripeProvider) Checkout(ctx context.Context, params CheckoutParams) (redirectURL string, err error) {
+	lineItems := []*stripe.CheckoutSessionLineItemParams{
+		{
+			Price:    stripe.String(params.PriceID),
+			Quantity: stripe.Int64(params.Quantity),
+		},
+	}
+	planPrice, _ := params.Plan.PriceByID(params.PriceID)
+	if overagePriceID := params.Plan.OveragePriceFor(planPrice.Interval); overagePriceID != "" {
+		// Metered prices must be added without a quantity.
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			Price: stripe.String(overagePriceID),
+		})
+	}
+	var customerID, email *string
+	if params.User.CustomerID != "" {
+		customerID = &params.User.CustomerID
+	} else {
+		email = &params.User.Email
+	}
+	// The userID is attached to the checkout session (and the subscription it
+	// creates) so that the webhook can link the customer to the user even if
+	// the user never returns to the success URL.
+	metadata := map[string]string{
+		"userID": params.User.UserID.String(),
+	}
+	subscriptionData := &stripe.CheckoutSessionSubscriptionDataParams{
+		Metadata: map[string]string{
+			"userID": params.User.UserID.String(),
+		},
+	}
+	if params.TrialDays > 0 {
+		subscriptionData.TrialPeriodDays = stripe.Int64(params.TrialDays)
+	}
+	// Stripe doesn't allow promotion codes to be entered if a discount is
+	// already applied.
+	var discounts []*stripe.CheckoutSessionDiscountParams
+	var allowPromotionCodes *bool
+	if params.Coupon != nil {
+		discounts = append(discounts, &stripe.CheckoutSessionDiscountParams{
+			Coupon: stripe.String(params.Coupon.CouponID),
+		})
+		metadata["coupon"] = params.Coupon.Code
+	} else if provider.StripeConfig.AllowPromotionCodes {
+		allowPromotionCodes = stripe.Bool(true)
+	}
+	checkoutSessionParams := &stripe.CheckoutSessionParams{
+		Customer:            customerID,
+		CustomerEmail:       email,
+		ClientReferenceID:   stripe.String(params.User.UserID.String()),
+		ExpiresAt:           stripe.Int64(time.Now().Add(30 * time.Minute).Unix()),
+		Mode:                stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:           lineItems,
+		Discounts:           discounts,
+		AllowPromotionCodes: allowPromotionCodes,
+		Metadata:            metadata,
+		SubscriptionData:    subscriptionData,
+		SuccessURL:          stripe.String(params.SuccessURL),
+		CancelURL:           stripe.String(params.ReturnURL),
+	}
+	if params.Plan.OneTime {
+		// The priceID is kept in the metadata because the line items of a
+		// checkout session are not included in webhook events. Payment mode
+		// checkouts only create a customer if asked to, and the customer is
+		// needed to link the purchase to the user.
+		metadata["priceID"] = params.PriceID
+		checkoutSessionParams.Mode = stripe.String(string(stripe.CheckoutSessionModePayment))
+		checkoutSessionParams.SubscriptionData = nil
+		checkoutSessionParams.PaymentIntentData = &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: map[string]string{
+				"userID": params.User.UserID.String(),
+			},
+		}
+		if customerID == nil {
+			checkoutSessionParams.CustomerCreation = stripe.String(string(stripe.CheckoutSessionCustomerCreationAlways))
+		}
+	}
+	stripeClient, err := customerClient(ctx, provider.Notebrew, provider.StripeConfig, params.User.CustomerID)
+	if err != nil {
+		return "", err
+	}
+	checkoutSession, err := stripeClient.CheckoutSessions.New(checkoutSessionParams)
+	if err != nil {
+		return "", err
+	}
+	return checkoutSession.URL, nil
+}
+
+func (provider *StripeProvider) Portal(ctx context.Context, customerID, returnURL string) (portalURL string, err error) {
+	stripeClient, err := customerClient(ctx, provider.Notebrew, provider.StripeConfig, customerID)
+	if err != nil {
+		return "", err
+	}
+	billingPortalSession, err := stripeClient.BillingPortalSessions.New(&stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(returnURL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return billingPortalSession.URL, nil
+}
+
+func (provider *StripeProvider) VerifyWebhook(payload []byte, header http.Header) (event stripe.Event, label string, err error) {
+	return constructEvent(payload, header.Get("Stripe-Signature"), provider.StripeConfig)
+}
+
+func (provider *StripeProvider) Subscriptions(ctx context.Context, customerID string) ([]Subscription, error) {
+	stripeClient, err := customerClient(ctx, provider.Notebrew, provider.StripeConfig, customerID)
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []Subscription
+	iter := stripeClient.Subscriptions.List(&stripe.SubscriptionListParams{
+		Customer: stripe.String(customerID),
+	})
+	for iter.Next() {
+		subscriptions = append(subscriptions, newSubscription(iter.Subscription()))
+	}
+	err = iter.Err()
+	if err != nil {
+		return nil, stacktrace.New(err)
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+)
+
+func BillingCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (Command, error) {
+	if nbrew.DB == nil {
+		return nil, fmt.Errorf("no database configured: to fix, run `notebrew config database.dialect sqlite`")
+	}
+	if stripeConfig.Provider != "manual" {
+		return nil, fmt.Errorf("billing commands require the manual provider: set \"provider\": \"manual\" in stripe.json")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing subcommand (cancel, invoices, markpaid)")
+	}
+	switch args[0] {
+	case "cancel":
+		cmd, err := BillingCancelCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "invoices":
+		cmd, err := BillingInvoicesCommand(nbrew, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "markpaid":
+		cmd, err := BillingMarkpaidCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+}
+
+type BillingInvoicesCmd struct {
+	Notebrew *notebrew.Notebrew
+	Stdout   io.Writer
+	All      bool
+}
+
+func BillingInvoicesCommand(nbrew *notebrew.Notebrew, args ...string) (*BillingInvoicesCmd, error) {
+	var cmd BillingInvoicesCmd
+	cmd.Notebrew = nbrew
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.BoolVar(&cmd.All, "all", false, "List paid and void invoices as well as open ones.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew billing invoices [FLAGS]
+Lists the open manual invoices, oldest first.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagset.Args(), " "))
+	}
+	return &cmd, nil
+}
+
+func (cmd *BillingInvoicesCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	type Row struct {
+		InvoiceID      string
+		SubscriptionID string
+		Status         string
+		AmountPaid     int64
+		Currency       string
+		CreationTime   time.Time
+		Email          string
+	}
+	format := "SELECT {*}" +
+		" FROM invoice" +
+		" JOIN customer ON customer.customer_id = invoice.customer_id" +
+		" JOIN users ON users.user_id = customer.user_id" +
+		" WHERE invoice.invoice_id LIKE 'minv%'"
+	if !cmd.All {
+		format += " AND invoice.status = 'open'"
+	}
+	format += " ORDER BY invoice.creation_time"
+	rows, err := sq.FetchAll(context.Background(), cmd.Notebrew.DB, sq.Query{
+		Dialect: cmd.Notebrew.Dialect,
+		Format:  format,
+	}, func(row *sq.Row) Row {
+		return Row{
+			InvoiceID:      row.String("invoice.invoice_id"),
+			SubscriptionID: row.String("invoice.subscription_id"),
+			Status:         row.String("invoice.status"),
+			AmountPaid:     row.Int64("invoice.amount_paid"),
+			Currency:       row.String("invoice.currency"),
+			CreationTime:   time.Unix(row.Int64("invoice.creation_time"), 0).UTC(),
+			Email:          row.String("users.email"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		fmt.Fprintln(cmd.Stdout, "no invoices")
+		return nil
+	}
+	for _, row := range rows {
+		if row.Status == "paid" {
+			fmt.Fprintf(cmd.Stdout, "%s %s %s %s paid %d %s\n", row.InvoiceID, row.CreationTime.Format("2006-01-02"), row.Email, row.SubscriptionID, row.AmountPaid, strings.ToUpper(row.Currency))
+			continue
+		}
+		fmt.Fprintf(cmd.Stdout, "%s %s %s %s %s\n", row.InvoiceID, row.CreationTime.Format("2006-01-02"), row.Email, row.SubscriptionID, row.Status)
+	}
+	return nil
+}
+
+type BillingMarkpaidCmd struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+	InvoiceID    string
+	Amount       int64
+	Currency     string
+}
+
+func BillingMarkpaidCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*BillingMarkpaidCmd, error) {
+	var cmd BillingMarkpaidCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Int64Var(&cmd.Amount, "amount", 0, "The amount paid, in the smallest currency unit (e.g. cents).")
+	flagset.StringVar(&cmd.Currency, "currency", "usd", "The three-letter ISO code of the currency paid in.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew billing markpaid [FLAGS] INVOICE_ID
+Marks an open manual invoice as paid and renews its subscription for another
+billing period.
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected exactly one invoice ID")
+	}
+	cmd.InvoiceID = flagset.Arg(0)
+	if cmd.Amount < 0 {
+		return nil, fmt.Errorf("-amount cannot be negative")
+	}
+	cmd.Currency = strings.ToLower(cmd.Currency)
+	return &cmd, nil
+}
+
+func (cmd *BillingMarkpaidCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	err := markManualInvoicePaid(context.Background(), cmd.Notebrew, cmd.StripeConfig, cmd.InvoiceID, cmd.Amount, cmd.Currency)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%s: paid\n", cmd.InvoiceID)
+	return nil
+}
+
+type BillingCancelCmd struct {
+	Notebrew       *notebrew.Notebrew
+	StripeConfig   StripeConfig
+	Stdout         io.Writer
+	SubscriptionID string
+}
+
+func BillingCancelCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*BillingCancelCmd, error) {
+	var cmd BillingCancelCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew billing cancel SUBSCRIPTION_ID
+Cancels a manual subscription immediately and voids its open invoices.`)
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() != 1 {
+		flagset.Usage()
+		return nil, fmt.Errorf("expected exactly one subscription ID")
+	}
+	cmd.SubscriptionID = flagset.Arg(0)
+	return &cmd, nil
+}
+
+func (cmd *BillingCancelCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	err := cancelManualSubscription(context.Background(), cmd.Notebrew, cmd.StripeConfig, cmd.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "%s: canceled\n", cmd.SubscriptionID)
+	return nil
+}
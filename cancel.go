@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// CancellationReason is a reason a user can give for canceling their
+// subscription. The values are Stripe's cancellation feedback values, so that
+// the reason also shows up on the subscription in the Stripe dashboard.
+type CancellationReason struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+}
+
+var cancellationReasons = []CancellationReason{
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackTooExpensive), Label: "It's too expensive"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackMissingFeatures), Label: "It's missing features I need"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackUnused), Label: "I don't use it enough"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackSwitchedService), Label: "I'm switching to a different service"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackTooComplex), Label: "It's too complicated"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackLowQuality), Label: "The quality was lower than expected"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackCustomerService), Label: "The customer service was lower than expected"},
+	{Value: string(stripe.SubscriptionCancellationDetailsFeedbackOther), Label: "Other"},
+}
+
+// stripeCancel lets a user cancel their subscription without going through
+// the Stripe billing portal. A GET request shows the cancellation survey and
+// the retention offer (if any), and a POST request either cancels the
+// subscription at the end of the current billing period (action=cancel),
+// applies the retention offer instead (action=acceptOffer) or undoes a
+// pending cancellation (action=resume). The reason given is recorded in the
+// cancellation table either way.
+func stripeCancel(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	type Response struct {
+		UserID                notebrew.ID          `json:"userID"`
+		Username              string               `json:"username"`
+		TimezoneOffsetSeconds int                  `json:"timezoneOffsetSeconds"`
+		DisableReason         string               `json:"disableReason"`
+		Plan                  Plan                 `json:"plan"`
+		CurrentPeriodEnd      time.Time            `json:"currentPeriodEnd"`
+		CancelAt              time.Time            `json:"cancelAt"`
+		Reasons               []CancellationReason `json:"reasons"`
+		RetentionOffer        *RetentionOffer      `json:"retentionOffer"`
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	}
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	currentSubscription, _, currentPlan, ok, err := getPlanSubscription(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if !ok {
+		nbrew.BadRequest(w, r, fmt.Errorf("user has no subscription"))
+		return
+	}
+	offerAvailable, err := retentionOfferAvailable(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+
+	if r.Method == "POST" {
+		action := r.Form.Get("action")
+		var params *stripe.SubscriptionParams
+		var reason, comment string
+		switch action {
+		case "resume":
+			if currentSubscription.CancelAt.IsZero() {
+				http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+				return
+			}
+			params = &stripe.SubscriptionParams{
+				CancelAtPeriodEnd: stripe.Bool(false),
+			}
+		case "cancel", "acceptOffer":
+			if !currentSubscription.CancelAt.IsZero() {
+				http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+				return
+			}
+			reason = r.Form.Get("reason")
+			validReason := false
+			for _, cancellationReason := range cancellationReasons {
+				if cancellationReason.Value == reason {
+					validReason = true
+					break
+				}
+			}
+			if !validReason {
+				nbrew.BadRequest(w, r, fmt.Errorf("invalid reason %q", reason))
+				return
+			}
+			comment = strings.TrimSpace(r.Form.Get("comment"))
+			if action == "acceptOffer" {
+				if !offerAvailable {
+					nbrew.BadRequest(w, r, fmt.Errorf("no retention offer available"))
+					return
+				}
+				params = &stripe.SubscriptionParams{
+					Discounts: []*stripe.SubscriptionDiscountParams{{
+						Coupon: stripe.String(stripeConfig.RetentionOffer.CouponID),
+					}},
+				}
+			} else {
+				params = &stripe.SubscriptionParams{
+					CancelAtPeriodEnd: stripe.Bool(true),
+					CancellationDetails: &stripe.SubscriptionCancellationDetailsParams{
+						Feedback: stripe.String(reason),
+					},
+				}
+				if comment != "" {
+					params.CancellationDetails.Comment = stripe.String(comment)
+				}
+			}
+		default:
+			nbrew.BadRequest(w, r, fmt.Errorf("invalid action %q", action))
+			return
+		}
+		stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		fetchTime := time.Now().Unix()
+		stripeSubscription, err := stripeClient.Subscriptions.Update(currentSubscription.SubscriptionID, params)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		_, err = saveSubscription(r.Context(), nbrew, stripeSubscription, fetchTime)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		postRedirectGet := map[string]any{
+			"from": "stripe/cancel",
+		}
+		switch action {
+		case "resume":
+			_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format: "UPDATE cancellation SET status = 'resumed', resume_time = {resumeTime}" +
+					" WHERE subscription_id = {subscriptionID} AND status = 'canceled'",
+				Values: []any{
+					sq.Int64Param("resumeTime", time.Now().Unix()),
+					sq.StringParam("subscriptionID", currentSubscription.SubscriptionID),
+				},
+			})
+			postRedirectGet["from"] = "stripe/cancel/resume"
+		case "acceptOffer":
+			err = recordCancellation(r.Context(), nbrew, currentSubscription, reason, comment, "retained")
+			postRedirectGet["from"] = "stripe/cancel/offer"
+			postRedirectGet["offer"] = stripeConfig.RetentionOffer.Description
+		case "cancel":
+			err = recordCancellation(r.Context(), nbrew, currentSubscription, reason, comment, "canceled")
+		}
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		err = nbrew.SetFlashSession(w, r, map[string]any{
+			"postRedirectGet": postRedirectGet,
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+		return
+	}
+
+	response := Response{
+		UserID:                user.UserID,
+		Username:              user.Username,
+		TimezoneOffsetSeconds: user.TimezoneOffsetSeconds,
+		DisableReason:         user.DisableReason,
+		Plan:                  currentPlan,
+		CurrentPeriodEnd:      currentSubscription.CurrentPeriodEnd,
+		CancelAt:              currentSubscription.CancelAt,
+		Reasons:               cancellationReasons,
+	}
+	if offerAvailable {
+		response.RetentionOffer = &stripeConfig.RetentionOffer
+	}
+	if r.Form.Has("api") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(&response)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+		}
+		return
+	}
+	referer := nbrew.GetReferer(r)
+	funcMap := map[string]any{
+		"stylesCSS":  func() template.CSS { return template.CSS(notebrew.StylesCSS) },
+		"baselineJS": func() template.JS { return template.JS(notebrew.BaselineJS) },
+		"referer":    func() string { return referer },
+		"formatTime": func(t time.Time, layout string, offset int) string {
+			return t.In(time.FixedZone("", offset)).Format(layout)
+		},
+	}
+	tmpl, err := template.New("cancel.html").Funcs(funcMap).ParseFS(RuntimeFS, "embed/cancel.html")
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", nbrew.ContentSecurityPolicy)
+	nbrew.ExecuteTemplate(w, r, tmpl, &response)
+}
+
+// retentionOfferAvailable reports whether the retention offer can be shown to
+// a customer. Each customer can only accept the offer once.
+func retentionOfferAvailable(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string) (bool, error) {
+	if stripeConfig.RetentionOffer.CouponID == "" {
+		return false, nil
+	}
+	accepted, err := sq.FetchExists(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM cancellation WHERE customer_id = {customerID} AND status = 'retained'",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return !accepted, nil
+}
+
+// recordCancellation records the reason a user gave for canceling their
+// subscription, along with whether they went through with it ("canceled") or
+// accepted the retention offer ("retained").
+func recordCancellation(ctx context.Context, nbrew *notebrew.Notebrew, subscription Subscription, reason, comment, status string) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO cancellation (cancellation_id, subscription_id, customer_id, reason, comment, status, creation_time)" +
+			" VALUES ({cancellationID}, {subscriptionID}, {customerID}, {reason}, {comment}, {status}, {creationTime})",
+		Values: []any{
+			sq.UUIDParam("cancellationID", notebrew.NewID()),
+			sq.StringParam("subscriptionID", subscription.SubscriptionID),
+			sq.StringParam("customerID", subscription.CustomerID),
+			sq.StringParam("reason", reason),
+			sq.StringParam("comment", comment),
+			sq.StringParam("status", status),
+			sq.Int64Param("creationTime", time.Now().Unix()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
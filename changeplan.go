@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// stripeChangePlan moves a subscribed user to a different plan by swapping
+// the price of the plan item on their existing subscription. A GET request
+// previews the prorated amount using Stripe's upcoming invoice and a POST
+// request confirms the change, using the same proration date as the preview
+// so that the user is charged exactly what they were shown.
+func stripeChangePlan(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	type Response struct {
+		UserID                notebrew.ID `json:"userID"`
+		Username              string      `json:"username"`
+		TimezoneOffsetSeconds int         `json:"timezoneOffsetSeconds"`
+		DisableReason         string      `json:"disableReason"`
+		CurrentPlan           Plan        `json:"currentPlan"`
+		CurrentPrice          PlanPrice   `json:"currentPrice"`
+		NewPlan               Plan        `json:"newPlan"`
+		NewPrice              PlanPrice   `json:"newPrice"`
+		ProrationDate         int64       `json:"prorationDate"`
+		ProrationAmount       int64       `json:"prorationAmount"`
+		NextInvoiceAmount     int64       `json:"nextInvoiceAmount"`
+		NextInvoiceDate       time.Time   `json:"nextInvoiceDate"`
+		Currency              string      `json:"currency"`
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	}
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	priceID := r.Form.Get("priceID")
+	if priceID == "" {
+		nbrew.BadRequest(w, r, fmt.Errorf("priceID not provided"))
+		return
+	}
+	newPlan, ok := stripeConfig.PlanByPriceID(priceID)
+	if !ok || newPlan.Archived || newPlan.OneTime {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid priceID"))
+		return
+	}
+	newPrice, _ := newPlan.PriceByID(priceID)
+	currentSubscription, currentItem, currentPlan, ok, err := getPlanSubscription(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if !ok {
+		nbrew.BadRequest(w, r, fmt.Errorf("user has no subscription"))
+		return
+	}
+	if priceID == currentItem.PriceID {
+		http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+		return
+	}
+	currentPrice, _ := currentPlan.PriceByID(currentItem.PriceID)
+	items := []*stripe.SubscriptionItemsParams{{
+		ID:    stripe.String(currentItem.ItemID),
+		Price: stripe.String(priceID),
+	}}
+	// Leaving a per-seat plan drops the extra seats (and with them the
+	// team's members).
+	if currentPlan.PerSeat && !newPlan.PerSeat {
+		items[0].Quantity = stripe.Int64(1)
+	}
+	// The metered overage item follows the plan: it is swapped for the new
+	// plan's overage price, removed if the new plan doesn't bill for
+	// overage, or added if only the new plan does.
+	newOveragePriceID := newPlan.OveragePriceFor(newPrice.Interval)
+	hasOverageItem := false
+	for _, item := range currentSubscription.Items {
+		// Every price on a subscription must have the same billing
+		// interval, and add-ons don't have a price for every interval.
+		if _, ok := stripeConfig.AddOnByPriceID(item.PriceID); ok && newPrice.Interval != currentPrice.Interval {
+			nbrew.BadRequest(w, r, fmt.Errorf("the billing interval cannot be changed while the subscription has add-ons"))
+			return
+		}
+		if !currentPlan.IsOveragePrice(item.PriceID) {
+			continue
+		}
+		hasOverageItem = true
+		if newOveragePriceID == "" {
+			items = append(items, &stripe.SubscriptionItemsParams{
+				ID:      stripe.String(item.ItemID),
+				Deleted: stripe.Bool(true),
+			})
+		} else if item.PriceID != newOveragePriceID {
+			items = append(items, &stripe.SubscriptionItemsParams{
+				ID:    stripe.String(item.ItemID),
+				Price: stripe.String(newOveragePriceID),
+			})
+		}
+	}
+	if !hasOverageItem && newOveragePriceID != "" {
+		items = append(items, &stripe.SubscriptionItemsParams{
+			Price: stripe.String(newOveragePriceID),
+		})
+	}
+
+	stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if r.Method == "POST" {
+		// A stale preview (or a missing proration date) sends the user back
+		// to the preview page so that they confirm an up-to-date amount.
+		prorationDate, err := strconv.ParseInt(r.Form.Get("prorationDate"), 10, 64)
+		if err != nil || prorationDate > time.Now().Unix() || time.Since(time.Unix(prorationDate, 0)) > time.Hour {
+			http.Redirect(w, r, "/stripe/changeplan/?priceID="+url.QueryEscape(priceID), http.StatusSeeOther)
+			return
+		}
+		fetchTime := time.Now().Unix()
+		stripeSubscription, err := stripeClient.Subscriptions.Update(currentSubscription.SubscriptionID, &stripe.SubscriptionParams{
+			Items:             items,
+			ProrationBehavior: stripe.String("create_prorations"),
+			ProrationDate:     stripe.Int64(prorationDate),
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		_, err = saveSubscription(r.Context(), nbrew, stripeSubscription, fetchTime)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		entitlement, err := syncEntitlement(r.Context(), nbrew, stripeConfig, user.UserID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		err = syncTeamEntitlements(r.Context(), nbrew, stripeConfig, user.CustomerID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		err = nbrew.SetFlashSession(w, r, map[string]any{
+			"postRedirectGet": map[string]any{
+				"from":         "stripe/changeplan",
+				"planName":     newPlan.Name,
+				"siteLimit":    entitlement.SiteLimit,
+				"storageLimit": entitlement.StorageLimit,
+			},
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+		return
+	}
+
+	response := Response{
+		UserID:                user.UserID,
+		Username:              user.Username,
+		TimezoneOffsetSeconds: user.TimezoneOffsetSeconds,
+		DisableReason:         user.DisableReason,
+		CurrentPlan:           currentPlan,
+		CurrentPrice:          currentPrice,
+		NewPlan:               newPlan,
+		NewPrice:              newPrice,
+		ProrationDate:         time.Now().Unix(),
+	}
+	upcomingInvoice, err := stripeClient.Invoices.Upcoming(&stripe.InvoiceUpcomingParams{
+		Customer:                      stripe.String(user.CustomerID),
+		Subscription:                  stripe.String(currentSubscription.SubscriptionID),
+		SubscriptionItems:             items,
+		SubscriptionProrationBehavior: stripe.String("create_prorations"),
+		SubscriptionProrationDate:     stripe.Int64(response.ProrationDate),
+	})
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if upcomingInvoice.Lines != nil {
+		for _, line := range upcomingInvoice.Lines.Data {
+			if line.Proration {
+				response.ProrationAmount += line.Amount
+			}
+		}
+	}
+	response.NextInvoiceAmount = upcomingInvoice.AmountDue
+	response.Currency = string(upcomingInvoice.Currency)
+	if upcomingInvoice.NextPaymentAttempt != 0 {
+		response.NextInvoiceDate = time.Unix(upcomingInvoice.NextPaymentAttempt, 0).UTC()
+	} else {
+		response.NextInvoiceDate = time.Unix(upcomingInvoice.PeriodEnd, 0).UTC()
+	}
+	if r.Form.Has("api") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(&response)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+		}
+		return
+	}
+	referer := nbrew.GetReferer(r)
+	funcMap := map[string]any{
+		"humanReadableFileSize": notebrew.HumanReadableFileSize,
+		"stylesCSS":             func() template.CSS { return template.CSS(notebrew.StylesCSS) },
+		"baselineJS":            func() template.JS { return template.JS(notebrew.BaselineJS) },
+		"referer":               func() string { return referer },
+		"formatAmount": func(amount int64, currency string) string {
+			sign := ""
+			if amount < 0 {
+				sign = "-"
+				amount = -amount
+			}
+			return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, strings.ToUpper(currency))
+		},
+		"formatTime": func(t time.Time, layout string, offset int) string {
+			return t.In(time.FixedZone("", offset)).Format(layout)
+		},
+	}
+	tmpl, err := template.New("changeplan.html").Funcs(funcMap).ParseFS(RuntimeFS, "embed/changeplan.html")
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", nbrew.ContentSecurityPolicy)
+	nbrew.ExecuteTemplate(w, r, tmpl, &response)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// readConfig reads and validates stripe.json and signupdisabled.txt in the
+// config directory.
+func readConfig(configDir string) (stripeConfig StripeConfig, signupDisabled bool, err error) {
+	filePath := filepath.Join(configDir, "stripe.json")
+	b, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return StripeConfig{}, false, fmt.Errorf("%s: %w", filePath, err)
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&stripeConfig)
+		if err != nil {
+			return StripeConfig{}, false, fmt.Errorf("%s: %w", filePath, err)
+		}
+		if stripeConfig.Test != nil && stripeConfig.Test.Test != nil {
+			return StripeConfig{}, false, fmt.Errorf("%s: test: test must not be nested", filePath)
+		}
+		for _, config := range []*StripeConfig{&stripeConfig, stripeConfig.Test} {
+			if config == nil {
+				continue
+			}
+			prefix := ""
+			if config == stripeConfig.Test {
+				prefix = "test: "
+			}
+			if config.PlansFromStripe {
+				if len(config.Plans) > 0 {
+					return StripeConfig{}, false, fmt.Errorf("%s: %splans must be empty if plansFromStripe is true", filePath, prefix)
+				}
+				config.Plans, err = fetchStripePlans(config.Client())
+				if err != nil {
+					return StripeConfig{}, false, fmt.Errorf("%s: %splansFromStripe: %w", filePath, prefix, err)
+				}
+			}
+			err = config.validate()
+			if err != nil {
+				return StripeConfig{}, false, fmt.Errorf("%s: %s%w", filePath, prefix, err)
+			}
+		}
+	}
+	filePath = filepath.Join(configDir, "signupdisabled.txt")
+	b, err = os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return StripeConfig{}, false, fmt.Errorf("%s: %w", filePath, err)
+	}
+	signupDisabled, _ = strconv.ParseBool(string(bytes.TrimSpace(b)))
+	return stripeConfig, signupDisabled, nil
+}
+
+// validate checks for mistakes in the config that would otherwise only
+// surface when a user checks out or a webhook event arrives.
+func (stripeConfig StripeConfig) validate() error {
+	switch stripeConfig.Provider {
+	case "", "stripe":
+	case "manual":
+		// Everything other than subscribing to a plan goes through the
+		// Stripe API.
+		switch {
+		case stripeConfig.PlansFromStripe:
+			return fmt.Errorf("provider: plansFromStripe requires the stripe provider")
+		case len(stripeConfig.AddOns) > 0:
+			return fmt.Errorf("provider: addOns require the stripe provider")
+		case len(stripeConfig.Gifts) > 0:
+			return fmt.Errorf("provider: gifts require the stripe provider")
+		case len(stripeConfig.Coupons) > 0 || stripeConfig.RetentionOffer.CouponID != "":
+			return fmt.Errorf("provider: coupons require the stripe provider")
+		case stripeConfig.Test != nil:
+			return fmt.Errorf("provider: the manual provider has no test mode")
+		}
+		for _, plan := range stripeConfig.Plans {
+			if plan.OneTime || plan.PerSeat || plan.OveragePriceID != "" {
+				return fmt.Errorf("plan %q: one-time, per-seat and overage plans require the stripe provider", plan.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("provider: unknown provider %q (must be stripe or manual)", stripeConfig.Provider)
+	}
+	owners := make(map[string]string)
+	addPriceID := func(priceID, owner string) error {
+		if priceID == "" {
+			return nil
+		}
+		if existingOwner, ok := owners[priceID]; ok {
+			return fmt.Errorf("priceID %q is used by both %s and %s", priceID, existingOwner, owner)
+		}
+		owners[priceID] = owner
+		return nil
+	}
+	for i, plan := range stripeConfig.Plans {
+		if plan.Name == "" {
+			return fmt.Errorf("plans[%d]: name is empty", i)
+		}
+		if plan.OneTime {
+			if plan.PriceID == "" || len(plan.Prices) > 0 {
+				return fmt.Errorf("plan %q: a one-time plan must have a priceID and no other prices", plan.Name)
+			}
+			if plan.OveragePriceID != "" || plan.TrialDays > 0 {
+				return fmt.Errorf("plan %q: a one-time plan cannot have an overage price or a free trial", plan.Name)
+			}
+			if plan.DurationDays < 0 {
+				return fmt.Errorf("plan %q: durationDays must not be negative", plan.Name)
+			}
+		} else if plan.DurationDays != 0 {
+			return fmt.Errorf("plan %q: durationDays is only for one-time plans", plan.Name)
+		}
+		if plan.PerSeat {
+			if plan.OneTime {
+				return fmt.Errorf("plan %q: a one-time plan cannot be per seat", plan.Name)
+			}
+			// Members don't pay for the storage they use, so they cannot be
+			// given a plan that bills the subscriber for overage.
+			if plan.OveragePriceID != "" {
+				return fmt.Errorf("plan %q: a per-seat plan cannot have an overage price", plan.Name)
+			}
+		}
+		for _, price := range plan.AllPrices() {
+			if price.Interval != "month" && price.Interval != "year" && !plan.OneTime {
+				return fmt.Errorf("plan %q: priceID %q: interval must be month or year, got %q", plan.Name, price.PriceID, price.Interval)
+			}
+			err := addPriceID(price.PriceID, "plan "+strconv.Quote(plan.Name))
+			if err != nil {
+				return err
+			}
+			if plan.OveragePriceID != "" && price.OveragePriceID == "" {
+				return fmt.Errorf("plan %q: priceID %q: overagePriceID is empty (a plan that bills for overage needs a metered price for every interval)", plan.Name, price.PriceID)
+			}
+			if plan.OveragePriceID == "" && price.OveragePriceID != "" {
+				return fmt.Errorf("plan %q: priceID %q: overagePriceID is set but the plan has no overagePriceID", plan.Name, price.PriceID)
+			}
+			err = addPriceID(price.OveragePriceID, "plan "+strconv.Quote(plan.Name))
+			if err != nil {
+				return err
+			}
+		}
+		if plan.PriceID == "" {
+			err := addPriceID(plan.OveragePriceID, "plan "+strconv.Quote(plan.Name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i, addOn := range stripeConfig.AddOns {
+		if addOn.PriceID == "" {
+			return fmt.Errorf("addOns[%d]: priceID is empty", i)
+		}
+		err := addPriceID(addOn.PriceID, "add-on "+strconv.Quote(addOn.Name))
+		if err != nil {
+			return err
+		}
+	}
+	for i, gift := range stripeConfig.Gifts {
+		if gift.PriceID == "" {
+			return fmt.Errorf("gifts[%d]: priceID is empty", i)
+		}
+		if gift.Months < 1 {
+			return fmt.Errorf("gift %q: months must be at least 1", gift.Name)
+		}
+		planIndex := slices.IndexFunc(stripeConfig.Plans, func(plan Plan) bool { return plan.Name == gift.Plan })
+		if planIndex < 0 {
+			return fmt.Errorf("gift %q: no plan named %q", gift.Name, gift.Plan)
+		}
+		if plan := stripeConfig.Plans[planIndex]; plan.IsFree() || plan.OneTime || plan.PerSeat {
+			return fmt.Errorf("gift %q: plan %q must be a subscription plan for a single user", gift.Name, gift.Plan)
+		}
+		err := addPriceID(gift.PriceID, "gift "+strconv.Quote(gift.Name))
+		if err != nil {
+			return err
+		}
+	}
+	for i, webhookSecret := range stripeConfig.WebhookSecrets {
+		if webhookSecret.Secret == "" {
+			return fmt.Errorf("webhookSecrets[%d]: secret is empty", i)
+		}
+	}
+	if stripeConfig.RetentionOffer.Description != "" && stripeConfig.RetentionOffer.CouponID == "" {
+		return fmt.Errorf("retentionOffer: couponID is empty")
+	}
+	codes := make(map[string]bool)
+	for i, coupon := range stripeConfig.Coupons {
+		if coupon.Code == "" || coupon.CouponID == "" {
+			return fmt.Errorf("coupons[%d]: code and couponID must not be empty", i)
+		}
+		if codes[coupon.Code] {
+			return fmt.Errorf("coupons[%d]: duplicate code %q", i, coupon.Code)
+		}
+		codes[coupon.Code] = true
+	}
+	return nil
+}
+
+// configChanges describes the differences between two configs, for logging.
+// Secrets are reported as changed without their values.
+func configChanges(oldConfig, newConfig StripeConfig, oldSignupDisabled, newSignupDisabled bool) []string {
+	var changes []string
+	oldValue, newValue := reflect.ValueOf(oldConfig), reflect.ValueOf(newConfig)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("json"), ",")
+		if name == "plans" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changes = append(changes, name+" changed")
+		}
+	}
+	var names []string
+	oldPlans := make(map[string][]Plan)
+	newPlans := make(map[string][]Plan)
+	for _, plan := range oldConfig.Plans {
+		if !slices.Contains(names, plan.Name) {
+			names = append(names, plan.Name)
+		}
+		oldPlans[plan.Name] = append(oldPlans[plan.Name], plan)
+	}
+	for _, plan := range newConfig.Plans {
+		if !slices.Contains(names, plan.Name) {
+			names = append(names, plan.Name)
+		}
+		newPlans[plan.Name] = append(newPlans[plan.Name], plan)
+	}
+	for _, name := range names {
+		switch {
+		case oldPlans[name] == nil:
+			changes = append(changes, "plan "+strconv.Quote(name)+" added")
+		case newPlans[name] == nil:
+			changes = append(changes, "plan "+strconv.Quote(name)+" removed")
+		case !reflect.DeepEqual(oldPlans[name], newPlans[name]):
+			changes = append(changes, "plan "+strconv.Quote(name)+" changed")
+		}
+	}
+	if oldSignupDisabled != newSignupDisabled {
+		if newSignupDisabled {
+			changes = append(changes, "signups disabled")
+		} else {
+			changes = append(changes, "signups enabled")
+		}
+	}
+	return changes
+}
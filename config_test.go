@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	type TestTable struct {
+		description    string
+		stripeJSON     string
+		signupDisabled string
+		err            string
+	}
+	tests := []TestTable{{
+		description: "no config",
+	}, {
+		description:    "valid config",
+		stripeJSON:     `{"plans": [{"name": "Free"}, {"name": "Pro", "priceID": "price_pro"}]}`,
+		signupDisabled: "true",
+	}, {
+		description: "unknown field",
+		stripeJSON:  `{"plan": []}`,
+		err:         `unknown field "plan"`,
+	}, {
+		description: "duplicate priceID",
+		stripeJSON:  `{"plans": [{"name": "Pro", "priceID": "price_pro"}], "addOns": [{"name": "+1 site", "priceID": "price_pro"}]}`,
+		err:         `priceID "price_pro" is used by both plan "Pro" and add-on "+1 site"`,
+	}, {
+		description: "invalid interval",
+		stripeJSON:  `{"plans": [{"name": "Pro", "prices": [{"interval": "week", "priceID": "price_pro_weekly"}]}]}`,
+		err:         "interval must be month or year",
+	}, {
+		description: "duplicate coupon",
+		stripeJSON:  `{"coupons": [{"code": "LAUNCH", "couponID": "a"}, {"code": "LAUNCH", "couponID": "b"}]}`,
+		err:         `duplicate code "LAUNCH"`,
+	}, {
+		description: "per-seat overage plan",
+		stripeJSON:  `{"plans": [{"name": "Team", "priceID": "price_team", "perSeat": true, "overagePriceID": "price_team_overage"}]}`,
+		err:         "a per-seat plan cannot have an overage price",
+	}, {
+		description: "overage plan without a yearly overage price",
+		stripeJSON:  `{"plans": [{"name": "Metered", "priceID": "price_metered", "overagePriceID": "price_overage", "prices": [{"interval": "year", "priceID": "price_metered_yearly"}]}]}`,
+		err:         `plan "Metered": priceID "price_metered_yearly": overagePriceID is empty`,
+	}, {
+		description: "gift of unknown plan",
+		stripeJSON:  `{"gifts": [{"name": "3 months of Pro", "plan": "Pro", "months": 3, "priceID": "price_gift"}]}`,
+		err:         `gift "3 months of Pro": no plan named "Pro"`,
+	}, {
+		description: "gift without months",
+		stripeJSON:  `{"plans": [{"name": "Pro", "priceID": "price_pro"}], "gifts": [{"name": "Pro", "plan": "Pro", "priceID": "price_gift"}]}`,
+		err:         `gift "Pro": months must be at least 1`,
+	}, {
+		description: "empty webhook secret",
+		stripeJSON:  `{"webhookSecrets": [{"label": "old", "secret": ""}]}`,
+		err:         "webhookSecrets[0]: secret is empty",
+	}, {
+		description: "invalid test config",
+		stripeJSON:  `{"test": {"plans": [{"name": ""}]}}`,
+		err:         "test: plans[0]: name is empty",
+	}, {
+		description: "nested test config",
+		stripeJSON:  `{"test": {"test": {}}}`,
+		err:         "test must not be nested",
+	}, {
+		description: "manual provider",
+		stripeJSON:  `{"provider": "manual", "plans": [{"name": "Free"}, {"name": "Pro", "priceID": "price_pro"}]}`,
+	}, {
+		description: "unknown provider",
+		stripeJSON:  `{"provider": "paypal"}`,
+		err:         `unknown provider "paypal"`,
+	}, {
+		description: "manual provider with add-ons",
+		stripeJSON:  `{"provider": "manual", "addOns": [{"name": "+1 site", "priceID": "price_site"}]}`,
+		err:         "addOns require the stripe provider",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			configDir := t.TempDir()
+			if tt.stripeJSON != "" {
+				err := os.WriteFile(filepath.Join(configDir, "stripe.json"), []byte(tt.stripeJSON), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.signupDisabled != "" {
+				err := os.WriteFile(filepath.Join(configDir, "signupdisabled.txt"), []byte(tt.signupDisabled), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, signupDisabled, err := readConfig(configDir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signupDisabled != (tt.signupDisabled == "true") {
+				t.Errorf("signupDisabled: expected %t, got %t", tt.signupDisabled == "true", signupDisabled)
+			}
+		})
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	oldConfig := testStripeConfig
+	newConfig := testStripeConfig
+	newConfig.WebhookSecret = "whsec_new"
+	newConfig.Plans = append([]Plan{}, testStripeConfig.Plans[:2]...)
+	newConfig.Plans[1].SiteLimit = 20
+	newConfig.Plans = append(newConfig.Plans, Plan{Name: "Enterprise", PriceID: "price_enterprise"})
+	changes := configChanges(oldConfig, newConfig, false, true)
+	expected := []string{
+		"webhookSecret changed",
+		`plan "Pro" changed`,
+		`plan "Business" removed`,
+		`plan "Legacy" removed`,
+		`plan "Lifetime" removed`,
+		`plan "30-day pass" removed`,
+		`plan "Team" removed`,
+		`plan "Enterprise" added`,
+		"signups disabled",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %q, got %q", expected, changes)
+	}
+	if changes := configChanges(oldConfig, oldConfig, false, false); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
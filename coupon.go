@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// CouponByCode returns the coupon with the given code.
+func (stripeConfig StripeConfig) CouponByCode(code string) (Coupon, bool) {
+	if code == "" {
+		return Coupon{}, false
+	}
+	for _, coupon := range stripeConfig.Coupons {
+		if coupon.Code == code {
+			return coupon, true
+		}
+	}
+	return Coupon{}, false
+}
+
+// setCouponCookie remembers the coupon in a ?coupon= link so that it can be
+// applied when the user eventually checks out, which may only be after they
+// have signed up and logged in. An unknown coupon code clears the cookie.
+func setCouponCookie(w http.ResponseWriter, r *http.Request, stripeConfig StripeConfig) {
+	coupon, ok := stripeConfig.CouponByCode(r.Form.Get("coupon"))
+	if !ok {
+		http.SetCookie(w, &http.Cookie{
+			Path:     "/",
+			Name:     "coupon",
+			Value:    "",
+			MaxAge:   -1,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     "coupon",
+		Value:    coupon.Code,
+		MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getCoupon returns the coupon that applies to the request, either from the
+// coupon form value or from the coupon cookie.
+func getCoupon(r *http.Request, stripeConfig StripeConfig) (Coupon, bool) {
+	if r.Form.Has("coupon") {
+		return stripeConfig.CouponByCode(r.Form.Get("coupon"))
+	}
+	cookie, _ := r.Cookie("coupon")
+	if cookie == nil {
+		return Coupon{}, false
+	}
+	return stripeConfig.CouponByCode(cookie.Value)
+}
+
+// recordRedemption records the discount applied to a completed checkout
+// session. It is called from both the checkout success page and the
+// checkout.session.completed webhook, whichever comes first. Only the
+// checkout success page expands the discount breakdown, so the coupon and
+// promotion code IDs are filled in if a redemption has already been recorded
+// without them.
+func recordRedemption(ctx context.Context, nbrew *notebrew.Notebrew, checkoutSession *stripe.CheckoutSession) error {
+	if checkoutSession.TotalDetails == nil || checkoutSession.TotalDetails.AmountDiscount == 0 {
+		return nil
+	}
+	var customerID, couponID, promotionCodeID string
+	if checkoutSession.Customer != nil {
+		customerID = checkoutSession.Customer.ID
+	}
+	if checkoutSession.TotalDetails.Breakdown != nil {
+		for _, discount := range checkoutSession.TotalDetails.Breakdown.Discounts {
+			if discount.Discount == nil {
+				continue
+			}
+			if discount.Discount.Coupon != nil {
+				couponID = discount.Discount.Coupon.ID
+			}
+			if discount.Discount.PromotionCode != nil {
+				promotionCodeID = discount.Discount.PromotionCode.ID
+			}
+			break
+		}
+	}
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO coupon_redemption (checkout_session_id, customer_id, coupon_code, coupon_id, promotion_code_id, amount_discount, currency, redemption_time)" +
+			" VALUES ({checkoutSessionID}, {customerID}, {couponCode}, {couponID}, {promotionCodeID}, {amountDiscount}, {currency}, {redemptionTime})",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSession.ID),
+			sq.StringParam("customerID", customerID),
+			sq.StringParam("couponCode", checkoutSession.Metadata["coupon"]),
+			sq.StringParam("couponID", couponID),
+			sq.StringParam("promotionCodeID", promotionCodeID),
+			sq.Int64Param("amountDiscount", checkoutSession.TotalDetails.AmountDiscount),
+			sq.StringParam("currency", string(checkoutSession.Currency)),
+			sq.Int64Param("redemptionTime", time.Now().Unix()),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return err
+	}
+	if couponID == "" && promotionCodeID == "" {
+		return nil
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE coupon_redemption" +
+			" SET coupon_id = {couponID}, promotion_code_id = {promotionCodeID}" +
+			" WHERE checkout_session_id = {checkoutSessionID}",
+		Values: []any{
+			sq.StringParam("couponID", couponID),
+			sq.StringParam("promotionCodeID", promotionCodeID),
+			sq.StringParam("checkoutSessionID", checkoutSession.ID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+	"golang.org/x/crypto/blake2b"
+)
+
+// syncCustomerDetails copies a user's email and username to the email and
+// name of their Stripe customer, so that receipts and invoices go to the
+// address they currently use. It only calls Stripe if either has changed
+// since it was last synced, and does nothing for users without a Stripe
+// customer.
+func syncCustomerDetails(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, userID notebrew.ID) error {
+	type Details struct {
+		CustomerID  string
+		Email       string
+		Username    string
+		SyncedEmail string
+		SyncedName  string
+	}
+	details, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM customer" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE customer.user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) Details {
+		return Details{
+			CustomerID:  row.String("customer.customer_id"),
+			Email:       row.String("users.email"),
+			Username:    row.String("users.username"),
+			SyncedEmail: row.String("customer.synced_email"),
+			SyncedName:  row.String("customer.synced_name"),
+		}
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	// Customers of the manual provider are not in Stripe.
+	if stripeConfig.SecretKey == "" || strings.HasPrefix(details.CustomerID, "mcus_") {
+		return nil
+	}
+	if details.Email == details.SyncedEmail && details.Username == details.SyncedName {
+		return nil
+	}
+	stripeClient, err := customerClient(ctx, nbrew, stripeConfig, details.CustomerID)
+	if err != nil {
+		return err
+	}
+	stripeCustomer, err := stripeClient.Customers.Update(details.CustomerID, &stripe.CustomerParams{
+		Email: stripe.String(details.Email),
+		Name:  stripe.String(details.Username),
+	})
+	if err != nil {
+		return fmt.Errorf("customer %s: %w", details.CustomerID, err)
+	}
+	// The customer.updated event for this update may arrive before or after
+	// the row is written, so the event time is set to now to keep an older
+	// event from overwriting stripe_email with the previous address.
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE customer" +
+			" SET synced_email = {syncedEmail}, synced_name = {syncedName}, stripe_email = {stripeEmail}, event_time = {eventTime}" +
+			" WHERE customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("syncedEmail", details.Email),
+			sq.StringParam("syncedName", details.Username),
+			sq.StringParam("stripeEmail", stripeCustomer.Email),
+			sq.Int64Param("eventTime", time.Now().Unix()),
+			sq.StringParam("customerID", details.CustomerID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// runCustomerSync syncs the details of every user whose email or username has
+// changed since their Stripe customer was last synced. It picks up changes
+// that were not synced straight away, such as an email change confirmed from
+// a link opened without a session.
+func runCustomerSync(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	if stripeConfig.Provider == "manual" || stripeConfig.SecretKey == "" {
+		return nil
+	}
+	userIDs, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM customer" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE customer.customer_id NOT LIKE 'mcus%'" +
+			" AND (customer.synced_email <> users.email OR customer.synced_name <> users.username)",
+	}, func(row *sq.Row) notebrew.ID {
+		return row.UUID("customer.user_id")
+	})
+	if err != nil {
+		return err
+	}
+	// One customer failing to sync (e.g. because it was deleted in Stripe)
+	// shouldn't hold up the rest.
+	var errs []error
+	for _, userID := range userIDs {
+		err := syncCustomerDetails(ctx, nbrew, stripeConfig, userID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// initCustomerSync records the current email and username of every user as
+// already synced to their Stripe customer if nothing has been synced for it
+// yet, so that runCustomerSync only pushes changes made from now on instead
+// of overwriting the details of customers created before syncing existed.
+func initCustomerSync(ctx context.Context, nbrew *notebrew.Notebrew) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE customer" +
+			" SET synced_email = (SELECT email FROM users WHERE users.user_id = customer.user_id)" +
+			", synced_name = (SELECT username FROM users WHERE users.user_id = customer.user_id)" +
+			" WHERE synced_email IS NULL AND synced_name IS NULL",
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// saveCustomerEmail records the email of a Stripe customer from a
+// customer.updated event. Stripe does not guarantee the order in which
+// events are delivered, so the email is only overwritten if eventTime is not
+// older than the event it was last saved from. The returned mismatch is true
+// if the email differs from the email of the user linked to the customer,
+// which happens when the customer changes it in the customer portal or it
+// is changed from the Stripe dashboard.
+func saveCustomerEmail(ctx context.Context, nbrew *notebrew.Notebrew, stripeCustomer *stripe.Customer, eventTime int64) (mismatch bool, err error) {
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE customer SET stripe_email = {stripeEmail}, event_time = {eventTime}" +
+			" WHERE customer_id = {customerID} AND coalesce(event_time, 0) <= {eventTime}",
+		Values: []any{
+			sq.StringParam("stripeEmail", stripeCustomer.Email),
+			sq.Int64Param("eventTime", eventTime),
+			sq.StringParam("customerID", stripeCustomer.ID),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	type Emails struct {
+		StripeEmail string
+		UserEmail   string
+	}
+	emails, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM customer" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE customer.customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", stripeCustomer.ID),
+		},
+	}, func(row *sq.Row) Emails {
+		return Emails{
+			StripeEmail: row.String("customer.stripe_email"),
+			UserEmail:   row.String("users.email"),
+		}
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Not linked to a user (yet).
+			return false, nil
+		}
+		return false, err
+	}
+	return !strings.EqualFold(emails.StripeEmail, emails.UserEmail), nil
+}
+
+// getSessionUserID returns the userID of the session in the request's session
+// cookie, or false if there is no valid session.
+func getSessionUserID(nbrew *notebrew.Notebrew, r *http.Request) (notebrew.ID, bool, error) {
+	cookie, _ := r.Cookie("session")
+	if cookie == nil || cookie.Value == "" {
+		return notebrew.ID{}, false, nil
+	}
+	sessionTokenBytes, err := hex.DecodeString(fmt.Sprintf("%048s", cookie.Value))
+	if err != nil || len(sessionTokenBytes) != 24 {
+		return notebrew.ID{}, false, nil
+	}
+	var sessionTokenHash [8 + blake2b.Size256]byte
+	checksum := blake2b.Sum256(sessionTokenBytes[8:])
+	copy(sessionTokenHash[:8], sessionTokenBytes[:8])
+	copy(sessionTokenHash[8:], checksum[:])
+	userID, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM session WHERE session_token_hash = {sessionTokenHash}",
+		Values: []any{
+			sq.BytesParam("sessionTokenHash", sessionTokenHash[:]),
+		},
+	}, func(row *sq.Row) notebrew.ID {
+		return row.UUID("user_id")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return notebrew.ID{}, false, nil
+		}
+		return notebrew.ID{}, false, err
+	}
+	return userID, true, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+)
+
+// enforceSiteLimit makes a user's sites read-only if they own more sites than
+// their site limit allows. The most recently updated sites are kept writable
+// and the rest are locked, so that lowering a user's site limit takes away
+// the sites they are least likely to be using. Sites are unlocked again once
+// the user is back within their site limit.
+func enforceSiteLimit(ctx context.Context, nbrew *notebrew.Notebrew, userID notebrew.ID, siteLimit int64) error {
+	siteNames, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM site" +
+			" JOIN site_owner ON site_owner.site_id = site.site_id" +
+			" LEFT JOIN site_activity ON site_activity.site_name = site.site_name" +
+			" WHERE site_owner.user_id = {userID}" +
+			" ORDER BY coalesce(site_activity.last_write_time, 0) DESC, site.site_name",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("site.site_name")
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM site_lock WHERE user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if siteLimit <= 0 || int64(len(siteNames)) <= siteLimit {
+		return nil
+	}
+	lockTime := time.Now().Unix()
+	for _, siteName := range siteNames[siteLimit:] {
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "INSERT INTO site_lock (site_name, user_id, lock_time) VALUES ({siteName}, {userID}, {lockTime})",
+			Values: []any{
+				sq.StringParam("siteName", siteName),
+				sq.UUIDParam("userID", userID),
+				sq.Int64Param("lockTime", lockTime),
+			},
+		})
+		if err != nil && !isKeyViolation(nbrew, err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// siteLocked reports whether a site has been made read-only for a user by
+// enforceSiteLimit. Locks are per owner: a co-owner who is within their own
+// site limit can still write to the site.
+func siteLocked(ctx context.Context, nbrew *notebrew.Notebrew, siteName string, userID notebrew.ID) (bool, error) {
+	return sq.FetchExists(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM site_lock WHERE site_name = {siteName} AND user_id = {userID}",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+			sq.UUIDParam("userID", userID),
+		},
+	})
+}
+
+// storageExceeded reports whether any owner of a site is using more storage
+// than their storage limit allows.
+func storageExceeded(ctx context.Context, nbrew *notebrew.Notebrew, siteName string) (bool, error) {
+	return sq.FetchExists(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT 1" +
+			" FROM site" +
+			" JOIN site_owner ON site_owner.site_id = site.site_id" +
+			" JOIN users ON users.user_id = site_owner.user_id" +
+			" WHERE site.site_name = {siteName}" +
+			" AND users.storage_limit > 0" +
+			" AND users.storage_limit < (" +
+			"SELECT sum(owned_site.storage_used)" +
+			" FROM site AS owned_site" +
+			" JOIN site_owner AS owned_site_owner ON owned_site_owner.site_id = owned_site.site_id" +
+			" WHERE owned_site_owner.user_id = users.user_id" +
+			")",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+		},
+	})
+}
+
+// recordSiteActivity records that a site has just been written to.
+func recordSiteActivity(ctx context.Context, nbrew *notebrew.Notebrew, siteName string) error {
+	lastWriteTime := time.Now().Unix()
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "INSERT INTO site_activity (site_name, last_write_time) VALUES ({siteName}, {lastWriteTime})",
+		Values: []any{
+			sq.StringParam("siteName", siteName),
+			sq.Int64Param("lastWriteTime", lastWriteTime),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE site_activity SET last_write_time = {lastWriteTime} WHERE site_name = {siteName}",
+		Values: []any{
+			sq.Int64Param("lastWriteTime", lastWriteTime),
+			sq.StringParam("siteName", siteName),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// enforceSiteLimitsAfterDelete is called after sites may have been deleted.
+// It clears the locks and activity of sites that no longer exist, so that a
+// new site created with the same name does not inherit them, and re-runs
+// enforceSiteLimit for every user who has locked sites so that deleting sites
+// to get back within the site limit unlocks the rest straight away.
+func enforceSiteLimitsAfterDelete(ctx context.Context, nbrew *notebrew.Notebrew) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM site_lock WHERE NOT EXISTS (SELECT 1 FROM site WHERE site.site_name = site_lock.site_name)",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM site_activity WHERE NOT EXISTS (SELECT 1 FROM site WHERE site.site_name = site_activity.site_name)",
+	})
+	if err != nil {
+		return err
+	}
+	userIDs, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT DISTINCT {*} FROM site_lock",
+	}, func(row *sq.Row) notebrew.ID {
+		return row.UUID("user_id")
+	})
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		err := func() error {
+			// Hold the same mutex as syncEntitlement, so that the site limit
+			// read here cannot be overwritten by a concurrent sync before
+			// its sites are locked.
+			mutex := &entitlementMutexes[userID[len(userID)-1]]
+			mutex.Lock()
+			defer mutex.Unlock()
+			siteLimit, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM users WHERE user_id = {userID}",
+				Values: []any{
+					sq.UUIDParam("userID", userID),
+				},
+			}, func(row *sq.Row) int64 {
+				return row.Int64("coalesce(site_limit, -1)")
+			})
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil
+				}
+				return err
+			}
+			return enforceSiteLimit(ctx, nbrew, userID, siteLimit)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusRecorder records the status code written to a ResponseWriter, so
+// that a handler can tell whether the request it passed on failed.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(p)
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// splitFilesPath splits the tail of a /files/ URL path into the site name
+// and the action (the first path segment after the site prefix). Sites
+// other than the default site are prefixed with "@" (e.g. @bokwoon) unless
+// they use a custom domain (e.g. example.com).
+func splitFilesPath(tail string) (siteName, action string) {
+	head, rest, _ := strings.Cut(tail, "/")
+	if strings.HasPrefix(head, "@") {
+		siteName = strings.TrimPrefix(head, "@")
+		action, _, _ = strings.Cut(rest, "/")
+		return siteName, action
+	}
+	if strings.Contains(head, ".") {
+		siteName = head
+		action, _, _ = strings.Cut(rest, "/")
+		return siteName, action
+	}
+	return "", head
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+)
+
+const dunningDisableReason = "payment overdue"
+
+// startDunning records that payment for a subscription has failed. The grace
+// period starts from the first failure and is not extended by subsequent
+// failures.
+func startDunning(ctx context.Context, nbrew *notebrew.Notebrew, subscriptionID, customerID, status string) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO dunning (subscription_id, customer_id, status, start_time)" +
+			" VALUES ({subscriptionID}, {customerID}, {status}, {startTime})",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscriptionID),
+			sq.StringParam("customerID", customerID),
+			sq.StringParam("status", status),
+			sq.Int64Param("startTime", time.Now().Unix()),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE dunning SET status = {status} WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.StringParam("status", status),
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// endDunning clears the dunning state of a subscription, re-enabling the
+// user's account if it was disabled by dunning.
+func endDunning(ctx context.Context, nbrew *notebrew.Notebrew, subscriptionID, customerID string) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "DELETE FROM dunning WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE users SET disable_reason = NULL" +
+			" WHERE user_id = (SELECT user_id FROM customer WHERE customer_id = {customerID})" +
+			" AND disable_reason = {disableReason}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+			sq.StringParam("disableReason", dunningDisableReason),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// runDunning emails reminders to users whose payments have failed and takes
+// the configured dunning action on users whose grace period is over.
+func runDunning(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	type Dunning struct {
+		SubscriptionID string
+		CustomerID     string
+		UserID         notebrew.ID
+		Email          string
+		StartTime      time.Time
+		LastEmailTime  time.Time
+	}
+	gracePeriod := time.Duration(stripeConfig.Dunning.GracePeriodDays) * 24 * time.Hour
+	if gracePeriod <= 0 {
+		gracePeriod = 14 * 24 * time.Hour
+	}
+	reminderInterval := time.Duration(stripeConfig.Dunning.ReminderIntervalDays) * 24 * time.Hour
+	if reminderInterval <= 0 {
+		reminderInterval = 3 * 24 * time.Hour
+	}
+	dunnings, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM dunning" +
+			" JOIN customer ON customer.customer_id = dunning.customer_id" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE dunning.end_time IS NULL",
+	}, func(row *sq.Row) Dunning {
+		dunning := Dunning{
+			SubscriptionID: row.String("dunning.subscription_id"),
+			CustomerID:     row.String("dunning.customer_id"),
+			UserID:         row.UUID("users.user_id"),
+			Email:          row.String("users.email"),
+			StartTime:      time.Unix(row.Int64("dunning.start_time"), 0).UTC(),
+		}
+		lastEmailTime := row.Int64("coalesce(dunning.last_email_time, 0)")
+		if lastEmailTime > 0 {
+			dunning.LastEmailTime = time.Unix(lastEmailTime, 0).UTC()
+		}
+		return dunning
+	})
+	if err != nil {
+		return err
+	}
+	scheme := "https://"
+	if !nbrew.CMSDomainHTTPS {
+		scheme = "http://"
+	}
+	profileURL := scheme + nbrew.CMSDomain + "/users/profile/"
+	for _, dunning := range dunnings {
+		now := time.Now()
+		gracePeriodEnd := dunning.StartTime.Add(gracePeriod)
+		if now.After(gracePeriodEnd) {
+			if stripeConfig.Dunning.Action == "disable" {
+				_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+					Dialect: nbrew.Dialect,
+					Format:  "UPDATE users SET disable_reason = {disableReason} WHERE user_id = {userID} AND coalesce(disable_reason, '') = ''",
+					Values: []any{
+						sq.StringParam("disableReason", dunningDisableReason),
+						sq.UUIDParam("userID", dunning.UserID),
+					},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "UPDATE dunning SET end_time = {endTime} WHERE subscription_id = {subscriptionID}",
+				Values: []any{
+					sq.Int64Param("endTime", now.Unix()),
+					sq.StringParam("subscriptionID", dunning.SubscriptionID),
+				},
+			})
+			if err != nil {
+				return err
+			}
+			// Once the dunning has ended the subscription no longer counts
+			// towards the user's entitlement (unless the dunning action is
+			// "disable").
+			_, err = syncEntitlement(ctx, nbrew, stripeConfig, dunning.UserID)
+			if err != nil {
+				return err
+			}
+			err = syncTeamEntitlements(ctx, nbrew, stripeConfig, dunning.CustomerID)
+			if err != nil {
+				return err
+			}
+			if nbrew.Mailer != nil {
+				var body string
+				if stripeConfig.Dunning.Action == "disable" {
+					body = fmt.Sprintf("<p>We were unable to collect payment for your notebrew subscription and your account has been disabled."+
+						" Update your payment details at <a href='%[1]s'>%[1]s</a> to re-enable it.</p>", profileURL)
+				} else {
+					body = fmt.Sprintf("<p>We were unable to collect payment for your notebrew subscription and your account has been moved to the free plan."+
+						" Update your payment details at <a href='%[1]s'>%[1]s</a> to restore your plan.</p>", profileURL)
+				}
+				nbrew.Mailer.C <- notebrew.Mail{
+					MailFrom: nbrew.MailFrom,
+					RcptTo:   dunning.Email,
+					Headers: []string{
+						"Subject", "Your notebrew subscription payment is overdue",
+						"Content-Type", "text/html; charset=utf-8",
+					},
+					Body: strings.NewReader(body),
+				}
+			}
+			continue
+		}
+		if nbrew.Mailer == nil || now.Sub(dunning.LastEmailTime) < reminderInterval {
+			continue
+		}
+		nbrew.Mailer.C <- notebrew.Mail{
+			MailFrom: nbrew.MailFrom,
+			RcptTo:   dunning.Email,
+			Headers: []string{
+				"Subject", "Your notebrew subscription payment failed",
+				"Content-Type", "text/html; charset=utf-8",
+			},
+			Body: strings.NewReader(fmt.Sprintf(
+				"<p>We were unable to collect payment for your notebrew subscription."+
+					" Update your payment details at <a href='%[1]s'>%[1]s</a> before %[2]s to keep your current plan.</p>",
+				profileURL,
+				gracePeriodEnd.Format("2006-01-02"),
+			)),
+		}
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE dunning SET last_email_time = {lastEmailTime} WHERE subscription_id = {subscriptionID}",
+			Values: []any{
+				sq.Int64Param("lastEmailTime", now.Unix()),
+				sq.StringParam("subscriptionID", dunning.SubscriptionID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/notebrew/stacktrace"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// Entitlement is the set of limits and flags a user is entitled to.
+type Entitlement struct {
+	SiteLimit    int64           `json:"siteLimit"`
+	StorageLimit int64           `json:"storageLimit"`
+	UserFlags    map[string]bool `json:"userFlags"`
+}
+
+// Subscription is the local copy of a Stripe subscription, kept up to date by
+// the webhook.
+type Subscription struct {
+	SubscriptionID   string             `json:"subscriptionID"`
+	CustomerID       string             `json:"customerID"`
+	Status           string             `json:"status"`
+	Items            []SubscriptionItem `json:"items"`
+	CurrentPeriodEnd time.Time          `json:"currentPeriodEnd"`
+	TrialEnd         time.Time          `json:"trialEnd"`
+	// CancelAt is when the subscription is scheduled to be canceled, or the
+	// zero time if it renews.
+	CancelAt time.Time `json:"cancelAt"`
+}
+
+type SubscriptionItem struct {
+	ItemID   string `json:"itemID"`
+	PriceID  string `json:"priceID"`
+	Quantity int64  `json:"quantity"`
+}
+
+// PlanByPriceID returns the plan with the given priceID, which may be the
+// price of any of its billing intervals. Archived plans are included so that
+// existing subscribers keep their entitlements. Test mode plans are included
+// too, since priceIDs are unique across modes and test mode customers should
+// keep their plan when their entitlement is synced outside of a test mode
+// webhook event.
+func (stripeConfig StripeConfig) PlanByPriceID(priceID string) (Plan, bool) {
+	if priceID == "" {
+		return Plan{}, false
+	}
+	for _, plan := range stripeConfig.Plans {
+		if _, ok := plan.PriceByID(priceID); ok {
+			return plan, true
+		}
+	}
+	if stripeConfig.Test != nil {
+		return stripeConfig.Test.PlanByPriceID(priceID)
+	}
+	return Plan{}, false
+}
+
+// AddOnByPriceID returns the add-on with the given priceID, including test
+// mode add-ons (see PlanByPriceID).
+func (stripeConfig StripeConfig) AddOnByPriceID(priceID string) (AddOn, bool) {
+	if priceID == "" {
+		return AddOn{}, false
+	}
+	for _, addOn := range stripeConfig.AddOns {
+		if addOn.PriceID == priceID {
+			return addOn, true
+		}
+	}
+	if stripeConfig.Test != nil {
+		return stripeConfig.Test.AddOnByPriceID(priceID)
+	}
+	return AddOn{}, false
+}
+
+// GiftByPriceID returns the gift with the given priceID along with the plan
+// that it grants, including test mode gifts (see PlanByPriceID). The plan is
+// looked up in the same mode as the gift.
+func (stripeConfig StripeConfig) GiftByPriceID(priceID string) (Gift, Plan, bool) {
+	if priceID == "" {
+		return Gift{}, Plan{}, false
+	}
+	for _, gift := range stripeConfig.Gifts {
+		if gift.PriceID != priceID {
+			continue
+		}
+		for _, plan := range stripeConfig.Plans {
+			if plan.Name == gift.Plan {
+				return gift, plan, true
+			}
+		}
+		return Gift{}, Plan{}, false
+	}
+	if stripeConfig.Test != nil {
+		return stripeConfig.Test.GiftByPriceID(priceID)
+	}
+	return Gift{}, Plan{}, false
+}
+
+// newSubscription converts a Stripe subscription into its local copy.
+func newSubscription(subscription *stripe.Subscription) Subscription {
+	localSubscription := Subscription{
+		SubscriptionID:   subscription.ID,
+		Status:           string(subscription.Status),
+		CurrentPeriodEnd: time.Unix(subscription.CurrentPeriodEnd, 0).UTC(),
+	}
+	if subscription.Customer != nil {
+		localSubscription.CustomerID = subscription.Customer.ID
+	}
+	if subscription.TrialEnd > 0 {
+		localSubscription.TrialEnd = time.Unix(subscription.TrialEnd, 0).UTC()
+	}
+	if subscription.CancelAt > 0 {
+		localSubscription.CancelAt = time.Unix(subscription.CancelAt, 0).UTC()
+	}
+	if subscription.Items != nil {
+		for _, subscriptionItem := range subscription.Items.Data {
+			if subscriptionItem.Price == nil {
+				continue
+			}
+			localSubscription.Items = append(localSubscription.Items, SubscriptionItem{
+				ItemID:   subscriptionItem.ID,
+				PriceID:  subscriptionItem.Price.ID,
+				Quantity: subscriptionItem.Quantity,
+			})
+		}
+	}
+	return localSubscription
+}
+
+// saveSubscription creates or updates the local copy of a Stripe
+// subscription. eventTime is the time at which the subscription was known to
+// be in the given state: the creation time of the webhook event it came from
+// (by Stripe's clock), or the time just before it was fetched from the Stripe
+// API (by the local clock, so the two are only as comparable as the clocks
+// are in sync). The checkout success page, the webhook and the reconcile
+// command, which runs in a separate process, can all save the same
+// subscription concurrently, and nothing but this comparison orders their
+// writes: the local copy is only overwritten if eventTime is not older than
+// the state it was last saved from.
+//
+// saved reports whether the local copy was written, so that callers can skip
+// side effects of a state that has already been superseded.
+func saveSubscription(ctx context.Context, nbrew *notebrew.Notebrew, subscription *stripe.Subscription, eventTime int64) (saved bool, err error) {
+	if subscription.Customer == nil {
+		return false, errors.New("subscription " + subscription.ID + " has no customer")
+	}
+	b, err := json.Marshal(newSubscription(subscription).Items)
+	if err != nil {
+		return false, err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO subscription (subscription_id, customer_id, status, items, current_period_end, trial_end, cancel_at, event_time)" +
+			" VALUES ({subscriptionID}, {customerID}, {status}, {items}, {currentPeriodEnd}, {trialEnd}, {cancelAt}, {eventTime})",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscription.ID),
+			sq.StringParam("customerID", subscription.Customer.ID),
+			sq.StringParam("status", string(subscription.Status)),
+			sq.StringParam("items", string(b)),
+			sq.Int64Param("currentPeriodEnd", subscription.CurrentPeriodEnd),
+			sq.Int64Param("trialEnd", subscription.TrialEnd),
+			sq.Int64Param("cancelAt", subscription.CancelAt),
+			sq.Int64Param("eventTime", eventTime),
+		},
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return false, err
+	}
+	result, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE subscription" +
+			" SET status = {status}, items = {items}, current_period_end = {currentPeriodEnd}, trial_end = {trialEnd}, cancel_at = {cancelAt}, event_time = {eventTime}" +
+			" WHERE subscription_id = {subscriptionID} AND coalesce(event_time, 0) <= {eventTime}",
+		Values: []any{
+			sq.StringParam("status", string(subscription.Status)),
+			sq.StringParam("items", string(b)),
+			sq.Int64Param("currentPeriodEnd", subscription.CurrentPeriodEnd),
+			sq.Int64Param("trialEnd", subscription.TrialEnd),
+			sq.Int64Param("cancelAt", subscription.CancelAt),
+			sq.Int64Param("eventTime", eventTime),
+			sq.StringParam("subscriptionID", subscription.ID),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// getSubscriptions returns the local copies of a customer's subscriptions.
+func getSubscriptions(ctx context.Context, nbrew *notebrew.Notebrew, customerID string) ([]Subscription, error) {
+	return sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM subscription WHERE customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) Subscription {
+		subscription := Subscription{
+			SubscriptionID:   row.String("subscription_id"),
+			CustomerID:       row.String("customer_id"),
+			Status:           row.String("status"),
+			CurrentPeriodEnd: time.Unix(row.Int64("current_period_end"), 0).UTC(),
+		}
+		trialEnd := row.Int64("coalesce(trial_end, 0)")
+		if trialEnd > 0 {
+			subscription.TrialEnd = time.Unix(trialEnd, 0).UTC()
+		}
+		cancelAt := row.Int64("coalesce(cancel_at, 0)")
+		if cancelAt > 0 {
+			subscription.CancelAt = time.Unix(cancelAt, 0).UTC()
+		}
+		b := row.Bytes(nil, "items")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &subscription.Items)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return subscription
+	})
+}
+
+// getPlanSubscription returns the customer's entitled subscription that
+// grants them a plan, along with the subscription item of the plan. The
+// returned ok is false if the customer has no such subscription.
+func getPlanSubscription(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string) (subscription Subscription, item SubscriptionItem, plan Plan, ok bool, err error) {
+	if customerID == "" {
+		return Subscription{}, SubscriptionItem{}, Plan{}, false, nil
+	}
+	subscriptions, err := getSubscriptions(ctx, nbrew, customerID)
+	if err != nil {
+		return Subscription{}, SubscriptionItem{}, Plan{}, false, err
+	}
+	for _, subscription := range subscriptions {
+		if !entitled(subscription.Status, false) {
+			continue
+		}
+		for _, item := range subscription.Items {
+			plan, ok := stripeConfig.PlanByPriceID(item.PriceID)
+			if ok {
+				return subscription, item, plan, true, nil
+			}
+		}
+	}
+	return Subscription{}, SubscriptionItem{}, Plan{}, false, nil
+}
+
+// entitled reports whether a subscription in the given status grants its
+// plan to the user. Subscriptions on a free trial are entitled, and
+// subscriptions whose payment has failed remain entitled until their dunning
+// grace period is over.
+func entitled(status string, lapsed bool) bool {
+	switch stripe.SubscriptionStatus(status) {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing:
+		return true
+	case stripe.SubscriptionStatusPastDue, stripe.SubscriptionStatusUnpaid:
+		return !lapsed
+	}
+	return false
+}
+
+// computeEntitlement returns the entitlement granted by a set of
+// subscriptions, one-time purchases and redeemed gift vouchers. If none of
+// them grant a plan, the user gets the free plan. If several plans are
+// granted, the user gets the highest limit of each and a restriction flag is
+// only set if every granted plan sets it.
+//
+// Add-ons are added on top of the resulting limits, multiplied by their
+// quantity. They have no effect on limits that are already unlimited.
+//
+// Every flag mentioned in any plan is present in the returned UserFlags
+// (possibly as false), so that writing it to the user overrides flags granted
+// by a previous plan.
+func computeEntitlement(stripeConfig StripeConfig, subscriptions []Subscription, purchases []Purchase, vouchers []Voucher, lapsed map[string]bool) Entitlement {
+	var plans []Plan
+	var extraSites, extraStorage int64
+	for _, subscription := range subscriptions {
+		if !entitled(subscription.Status, lapsed[subscription.SubscriptionID]) {
+			continue
+		}
+		for _, item := range subscription.Items {
+			if addOn, ok := stripeConfig.AddOnByPriceID(item.PriceID); ok {
+				extraSites += addOn.SiteLimit * item.Quantity
+				extraStorage += addOn.StorageLimit * item.Quantity
+				continue
+			}
+			plan, ok := stripeConfig.PlanByPriceID(item.PriceID)
+			if !ok {
+				continue
+			}
+			plans = append(plans, plan)
+		}
+	}
+	for _, purchase := range purchases {
+		if !purchase.active() {
+			continue
+		}
+		plan, ok := stripeConfig.PlanByPriceID(purchase.PriceID)
+		if !ok {
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	for _, voucher := range vouchers {
+		if !voucher.active() {
+			continue
+		}
+		_, plan, ok := stripeConfig.GiftByPriceID(voucher.PriceID)
+		if !ok {
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	freePlan := stripeConfig.FreePlan()
+	if len(plans) == 0 {
+		plans = append(plans, freePlan)
+	}
+	// Plans that bill for storage overage don't cap storage.
+	storageLimit := func(plan Plan) int64 {
+		if plan.OveragePriceID != "" {
+			return -1
+		}
+		return plan.StorageLimit
+	}
+	entitlement := Entitlement{
+		SiteLimit:    plans[0].SiteLimit,
+		StorageLimit: storageLimit(plans[0]),
+		UserFlags:    make(map[string]bool),
+	}
+	for _, plan := range stripeConfig.Plans {
+		for name := range plan.UserFlags {
+			entitlement.UserFlags[name] = true
+		}
+	}
+	for name := range freePlan.UserFlags {
+		entitlement.UserFlags[name] = true
+	}
+	for _, plan := range plans {
+		entitlement.SiteLimit = maxLimit(entitlement.SiteLimit, plan.SiteLimit)
+		entitlement.StorageLimit = maxLimit(entitlement.StorageLimit, storageLimit(plan))
+		for name := range entitlement.UserFlags {
+			if !plan.UserFlags[name] {
+				entitlement.UserFlags[name] = false
+			}
+		}
+	}
+	if entitlement.SiteLimit > 0 {
+		entitlement.SiteLimit += extraSites
+	}
+	if entitlement.StorageLimit > 0 {
+		entitlement.StorageLimit += extraStorage
+	}
+	return entitlement
+}
+
+// maxLimit returns the larger of two limits, where a limit less than or equal
+// to zero means unlimited.
+func maxLimit(a, b int64) int64 {
+	if a <= 0 {
+		return a
+	}
+	if b <= 0 {
+		return b
+	}
+	return max(a, b)
+}
+
+// resolveEntitlement returns the entitlement of a user given their Stripe
+// customer and subscriptions. The subscriptions are passed in rather than
+// read from the subscription table so that the entitlement can be computed
+// from subscriptions fetched directly from Stripe. One-time purchases and
+// redeemed gift vouchers are read from the purchase and voucher tables, and
+// the plan of the team the user has a seat on (if any) is read from the
+// subscription table.
+func resolveEntitlement(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, userID notebrew.ID, customerID string, subscriptions []Subscription) (Entitlement, error) {
+	lapsed := make(map[string]bool)
+	if customerID != "" && stripeConfig.Dunning.Action != "disable" {
+		subscriptionIDs, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM dunning WHERE customer_id = {customerID} AND end_time IS NOT NULL",
+			Values: []any{
+				sq.StringParam("customerID", customerID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("subscription_id")
+		})
+		if err != nil {
+			return Entitlement{}, err
+		}
+		for _, subscriptionID := range subscriptionIDs {
+			lapsed[subscriptionID] = true
+		}
+	}
+	var purchases []Purchase
+	if customerID != "" {
+		var err error
+		purchases, err = getPurchases(ctx, nbrew, customerID)
+		if err != nil {
+			return Entitlement{}, err
+		}
+	}
+	vouchers, err := getRedeemedVouchers(ctx, nbrew, userID)
+	if err != nil {
+		return Entitlement{}, err
+	}
+	teamSubscription, ok, err := getTeamSubscription(ctx, nbrew, stripeConfig, userID)
+	if err != nil {
+		return Entitlement{}, err
+	}
+	if ok {
+		subscriptions = append(slices.Clip(subscriptions), teamSubscription)
+		if stripeConfig.Dunning.Action != "disable" {
+			teamLapsed, err := sq.FetchExists(ctx, nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT 1 FROM dunning WHERE subscription_id = {subscriptionID} AND end_time IS NOT NULL",
+				Values: []any{
+					sq.StringParam("subscriptionID", teamSubscription.SubscriptionID),
+				},
+			})
+			if err != nil {
+				return Entitlement{}, err
+			}
+			lapsed[teamSubscription.SubscriptionID] = teamLapsed
+		}
+	}
+	return computeEntitlement(stripeConfig, subscriptions, purchases, vouchers, lapsed), nil
+}
+
+// entitlementMutexes serialize syncEntitlement per user (a user always maps to
+// the same mutex), so that a sync that read the subscription table before a
+// newer subscription was saved cannot write its stale entitlement after the
+// sync that read the newer subscription. They only cover syncs within this
+// process: a sync run by the reconcile command can still race one run by the
+// server, and whichever writes last wins until the next sync.
+var entitlementMutexes [256]sync.Mutex
+
+// syncEntitlement recomputes a user's entitlement and writes it to the users
+// table. It is the only place that writes the site_limit, storage_limit and
+// user_flags of a user.
+func syncEntitlement(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, userID notebrew.ID) (Entitlement, error) {
+	mutex := &entitlementMutexes[userID[len(userID)-1]]
+	mutex.Lock()
+	defer mutex.Unlock()
+	customerID, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM customer WHERE user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("customer_id")
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Entitlement{}, err
+	}
+	var subscriptions []Subscription
+	if customerID != "" {
+		subscriptions, err = getSubscriptions(ctx, nbrew, customerID)
+		if err != nil {
+			return Entitlement{}, err
+		}
+	}
+	entitlement, err := resolveEntitlement(ctx, nbrew, stripeConfig, userID, customerID, subscriptions)
+	if err != nil {
+		return Entitlement{}, err
+	}
+	b, err := json.Marshal(entitlement.UserFlags)
+	if err != nil {
+		return Entitlement{}, err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE users" +
+			" SET site_limit = {siteLimit}, storage_limit = {storageLimit}, user_flags = {userFlags}" +
+			" WHERE user_id = {userID}",
+		Values: []any{
+			sq.Int64Param("siteLimit", entitlement.SiteLimit),
+			sq.Int64Param("storageLimit", entitlement.StorageLimit),
+			sq.Param("userFlags", sq.DialectExpression{
+				Default: sq.Expr("json_patch(coalesce(user_flags, json_object()), {})", string(b)),
+				Cases: []sq.DialectCase{{
+					Dialect: "postgres",
+					Result:  sq.Expr("coalesce(user_flags, jsonb_build_object()) || CAST({} AS JSONB)", string(b)),
+				}, {
+					Dialect: "mysql",
+					Result:  sq.Expr("json_merge_patch(coalesce(user_flags, json_object()), CAST({} AS JSON))", string(b)),
+				}},
+			}),
+			sq.UUIDParam("userID", userID),
+		},
+	})
+	if err != nil {
+		return Entitlement{}, err
+	}
+	err = enforceSiteLimit(ctx, nbrew, userID, entitlement.SiteLimit)
+	if err != nil {
+		return Entitlement{}, err
+	}
+	return entitlement, nil
+}
+
+// syncCustomerEntitlement is like syncEntitlement, but for the user linked to
+// a Stripe customer and the members of their team. It does nothing if the
+// customer is not linked to any user yet.
+func syncCustomerEntitlement(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string) error {
+	userID, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM customer WHERE customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) notebrew.ID {
+		return row.UUID("user_id")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	_, err = syncEntitlement(ctx, nbrew, stripeConfig, userID)
+	if err != nil {
+		return err
+	}
+	return syncTeamEntitlements(ctx, nbrew, stripeConfig, customerID)
+}
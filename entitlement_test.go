@@ -0,0 +1,211 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeEntitlement(t *testing.T) {
+	stripeConfig := testStripeConfig
+	stripeConfig.Plans = append([]Plan{}, testStripeConfig.Plans...)
+	stripeConfig.Plans = append(stripeConfig.Plans, Plan{
+		Name:           "Metered",
+		SiteLimit:      10,
+		StorageLimit:   50_000_000_000,
+		Price:          "$10/month",
+		PriceID:        "price_metered",
+		OveragePriceID: "price_overage",
+	})
+	type TestTable struct {
+		description   string
+		subscriptions []Subscription
+		purchases     []Purchase
+		vouchers      []Voucher
+		lapsed        map[string]bool
+		siteLimit     int64
+		storageLimit  int64
+	}
+	tests := []TestTable{{
+		description:  "no subscriptions",
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "canceled subscription",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "canceled",
+			Items:          []SubscriptionItem{{PriceID: "price_pro", Quantity: 1}},
+		}},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "active subscription",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items:          []SubscriptionItem{{PriceID: "price_pro", Quantity: 1}},
+		}},
+		siteLimit:    10,
+		storageLimit: 10_000_000_000,
+	}, {
+		description: "yearly price",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items:          []SubscriptionItem{{PriceID: "price_pro_yearly", Quantity: 1}},
+		}},
+		siteLimit:    10,
+		storageLimit: 10_000_000_000,
+	}, {
+		description: "archived plan",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items:          []SubscriptionItem{{PriceID: "price_legacy", Quantity: 1}},
+		}},
+		siteLimit:    20,
+		storageLimit: 20_000_000_000,
+	}, {
+		description: "trialing subscription",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "trialing",
+			Items:          []SubscriptionItem{{PriceID: "price_pro", Quantity: 1}},
+		}},
+		siteLimit:    10,
+		storageLimit: 10_000_000_000,
+	}, {
+		description: "lapsed subscription",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "past_due",
+			Items:          []SubscriptionItem{{PriceID: "price_pro", Quantity: 1}},
+		}},
+		lapsed:       map[string]bool{"sub_1": true},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "add-ons",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items: []SubscriptionItem{
+				{PriceID: "price_pro", Quantity: 1},
+				{PriceID: "price_site", Quantity: 3},
+				{PriceID: "price_storage", Quantity: 2},
+			},
+		}},
+		siteLimit:    13,
+		storageLimit: 30_000_000_000,
+	}, {
+		description: "storage overage",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items: []SubscriptionItem{
+				{PriceID: "price_metered", Quantity: 1},
+				{PriceID: "price_overage"},
+			},
+		}},
+		siteLimit:    10,
+		storageLimit: -1,
+	}, {
+		description: "lifetime purchase",
+		purchases: []Purchase{{
+			PriceID: "price_lifetime",
+			Status:  "paid",
+		}},
+		siteLimit:    30,
+		storageLimit: 30_000_000_000,
+	}, {
+		description: "expired purchase",
+		purchases: []Purchase{{
+			PriceID:    "price_pass",
+			Status:     "paid",
+			ExpiryTime: time.Now().Add(-time.Hour),
+		}},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "pending purchase",
+		purchases: []Purchase{{
+			PriceID: "price_lifetime",
+			Status:  "pending",
+		}},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "purchase and subscription",
+		subscriptions: []Subscription{{
+			SubscriptionID: "sub_1",
+			Status:         "active",
+			Items:          []SubscriptionItem{{PriceID: "price_pro", Quantity: 1}},
+		}},
+		purchases: []Purchase{{
+			PriceID:    "price_pass",
+			Status:     "paid",
+			ExpiryTime: time.Now().Add(time.Hour),
+		}},
+		siteLimit:    10,
+		storageLimit: 10_000_000_000,
+	}, {
+		description: "redeemed voucher",
+		vouchers: []Voucher{{
+			PriceID:    "price_gift_business",
+			Status:     "redeemed",
+			ExpiryTime: time.Now().Add(time.Hour),
+		}},
+		siteLimit:    50,
+		storageLimit: 100_000_000_000,
+	}, {
+		description: "expired voucher",
+		vouchers: []Voucher{{
+			PriceID:    "price_gift_business",
+			Status:     "redeemed",
+			ExpiryTime: time.Now().Add(-time.Hour),
+		}},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}, {
+		description: "unredeemed voucher",
+		vouchers: []Voucher{{
+			PriceID: "price_gift_business",
+			Status:  "issued",
+		}},
+		siteLimit:    1,
+		storageLimit: 10_000_000,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			entitlement := computeEntitlement(stripeConfig, tt.subscriptions, tt.purchases, tt.vouchers, tt.lapsed)
+			if entitlement.SiteLimit != tt.siteLimit {
+				t.Errorf("site limit: expected %d, got %d", tt.siteLimit, entitlement.SiteLimit)
+			}
+			if entitlement.StorageLimit != tt.storageLimit {
+				t.Errorf("storage limit: expected %d, got %d", tt.storageLimit, entitlement.StorageLimit)
+			}
+		})
+	}
+}
+
+func TestOverageUnits(t *testing.T) {
+	plan := Plan{OveragePriceID: "price_overage"}
+	type TestTable struct {
+		storageAllowance int64
+		storageUsed      int64
+		units            int64
+	}
+	tests := []TestTable{
+		{storageAllowance: 50_000_000_000, storageUsed: 0, units: 0},
+		{storageAllowance: 50_000_000_000, storageUsed: 50_000_000_000, units: 0},
+		{storageAllowance: 50_000_000_000, storageUsed: 50_000_000_001, units: 1},
+		{storageAllowance: 50_000_000_000, storageUsed: 52_000_000_000, units: 2},
+		{storageAllowance: 50_000_000_000, storageUsed: 52_500_000_000, units: 3},
+	}
+	for _, tt := range tests {
+		units := overageUnits(plan, tt.storageAllowance, tt.storageUsed)
+		if units != tt.units {
+			t.Errorf("overageUnits(%d, %d): expected %d, got %d", tt.storageAllowance, tt.storageUsed, tt.units, units)
+		}
+	}
+}
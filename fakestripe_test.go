@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v79"
+)
+
+// The amounts of the proration and renewal lines of every upcoming invoice
+// previewed by the fake.
+const (
+	fakeProrationAmount = 1400
+	fakeRenewalAmount   = 2000
+)
+
+// fakeStripe is an in-process fake of the subset of the Stripe API that
+// notebrewlive uses. It is plugged into stripe-go by overriding the API
+// backend, so that the package-level functions (session.New, subscription.List
+// etc) talk to it instead of Stripe.
+type fakeStripe struct {
+	mu               sync.Mutex
+	server           *httptest.Server
+	nextID           int
+	checkoutSessions map[string]*stripe.CheckoutSession
+	subscriptions    map[string]*stripe.Subscription
+	portalSessions   map[string]*stripe.BillingPortalSession
+	prorationDates   map[string]int64
+	customerUpdates  map[string][]stripe.Customer
+}
+
+func newFakeStripe(t *testing.T) *fakeStripe {
+	t.Helper()
+	fake := &fakeStripe{
+		checkoutSessions: make(map[string]*stripe.CheckoutSession),
+		subscriptions:    make(map[string]*stripe.Subscription),
+		portalSessions:   make(map[string]*stripe.BillingPortalSession),
+		prorationDates:   make(map[string]int64),
+		customerUpdates:  make(map[string][]stripe.Customer),
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.ServeHTTP))
+	previousKey := stripe.Key
+	previousBackend := stripe.GetBackend(stripe.APIBackend)
+	stripe.Key = "sk_test_fake"
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(fake.server.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+	t.Cleanup(func() {
+		fake.server.Close()
+		stripe.Key = previousKey
+		stripe.SetBackend(stripe.APIBackend, previousBackend)
+	})
+	return fake
+}
+
+func (fake *fakeStripe) newID(prefix string) string {
+	fake.nextID++
+	return prefix + "_test_" + strconv.Itoa(fake.nextID)
+}
+
+func (fake *fakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	err := r.ParseForm()
+	if err != nil {
+		fake.writeError(w, http.StatusBadRequest, "parameter_invalid", err.Error())
+		return
+	}
+	urlPath := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case r.Method == "POST" && urlPath == "checkout/sessions":
+		checkoutSession := &stripe.CheckoutSession{
+			ID:                fake.newID("cs"),
+			Object:            "checkout.session",
+			ClientReferenceID: r.Form.Get("client_reference_id"),
+			CustomerEmail:     r.Form.Get("customer_email"),
+			ExpiresAt:         time.Now().Add(30 * time.Minute).Unix(),
+			Mode:              stripe.CheckoutSessionMode(r.Form.Get("mode")),
+			CustomerCreation:  stripe.CheckoutSessionCustomerCreation(r.Form.Get("customer_creation")),
+			Status:            stripe.CheckoutSessionStatusOpen,
+			SuccessURL:        r.Form.Get("success_url"),
+			CancelURL:         r.Form.Get("cancel_url"),
+			Metadata:          formMap(r, "metadata"),
+			LineItems:         &stripe.LineItemList{},
+		}
+		checkoutSession.AllowPromotionCodes, _ = strconv.ParseBool(r.Form.Get("allow_promotion_codes"))
+		if couponID := r.Form.Get("discounts[0][coupon]"); couponID != "" {
+			checkoutSession.TotalDetails = &stripe.CheckoutSessionTotalDetails{
+				AmountDiscount: 100,
+				Breakdown: &stripe.CheckoutSessionTotalDetailsBreakdown{
+					Discounts: []*stripe.CheckoutSessionTotalDetailsBreakdownDiscount{{
+						Amount:   100,
+						Discount: &stripe.Discount{Coupon: &stripe.Coupon{ID: couponID}},
+					}},
+				},
+			}
+		}
+		checkoutSession.URL = "https://checkout.stripe.com/c/pay/" + checkoutSession.ID
+		if customerID := r.Form.Get("customer"); customerID != "" {
+			checkoutSession.Customer = &stripe.Customer{ID: customerID}
+		}
+		for i := 0; r.Form.Has("line_items[" + strconv.Itoa(i) + "][price]"); i++ {
+			prefix := "line_items[" + strconv.Itoa(i) + "]"
+			quantity, _ := strconv.ParseInt(r.Form.Get(prefix+"[quantity]"), 10, 64)
+			checkoutSession.LineItems.Data = append(checkoutSession.LineItems.Data, &stripe.LineItem{
+				ID:       fake.newID("li"),
+				Price:    &stripe.Price{ID: r.Form.Get(prefix + "[price]")},
+				Quantity: quantity,
+			})
+		}
+		// Stash the subscription data on the (not yet created) subscription
+		// so that completeCheckout can apply it.
+		checkoutSession.Subscription = &stripe.Subscription{
+			Metadata: formMap(r, "subscription_data[metadata]"),
+		}
+		if trialPeriodDays, _ := strconv.Atoi(r.Form.Get("subscription_data[trial_period_days]")); trialPeriodDays > 0 {
+			checkoutSession.Subscription.TrialEnd = time.Now().AddDate(0, 0, trialPeriodDays).Unix()
+		}
+		fake.checkoutSessions[checkoutSession.ID] = checkoutSession
+		fake.writeJSON(w, fake.checkoutSessionResponse(checkoutSession, r))
+	case r.Method == "GET" && strings.HasPrefix(urlPath, "checkout/sessions/"):
+		checkoutSession := fake.checkoutSessions[strings.TrimPrefix(urlPath, "checkout/sessions/")]
+		if checkoutSession == nil {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such checkout.session")
+			return
+		}
+		fake.writeJSON(w, fake.checkoutSessionResponse(checkoutSession, r))
+	case r.Method == "POST" && urlPath == "billing_portal/sessions":
+		customerID := r.Form.Get("customer")
+		if !fake.customerExists(customerID) {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such customer: "+customerID)
+			return
+		}
+		portalSession := &stripe.BillingPortalSession{
+			ID:        fake.newID("bps"),
+			Object:    "billing_portal.session",
+			Customer:  customerID,
+			ReturnURL: r.Form.Get("return_url"),
+		}
+		portalSession.URL = "https://billing.stripe.com/p/session/" + portalSession.ID
+		fake.portalSessions[portalSession.ID] = portalSession
+		fake.writeJSON(w, portalSession)
+	case r.Method == "GET" && urlPath == "subscriptions":
+		customerID := r.Form.Get("customer")
+		status := r.Form.Get("status")
+		data := []*stripe.Subscription{}
+		for _, subscription := range fake.subscriptions {
+			if customerID != "" && subscription.Customer.ID != customerID {
+				continue
+			}
+			if status != "all" && subscription.Status == stripe.SubscriptionStatusCanceled {
+				continue
+			}
+			data = append(data, subscription)
+		}
+		fake.writeJSON(w, map[string]any{
+			"object":   "list",
+			"url":      "/v1/subscriptions",
+			"has_more": false,
+			"data":     data,
+		})
+	case r.Method == "POST" && strings.HasPrefix(urlPath, "subscriptions/"):
+		subscription := fake.subscriptions[strings.TrimPrefix(urlPath, "subscriptions/")]
+		if subscription == nil {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such subscription")
+			return
+		}
+		for i := 0; r.Form.Has("items["+strconv.Itoa(i)+"][id]") || r.Form.Has("items["+strconv.Itoa(i)+"][price]"); i++ {
+			prefix := "items[" + strconv.Itoa(i) + "]"
+			if !r.Form.Has(prefix + "[id]") {
+				subscription.Items.Data = append(subscription.Items.Data, &stripe.SubscriptionItem{
+					ID:           fake.newID("si"),
+					Object:       "subscription_item",
+					Price:        &stripe.Price{ID: r.Form.Get(prefix + "[price]")},
+					Subscription: subscription.ID,
+				})
+				continue
+			}
+			for j, subscriptionItem := range subscription.Items.Data {
+				if subscriptionItem.ID != r.Form.Get(prefix+"[id]") {
+					continue
+				}
+				if r.Form.Get(prefix+"[deleted]") == "true" {
+					subscription.Items.Data = append(subscription.Items.Data[:j], subscription.Items.Data[j+1:]...)
+					break
+				}
+				if r.Form.Has(prefix + "[price]") {
+					subscriptionItem.Price = &stripe.Price{ID: r.Form.Get(prefix + "[price]")}
+				}
+				if r.Form.Has(prefix + "[quantity]") {
+					subscriptionItem.Quantity, _ = strconv.ParseInt(r.Form.Get(prefix+"[quantity]"), 10, 64)
+				}
+			}
+		}
+		if r.Form.Has("proration_date") {
+			fake.prorationDates[subscription.ID], _ = strconv.ParseInt(r.Form.Get("proration_date"), 10, 64)
+		}
+		if r.Form.Has("cancel_at_period_end") {
+			subscription.CancelAtPeriodEnd, _ = strconv.ParseBool(r.Form.Get("cancel_at_period_end"))
+			subscription.CancelAt = 0
+			if subscription.CancelAtPeriodEnd {
+				subscription.CancelAt = subscription.CurrentPeriodEnd
+			}
+		}
+		if r.Form.Has("cancellation_details[feedback]") {
+			subscription.CancellationDetails = &stripe.SubscriptionCancellationDetails{
+				Comment:  r.Form.Get("cancellation_details[comment]"),
+				Feedback: stripe.SubscriptionCancellationDetailsFeedback(r.Form.Get("cancellation_details[feedback]")),
+			}
+		}
+		if couponID := r.Form.Get("discounts[0][coupon]"); couponID != "" {
+			subscription.Discount = &stripe.Discount{Coupon: &stripe.Coupon{ID: couponID}}
+		}
+		fake.writeJSON(w, subscription)
+	case r.Method == "GET" && strings.HasPrefix(urlPath, "subscriptions/"):
+		subscription := fake.subscriptions[strings.TrimPrefix(urlPath, "subscriptions/")]
+		if subscription == nil {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such subscription")
+			return
+		}
+		fake.writeJSON(w, subscription)
+	case r.Method == "POST" && urlPath == "subscription_items":
+		subscription := fake.subscriptions[r.Form.Get("subscription")]
+		if subscription == nil {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such subscription")
+			return
+		}
+		quantity, _ := strconv.ParseInt(r.Form.Get("quantity"), 10, 64)
+		subscriptionItem := &stripe.SubscriptionItem{
+			ID:           fake.newID("si"),
+			Object:       "subscription_item",
+			Price:        &stripe.Price{ID: r.Form.Get("price")},
+			Quantity:     quantity,
+			Subscription: subscription.ID,
+		}
+		subscription.Items.Data = append(subscription.Items.Data, subscriptionItem)
+		fake.writeJSON(w, subscriptionItem)
+	case (r.Method == "POST" || r.Method == "DELETE") && strings.HasPrefix(urlPath, "subscription_items/"):
+		itemID := strings.TrimPrefix(urlPath, "subscription_items/")
+		for _, subscription := range fake.subscriptions {
+			for i, subscriptionItem := range subscription.Items.Data {
+				if subscriptionItem.ID != itemID {
+					continue
+				}
+				if r.Method == "DELETE" {
+					subscription.Items.Data = append(subscription.Items.Data[:i], subscription.Items.Data[i+1:]...)
+					fake.writeJSON(w, map[string]any{"id": itemID, "object": "subscription_item", "deleted": true})
+					return
+				}
+				if r.Form.Has("quantity") {
+					subscriptionItem.Quantity, _ = strconv.ParseInt(r.Form.Get("quantity"), 10, 64)
+				}
+				fake.writeJSON(w, subscriptionItem)
+				return
+			}
+		}
+		fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such subscription item: "+itemID)
+	case r.Method == "GET" && urlPath == "invoices/upcoming":
+		subscription := fake.subscriptions[r.Form.Get("subscription")]
+		if subscription == nil {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such subscription")
+			return
+		}
+		// The fake doesn't know what prices cost, so every price change is
+		// previewed as a fixed proration on top of a fixed renewal.
+		var lines []map[string]any
+		for i := 0; r.Form.Has("subscription_items[" + strconv.Itoa(i) + "][id]"); i++ {
+			lines = append(lines, map[string]any{
+				"id":        fake.newID("il"),
+				"object":    "line_item",
+				"amount":    fakeProrationAmount,
+				"currency":  "usd",
+				"proration": true,
+			})
+		}
+		lines = append(lines, map[string]any{
+			"id":        fake.newID("il"),
+			"object":    "line_item",
+			"amount":    fakeRenewalAmount,
+			"currency":  "usd",
+			"proration": false,
+		})
+		amountDue := int64(fakeRenewalAmount)
+		if len(lines) > 1 {
+			amountDue += fakeProrationAmount
+		}
+		fake.writeJSON(w, map[string]any{
+			"object":               "invoice",
+			"customer":             subscription.Customer.ID,
+			"subscription":         subscription.ID,
+			"currency":             "usd",
+			"amount_due":           amountDue,
+			"total":                amountDue,
+			"period_end":           subscription.CurrentPeriodEnd,
+			"next_payment_attempt": subscription.CurrentPeriodEnd,
+			"lines": map[string]any{
+				"object":   "list",
+				"url":      "/v1/invoices/upcoming/lines",
+				"has_more": false,
+				"data":     lines,
+			},
+		})
+	case r.Method == "POST" && strings.HasPrefix(urlPath, "customers/"):
+		customerID := strings.TrimPrefix(urlPath, "customers/")
+		if !fake.customerExists(customerID) {
+			fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), "No such customer: "+customerID)
+			return
+		}
+		customer := stripe.Customer{
+			ID:     customerID,
+			Object: "customer",
+			Email:  r.Form.Get("email"),
+			Name:   r.Form.Get("name"),
+		}
+		fake.customerUpdates[customerID] = append(fake.customerUpdates[customerID], customer)
+		fake.writeJSON(w, customer)
+	default:
+		fake.writeError(w, http.StatusNotFound, string(stripe.ErrorCodeResourceMissing), fmt.Sprintf("Unrecognized request URL (%s: %s)", r.Method, r.URL.Path))
+	}
+}
+
+// checkoutSessionResponse returns the JSON representation of a checkout
+// session, expanding the subscription only if requested.
+func (fake *fakeStripe) checkoutSessionResponse(checkoutSession *stripe.CheckoutSession, r *http.Request) map[string]any {
+	b, err := json.Marshal(checkoutSession)
+	if err != nil {
+		panic(err)
+	}
+	var response map[string]any
+	err = json.Unmarshal(b, &response)
+	if err != nil {
+		panic(err)
+	}
+	expand := make(map[string]bool)
+	for key, values := range r.Form {
+		if strings.HasPrefix(key, "expand") {
+			for _, value := range values {
+				expand[value] = true
+			}
+		}
+	}
+	if checkoutSession.Customer != nil {
+		response["customer"] = checkoutSession.Customer.ID
+	}
+	if checkoutSession.PaymentIntent != nil {
+		response["payment_intent"] = checkoutSession.PaymentIntent.ID
+	}
+	if checkoutSession.Subscription == nil || checkoutSession.Subscription.ID == "" {
+		response["subscription"] = nil
+	} else if !expand["subscription"] {
+		response["subscription"] = checkoutSession.Subscription.ID
+	}
+	if !expand["line_items"] {
+		delete(response, "line_items")
+	}
+	return response
+}
+
+func (fake *fakeStripe) customerExists(customerID string) bool {
+	for _, checkoutSession := range fake.checkoutSessions {
+		if checkoutSession.Customer != nil && checkoutSession.Customer.ID == customerID {
+			return true
+		}
+	}
+	return false
+}
+
+// completeCheckout simulates the user paying for a checkout session: it
+// creates the customer (if necessary) and an active subscription for the
+// session's line items.
+func (fake *fakeStripe) completeCheckout(t *testing.T, sessionID string) (*stripe.CheckoutSession, *stripe.Subscription) {
+	t.Helper()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	checkoutSession := fake.checkoutSessions[sessionID]
+	if checkoutSession == nil {
+		t.Fatalf("no such checkout session %q", sessionID)
+	}
+	if checkoutSession.Customer == nil {
+		checkoutSession.Customer = &stripe.Customer{ID: fake.newID("cus"), Email: checkoutSession.CustomerEmail}
+	}
+	now := time.Now()
+	subscription := &stripe.Subscription{
+		ID:                 fake.newID("sub"),
+		Object:             "subscription",
+		Created:            now.Unix(),
+		Customer:           checkoutSession.Customer,
+		Status:             stripe.SubscriptionStatusActive,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Metadata:           checkoutSession.Subscription.Metadata,
+		Items:              &stripe.SubscriptionItemList{},
+	}
+	if trialEnd := checkoutSession.Subscription.TrialEnd; trialEnd > 0 {
+		subscription.Status = stripe.SubscriptionStatusTrialing
+		subscription.TrialStart = now.Unix()
+		subscription.TrialEnd = trialEnd
+		subscription.CurrentPeriodEnd = trialEnd
+	}
+	for _, lineItem := range checkoutSession.LineItems.Data {
+		subscription.Items.Data = append(subscription.Items.Data, &stripe.SubscriptionItem{
+			ID:           fake.newID("si"),
+			Object:       "subscription_item",
+			Price:        lineItem.Price,
+			Quantity:     lineItem.Quantity,
+			Subscription: subscription.ID,
+		})
+	}
+	fake.subscriptions[subscription.ID] = subscription
+	checkoutSession.Subscription = subscription
+	checkoutSession.Status = stripe.CheckoutSessionStatusComplete
+	checkoutSession.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	return checkoutSession, subscription
+}
+
+// completePayment simulates the user completing a payment mode checkout
+// session. If paid is false, the payment is still processing (as with delayed
+// payment methods) and only succeeds later.
+func (fake *fakeStripe) completePayment(t *testing.T, sessionID string, paid bool) *stripe.CheckoutSession {
+	t.Helper()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	checkoutSession := fake.checkoutSessions[sessionID]
+	if checkoutSession == nil {
+		t.Fatalf("no such checkout session %q", sessionID)
+	}
+	if checkoutSession.Mode != stripe.CheckoutSessionModePayment {
+		t.Fatalf("checkout session %q is not in payment mode", sessionID)
+	}
+	if checkoutSession.Customer == nil {
+		checkoutSession.Customer = &stripe.Customer{ID: fake.newID("cus"), Email: checkoutSession.CustomerEmail}
+	}
+	checkoutSession.Subscription = nil
+	checkoutSession.PaymentIntent = &stripe.PaymentIntent{ID: fake.newID("pi")}
+	checkoutSession.Status = stripe.CheckoutSessionStatusComplete
+	checkoutSession.PaymentStatus = stripe.CheckoutSessionPaymentStatusUnpaid
+	if paid {
+		checkoutSession.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	}
+	return checkoutSession
+}
+
+// cancelSubscription simulates a subscription being canceled immediately.
+func (fake *fakeStripe) cancelSubscription(t *testing.T, subscriptionID string) *stripe.Subscription {
+	t.Helper()
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	subscription := fake.subscriptions[subscriptionID]
+	if subscription == nil {
+		t.Fatalf("no such subscription %q", subscriptionID)
+	}
+	subscription.Status = stripe.SubscriptionStatusCanceled
+	subscription.CanceledAt = time.Now().Unix()
+	subscription.EndedAt = time.Now().Unix()
+	return subscription
+}
+
+func (fake *fakeStripe) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (fake *fakeStripe) writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"type":    "invalid_request_error",
+			"code":    code,
+			"message": message,
+		},
+	})
+}
+
+// formMap extracts a map parameter such as metadata[key]=value from the form.
+func formMap(r *http.Request, name string) map[string]string {
+	m := make(map[string]string)
+	for key := range r.Form {
+		if strings.HasPrefix(key, name+"[") && strings.HasSuffix(key, "]") {
+			m[strings.TrimSuffix(strings.TrimPrefix(key, name+"["), "]")] = r.Form.Get(key)
+		}
+	}
+	return m
+}
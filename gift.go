@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// Voucher is a gift bought through a payment mode checkout. The buyer's
+// customer pays for it, and whoever redeems its code gets the gift's plan.
+type Voucher struct {
+	CheckoutSessionID string `json:"checkoutSessionID"`
+	VoucherCode       string `json:"voucherCode"`
+	CustomerID        string `json:"customerID"`
+	PriceID           string `json:"priceID"`
+	RecipientEmail    string `json:"recipientEmail"`
+	// Status is "pending" until the payment succeeds, then "issued" until
+	// the code is redeemed, then "redeemed" until the prepaid period is
+	// over, then "expired".
+	Status       string      `json:"status"`
+	CreationTime time.Time   `json:"creationTime"`
+	RedeemUserID notebrew.ID `json:"redeemUserID"`
+	RedeemTime   time.Time   `json:"redeemTime"`
+	ExpiryTime   time.Time   `json:"expiryTime"`
+}
+
+// active reports whether the voucher grants its plan to the user who redeemed
+// it.
+func (voucher Voucher) active() bool {
+	return voucher.Status == "redeemed" && voucher.ExpiryTime.After(time.Now())
+}
+
+// voucherAlphabet leaves out the letters and digits that are easily confused
+// (I, O, 0 and 1), since voucher codes are meant to be typed in by hand.
+const voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newVoucherCode generates a random voucher code of the form
+// XXXX-XXXX-XXXX-XXXX.
+func newVoucherCode() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	var code [16]byte
+	for i := range b {
+		// 256 is a multiple of 32, so there is no modulo bias.
+		code[i] = voucherAlphabet[b[i]%byte(len(voucherAlphabet))]
+	}
+	return normalizeVoucherCode(string(code[:])), nil
+}
+
+// normalizeVoucherCode uppercases a voucher code entered by a user, drops
+// anything that isn't part of the voucher alphabet (such as spaces and
+// dashes) and puts the dashes back in, so that codes compare equal however
+// they were typed.
+func normalizeVoucherCode(code string) string {
+	var b strings.Builder
+	n := 0
+	for _, char := range strings.ToUpper(code) {
+		if !strings.ContainsRune(voucherAlphabet, char) {
+			continue
+		}
+		if n > 0 && n%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(char)
+		n++
+	}
+	return b.String()
+}
+
+// stripeGift sends the user to a payment mode checkout to buy a gift for the
+// recipientEmail. Once the payment succeeds, the recipient is emailed a
+// voucher code (see issueVoucher).
+func stripeGift(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	if r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	priceID := r.Form.Get("priceID")
+	if priceID == "" {
+		nbrew.BadRequest(w, r, fmt.Errorf("priceID not provided"))
+		return
+	}
+	gift, plan, ok := stripeConfig.GiftByPriceID(priceID)
+	if !ok {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid priceID"))
+		return
+	}
+	if plan.Archived {
+		nbrew.BadRequest(w, r, fmt.Errorf("gift %q is no longer available", gift.Name))
+		return
+	}
+	recipientEmail := strings.TrimSpace(r.Form.Get("recipientEmail"))
+	_, err = mail.ParseAddress(recipientEmail)
+	if err != nil {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid email address %q", recipientEmail))
+		return
+	}
+	scheme := "https://"
+	if r.TLS == nil {
+		scheme = "http://"
+	}
+	var customerID, email *string
+	if user.CustomerID != "" {
+		customerID = &user.CustomerID
+	} else {
+		email = &user.Email
+	}
+	// As with one-time plans, the priceID is kept in the metadata because
+	// the line items of a checkout session are not included in webhook
+	// events. Payment mode checkouts only create a customer if asked to.
+	checkoutSessionParams := &stripe.CheckoutSessionParams{
+		Customer:          customerID,
+		CustomerEmail:     email,
+		ClientReferenceID: stripe.String(user.UserID.String()),
+		ExpiresAt:         stripe.Int64(time.Now().Add(30 * time.Minute).Unix()),
+		Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{{
+			Price:    stripe.String(priceID),
+			Quantity: stripe.Int64(1),
+		}},
+		Metadata: map[string]string{
+			"userID":         user.UserID.String(),
+			"priceID":        priceID,
+			"recipientEmail": recipientEmail,
+		},
+		PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
+			Metadata: map[string]string{
+				"userID": user.UserID.String(),
+			},
+		},
+		SuccessURL: stripe.String(scheme + nbrew.CMSDomain + "/stripe/checkout/success/?sessionID={CHECKOUT_SESSION_ID}"),
+		CancelURL:  stripe.String(scheme + nbrew.CMSDomain + "/users/profile/"),
+	}
+	if customerID == nil {
+		checkoutSessionParams.CustomerCreation = stripe.String(string(stripe.CheckoutSessionCustomerCreationAlways))
+	}
+	stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	checkoutSession, err := stripeClient.CheckoutSessions.New(checkoutSessionParams)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			if stripeErr.Code == stripe.ErrorCodeResourceMissing {
+				nbrew.BadRequest(w, r, fmt.Errorf("invalid customerID %q", user.CustomerID))
+				return
+			}
+		}
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, checkoutSession.URL, http.StatusSeeOther)
+}
+
+// saveVoucher records the gift bought through a completed payment mode
+// checkout session. Like savePurchase, it is called from both the checkout
+// success page and the checkout.session.completed webhook, and the voucher is
+// only issued once the payment has succeeded.
+func saveVoucher(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, checkoutSession *stripe.CheckoutSession) error {
+	if checkoutSession.Mode != stripe.CheckoutSessionModePayment || checkoutSession.Customer == nil {
+		return nil
+	}
+	gift, _, ok := stripeConfig.GiftByPriceID(checkoutSession.Metadata["priceID"])
+	if !ok || checkoutSession.Metadata["recipientEmail"] == "" {
+		// Not a checkout session created by stripeGift.
+		return nil
+	}
+	voucherCode, err := newVoucherCode()
+	if err != nil {
+		return err
+	}
+	var paymentIntentID string
+	if checkoutSession.PaymentIntent != nil {
+		paymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO voucher (checkout_session_id, voucher_code, customer_id, price_id, recipient_email, payment_intent_id, status, creation_time)" +
+			" VALUES ({checkoutSessionID}, {voucherCode}, {customerID}, {priceID}, {recipientEmail}, {paymentIntentID}, 'pending', {creationTime})",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSession.ID),
+			sq.StringParam("voucherCode", voucherCode),
+			sq.StringParam("customerID", checkoutSession.Customer.ID),
+			sq.StringParam("priceID", gift.PriceID),
+			sq.StringParam("recipientEmail", checkoutSession.Metadata["recipientEmail"]),
+			sq.StringParam("paymentIntentID", paymentIntentID),
+			sq.Int64Param("creationTime", time.Now().Unix()),
+		},
+	})
+	if err != nil && !isKeyViolation(nbrew, err) {
+		return err
+	}
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		return nil
+	}
+	return issueVoucher(ctx, nbrew, stripeConfig, checkoutSession.ID)
+}
+
+// completeVoucherPayment issues the pending voucher paid for by a payment
+// intent. It does nothing if the payment intent does not belong to a pending
+// voucher.
+func completeVoucherPayment(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, paymentIntentID string) error {
+	checkoutSessionID, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM voucher WHERE payment_intent_id = {paymentIntentID} AND status = 'pending'",
+		Values: []any{
+			sq.StringParam("paymentIntentID", paymentIntentID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("checkout_session_id")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	return issueVoucher(ctx, nbrew, stripeConfig, checkoutSessionID)
+}
+
+// issueVoucher marks a pending voucher as issued and emails its code to the
+// recipient. The recipient is only emailed by whichever caller gets to issue
+// the voucher first.
+func issueVoucher(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, checkoutSessionID string) error {
+	result, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE voucher SET status = 'issued' WHERE checkout_session_id = {checkoutSessionID} AND status = 'pending'",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSessionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected == 0 || nbrew.Mailer == nil {
+		return nil
+	}
+	type Issue struct {
+		VoucherCode    string
+		PriceID        string
+		RecipientEmail string
+		BuyerEmail     string
+	}
+	issue, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM voucher" +
+			" LEFT JOIN customer ON customer.customer_id = voucher.customer_id" +
+			" LEFT JOIN users ON users.user_id = customer.user_id" +
+			" WHERE voucher.checkout_session_id = {checkoutSessionID}",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSessionID),
+		},
+	}, func(row *sq.Row) Issue {
+		return Issue{
+			VoucherCode:    row.String("voucher.voucher_code"),
+			PriceID:        row.String("voucher.price_id"),
+			RecipientEmail: row.String("voucher.recipient_email"),
+			BuyerEmail:     row.String("users.email"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	gift, plan, ok := stripeConfig.GiftByPriceID(issue.PriceID)
+	if !ok {
+		return fmt.Errorf("voucher %s: no gift with priceID %q", checkoutSessionID, issue.PriceID)
+	}
+	from := "Someone"
+	if issue.BuyerEmail != "" {
+		from = issue.BuyerEmail
+	}
+	scheme := "https://"
+	if !nbrew.CMSDomainHTTPS {
+		scheme = "http://"
+	}
+	redeemLink := scheme + nbrew.CMSDomain + "/redeem/?code=" + url.QueryEscape(issue.VoucherCode)
+	nbrew.Mailer.C <- notebrew.Mail{
+		MailFrom: nbrew.MailFrom,
+		RcptTo:   issue.RecipientEmail,
+		Headers: []string{
+			"Subject", "You've been gifted " + gift.Name + " on notebrew",
+			"Content-Type", "text/html; charset=utf-8",
+		},
+		Body: strings.NewReader(fmt.Sprintf(
+			"<p>%[1]s has gifted you %[2]d months of the %[3]s plan on notebrew.</p>"+
+				"<p>Your voucher code is <b>%[4]s</b>. Redeem it at <a href='%[5]s'>%[5]s</a> (if you don't have an account yet, sign up first).</p>",
+			template.HTMLEscapeString(from), gift.Months, template.HTMLEscapeString(plan.Name), issue.VoucherCode, redeemLink,
+		)),
+	}
+	return nil
+}
+
+// getRedeemedVouchers returns the vouchers redeemed by a user that have not
+// been expired by runVoucherExpiry yet, most recently redeemed first.
+func getRedeemedVouchers(ctx context.Context, nbrew *notebrew.Notebrew, userID notebrew.ID) ([]Voucher, error) {
+	return sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM voucher WHERE redeem_user_id = {userID} AND status = 'redeemed' ORDER BY redeem_time DESC",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) Voucher {
+		return Voucher{
+			CheckoutSessionID: row.String("checkout_session_id"),
+			VoucherCode:       row.String("voucher_code"),
+			CustomerID:        row.String("customer_id"),
+			PriceID:           row.String("price_id"),
+			RecipientEmail:    row.String("recipient_email"),
+			Status:            row.String("status"),
+			CreationTime:      time.Unix(row.Int64("creation_time"), 0).UTC(),
+			RedeemUserID:      row.UUID("redeem_user_id"),
+			RedeemTime:        time.Unix(row.Int64("coalesce(redeem_time, 0)"), 0).UTC(),
+			ExpiryTime:        time.Unix(row.Int64("coalesce(expiry_time, 0)"), 0).UTC(),
+		}
+	})
+}
+
+// runVoucherExpiry expires the redeemed vouchers whose prepaid period is over
+// and syncs the entitlement of the users who redeemed them.
+func runVoucherExpiry(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	type Expiry struct {
+		CheckoutSessionID string
+		UserID            notebrew.ID
+	}
+	expiries, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM voucher WHERE status = 'redeemed' AND expiry_time <= {now}",
+		Values: []any{
+			sq.Int64Param("now", time.Now().Unix()),
+		},
+	}, func(row *sq.Row) Expiry {
+		return Expiry{
+			CheckoutSessionID: row.String("checkout_session_id"),
+			UserID:            row.UUID("redeem_user_id"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, expiry := range expiries {
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE voucher SET status = 'expired' WHERE checkout_session_id = {checkoutSessionID}",
+			Values: []any{
+				sq.StringParam("checkoutSessionID", expiry.CheckoutSessionID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = syncEntitlement(ctx, nbrew, stripeConfig, expiry.UserID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redeem lets a user redeem a voucher code for the plan of its gift. The
+// prepaid period starts when the code is redeemed, and redeeming another gift
+// of the same plan before the first one runs out extends it rather than
+// overlapping it.
+func redeem(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	type Response struct {
+		UserID        notebrew.ID `json:"userID"`
+		Username      string      `json:"username"`
+		DisableReason string      `json:"disableReason"`
+		Code          string      `json:"code"`
+		Error         string      `json:"error"`
+		FormErrors    url.Values  `json:"formErrors"`
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response) {
+			if r.Form.Has("api") {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				if r.Method == "HEAD" {
+					w.WriteHeader(http.StatusOK)
+					return
+				}
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			funcMap := map[string]any{
+				"stylesCSS":  func() template.CSS { return template.CSS(notebrew.StylesCSS) },
+				"baselineJS": func() template.JS { return template.JS(notebrew.BaselineJS) },
+			}
+			tmpl, err := template.New("redeem.html").Funcs(funcMap).ParseFS(RuntimeFS, "embed/redeem.html")
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Security-Policy", nbrew.ContentSecurityPolicy)
+			nbrew.ExecuteTemplate(w, r, tmpl, &response)
+		}
+		var response Response
+		_, err := nbrew.GetFlashSession(w, r, &response)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+		}
+		response.UserID = user.UserID
+		response.Username = user.Username
+		response.DisableReason = user.DisableReason
+		if response.Code == "" {
+			response.Code = normalizeVoucherCode(r.Form.Get("code"))
+		}
+		writeResponse(w, r, response)
+	case "POST":
+		writeResponse := func(w http.ResponseWriter, r *http.Request, response Response, plan Plan, entitlement Entitlement) {
+			if r.Form.Has("api") {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				encoder := json.NewEncoder(w)
+				encoder.SetIndent("", "  ")
+				encoder.SetEscapeHTML(false)
+				err := encoder.Encode(&response)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+				}
+				return
+			}
+			if response.Error != "" {
+				err := nbrew.SetFlashSession(w, r, &response)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				http.Redirect(w, r, "/redeem/", http.StatusFound)
+				return
+			}
+			err := nbrew.SetFlashSession(w, r, map[string]any{
+				"postRedirectGet": map[string]any{
+					"from":         "redeem",
+					"planName":     plan.Name,
+					"siteLimit":    entitlement.SiteLimit,
+					"storageLimit": entitlement.StorageLimit,
+				},
+			})
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/users/profile/", http.StatusFound)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+		err := r.ParseForm()
+		if err != nil {
+			nbrew.BadRequest(w, r, err)
+			return
+		}
+		response := Response{
+			Code:       normalizeVoucherCode(r.Form.Get("code")),
+			FormErrors: url.Values{},
+		}
+		if response.Code == "" {
+			response.FormErrors.Add("code", "required")
+			response.Error = "FormErrorsPresent"
+			writeResponse(w, r, response, Plan{}, Entitlement{})
+			return
+		}
+		voucher, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM voucher WHERE voucher_code = {voucherCode}",
+			Values: []any{
+				sq.StringParam("voucherCode", response.Code),
+			},
+		}, func(row *sq.Row) Voucher {
+			return Voucher{
+				CheckoutSessionID: row.String("checkout_session_id"),
+				PriceID:           row.String("price_id"),
+				Status:            row.String("status"),
+			}
+		})
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		// A voucher whose payment hasn't gone through yet is as good as
+		// nonexistent to the recipient, who shouldn't have its code anyway.
+		if errors.Is(err, sql.ErrNoRows) || voucher.Status == "pending" {
+			response.FormErrors.Add("code", "invalid voucher code")
+			response.Error = "FormErrorsPresent"
+			writeResponse(w, r, response, Plan{}, Entitlement{})
+			return
+		}
+		if voucher.Status != "issued" {
+			response.FormErrors.Add("code", "this voucher has already been redeemed")
+			response.Error = "FormErrorsPresent"
+			writeResponse(w, r, response, Plan{}, Entitlement{})
+			return
+		}
+		gift, plan, ok := stripeConfig.GiftByPriceID(voucher.PriceID)
+		if !ok {
+			response.FormErrors.Add("code", "this gift is no longer available")
+			response.Error = "FormErrorsPresent"
+			writeResponse(w, r, response, Plan{}, Entitlement{})
+			return
+		}
+		redeemTime := time.Now()
+		latestExpiryTime, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM voucher WHERE redeem_user_id = {userID} AND price_id = {priceID} AND status = 'redeemed'",
+			Values: []any{
+				sq.UUIDParam("userID", user.UserID),
+				sq.StringParam("priceID", voucher.PriceID),
+			},
+		}, func(row *sq.Row) int64 {
+			return row.Int64("coalesce(max(expiry_time), 0)")
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		expiryTime := time.Unix(max(redeemTime.Unix(), latestExpiryTime), 0).AddDate(0, int(gift.Months), 0)
+		// The status check makes sure that a voucher redeemed twice at the
+		// same time is only redeemed once.
+		result, err := sq.Exec(r.Context(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format: "UPDATE voucher SET status = 'redeemed', redeem_user_id = {userID}, redeem_time = {redeemTime}, expiry_time = {expiryTime}" +
+				" WHERE checkout_session_id = {checkoutSessionID} AND status = 'issued'",
+			Values: []any{
+				sq.UUIDParam("userID", user.UserID),
+				sq.Int64Param("redeemTime", redeemTime.Unix()),
+				sq.Int64Param("expiryTime", expiryTime.Unix()),
+				sq.StringParam("checkoutSessionID", voucher.CheckoutSessionID),
+			},
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		if result.RowsAffected == 0 {
+			response.FormErrors.Add("code", "this voucher has already been redeemed")
+			response.Error = "FormErrorsPresent"
+			writeResponse(w, r, response, Plan{}, Entitlement{})
+			return
+		}
+		entitlement, err := syncEntitlement(r.Context(), nbrew, stripeConfig, user.UserID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		writeResponse(w, r, response, plan, entitlement)
+	default:
+		nbrew.MethodNotAllowed(w, r)
+	}
+}
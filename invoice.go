@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// Invoice is the local copy of a Stripe invoice, kept up to date by the
+// invoice.paid and invoice.payment_failed webhook events so that the billing
+// history can be shown without calling Stripe.
+type Invoice struct {
+	InvoiceID        string    `json:"invoiceID"`
+	CustomerID       string    `json:"customerID"`
+	SubscriptionID   string    `json:"subscriptionID"`
+	Number           string    `json:"number"`
+	Status           string    `json:"status"`
+	AmountDue        int64     `json:"amountDue"`
+	AmountPaid       int64     `json:"amountPaid"`
+	Currency         string    `json:"currency"`
+	CreationTime     time.Time `json:"creationTime"`
+	HostedInvoiceURL string    `json:"hostedInvoiceURL"`
+	InvoicePDF       string    `json:"invoicePDF"`
+}
+
+// saveInvoice upserts a Stripe invoice into the invoice table. Stripe does not
+// guarantee the order in which events are delivered, so the invoice is only
+// overwritten if eventTime is not older than the event it was last saved
+// from.
+func saveInvoice(ctx context.Context, nbrew *notebrew.Notebrew, invoice *stripe.Invoice, eventTime int64) error {
+	if invoice.Customer == nil {
+		return errors.New("invoice " + invoice.ID + " has no customer")
+	}
+	var subscriptionID string
+	if invoice.Subscription != nil {
+		subscriptionID = invoice.Subscription.ID
+	}
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO invoice (invoice_id, customer_id, subscription_id, number, status, amount_due, amount_paid, currency, creation_time, hosted_invoice_url, invoice_pdf, event_time)" +
+			" VALUES ({invoiceID}, {customerID}, {subscriptionID}, {number}, {status}, {amountDue}, {amountPaid}, {currency}, {creationTime}, {hostedInvoiceURL}, {invoicePDF}, {eventTime})",
+		Values: []any{
+			sq.StringParam("invoiceID", invoice.ID),
+			sq.StringParam("customerID", invoice.Customer.ID),
+			sq.StringParam("subscriptionID", subscriptionID),
+			sq.StringParam("number", invoice.Number),
+			sq.StringParam("status", string(invoice.Status)),
+			sq.Int64Param("amountDue", invoice.AmountDue),
+			sq.Int64Param("amountPaid", invoice.AmountPaid),
+			sq.StringParam("currency", string(invoice.Currency)),
+			sq.Int64Param("creationTime", invoice.Created),
+			sq.StringParam("hostedInvoiceURL", invoice.HostedInvoiceURL),
+			sq.StringParam("invoicePDF", invoice.InvoicePDF),
+			sq.Int64Param("eventTime", eventTime),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE invoice" +
+			" SET number = {number}, status = {status}, amount_due = {amountDue}, amount_paid = {amountPaid}, currency = {currency}" +
+			", hosted_invoice_url = {hostedInvoiceURL}, invoice_pdf = {invoicePDF}, event_time = {eventTime}" +
+			" WHERE invoice_id = {invoiceID} AND event_time <= {eventTime}",
+		Values: []any{
+			sq.StringParam("number", invoice.Number),
+			sq.StringParam("status", string(invoice.Status)),
+			sq.Int64Param("amountDue", invoice.AmountDue),
+			sq.Int64Param("amountPaid", invoice.AmountPaid),
+			sq.StringParam("currency", string(invoice.Currency)),
+			sq.StringParam("hostedInvoiceURL", invoice.HostedInvoiceURL),
+			sq.StringParam("invoicePDF", invoice.InvoicePDF),
+			sq.Int64Param("eventTime", eventTime),
+			sq.StringParam("invoiceID", invoice.ID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// getInvoices returns the most recent invoices of a customer, newest first.
+func getInvoices(ctx context.Context, nbrew *notebrew.Notebrew, customerID string, limit int) ([]Invoice, error) {
+	return sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM invoice WHERE customer_id = {customerID} ORDER BY creation_time DESC LIMIT {limit}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+			sq.IntParam("limit", limit),
+		},
+	}, func(row *sq.Row) Invoice {
+		return Invoice{
+			InvoiceID:        row.String("invoice_id"),
+			CustomerID:       row.String("customer_id"),
+			SubscriptionID:   row.String("subscription_id"),
+			Number:           row.String("number"),
+			Status:           row.String("status"),
+			AmountDue:        row.Int64("amount_due"),
+			AmountPaid:       row.Int64("amount_paid"),
+			Currency:         row.String("currency"),
+			CreationTime:     time.Unix(row.Int64("creation_time"), 0).UTC(),
+			HostedInvoiceURL: row.String("hosted_invoice_url"),
+			InvoicePDF:       row.String("invoice_pdf"),
+		}
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/hex"
@@ -10,7 +9,6 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
@@ -19,8 +17,8 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -124,6 +122,10 @@ func main() {
 			if err != nil {
 				return err
 			}
+			err = initCustomerSync(context.Background(), nbrew)
+			if err != nil {
+				return err
+			}
 		}
 		if nbrew.DB != nil && nbrew.Dialect == "sqlite" {
 			_, err := nbrew.DB.ExecContext(context.Background(), "PRAGMA optimize(0x10002)")
@@ -163,30 +165,84 @@ func main() {
 				}
 			}()
 		}
-		// Stripe.
-		var stripeConfig StripeConfig
-		b, err := os.ReadFile(filepath.Join(configDir, "stripe.json"))
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("%s: %w", filepath.Join(configDir, "stripe.json"), err)
+		// Stripe and signup.
+		stripeConfig, signupDisabled, err := readConfig(configDir)
+		if err != nil {
+			return err
 		}
-		b = bytes.TrimSpace(b)
-		if len(b) > 0 {
-			decoder := json.NewDecoder(bytes.NewReader(b))
-			decoder.DisallowUnknownFields()
-			err := decoder.Decode(&stripeConfig)
-			if err != nil {
-				return fmt.Errorf("%s: %w", filepath.Join(configDir, "stripe.json"), err)
-			}
-			stripe.Key = stripeConfig.SecretKey
+		stripe.Key = stripeConfig.SecretKey
+		// liveConfig holds the configuration that SIGHUP reloads. Each
+		// request and billing job run uses whichever config was current when
+		// it started.
+		type liveConfig struct {
+			stripeConfig   StripeConfig
+			signupDisabled bool
+			handler        http.Handler
 		}
-		// Signup.
-		b, err = os.ReadFile(filepath.Join(configDir, "signupdisabled.txt"))
-		if err != nil && !errors.Is(err, fs.ErrNotExist) {
-			return fmt.Errorf("%s: %w", filepath.Join(configDir, "signupdisabled.txt"), err)
+		var live atomic.Pointer[liveConfig]
+		live.Store(&liveConfig{
+			stripeConfig:   stripeConfig,
+			signupDisabled: signupDisabled,
+			handler:        ServeHTTP(nbrew, stripeConfig, signupDisabled),
+		})
+		// runBillingJobs runs the billing jobs every hour until ctx is
+		// canceled. It is only started by the commands that serve requests,
+		// not by one-shot commands.
+		runBillingJobs := func(ctx context.Context) {
+			if nbrew.DB == nil || (stripeConfig.SecretKey == "" && stripeConfig.Provider != "manual") {
+				return
+			}
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				stripeConfig := live.Load().stripeConfig
+				err := runDunning(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runOverageBilling(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runTrialReminders(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runPurchaseExpiry(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runVoucherExpiry(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runManualRenewals(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+				err = runCustomerSync(ctx, nbrew, stripeConfig)
+				if err != nil {
+					nbrew.Logger.Error(err.Error())
+				}
+			}
 		}
-		signupDisabled, _ := strconv.ParseBool(string(bytes.TrimSpace(b)))
 		if len(args) > 0 {
 			switch args[0] {
+			case "billing":
+				cmd, err := BillingCommand(nbrew, stripeConfig, args[1:]...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				return nil
 			case "createinvite":
 				cmd, err := cli.CreateinviteCommand(nbrew, args[1:]...)
 				if err != nil {
@@ -273,6 +329,9 @@ func main() {
 					return fmt.Errorf("%s: %w", args[0], err)
 				}
 				cmd.Handler = ServeHTTP(nbrew, stripeConfig, signupDisabled)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go runBillingJobs(ctx)
 				err = cmd.Run()
 				if err != nil {
 					return fmt.Errorf("%s: %w", args[0], err)
@@ -298,6 +357,16 @@ func main() {
 					return fmt.Errorf("%s: %w", args[0], err)
 				}
 				return nil
+			case "stripe":
+				cmd, err := StripeCommand(nbrew, stripeConfig, args[1:]...)
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				err = cmd.Run()
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				return nil
 			case "version":
 				fmt.Println(notebrew.Version)
 				return nil
@@ -309,7 +378,9 @@ func main() {
 		if err != nil {
 			return err
 		}
-		server.Handler = ServeHTTP(nbrew, stripeConfig, signupDisabled)
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			live.Load().handler.ServeHTTP(w, r)
+		})
 		listener, err := net.Listen("tcp", server.Addr)
 		if err != nil {
 			var errno syscall.Errno
@@ -328,8 +399,13 @@ func main() {
 			}
 			return err
 		}
+		billingCtx, cancelBilling := context.WithCancel(context.Background())
+		defer cancelBilling()
+		go runBillingJobs(billingCtx)
 		wait := make(chan os.Signal, 1)
-		signal.Notify(wait, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		signal.Notify(wait, syscall.SIGINT, syscall.SIGTERM)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
 		if server.Addr == ":443" {
 			go http.ListenAndServe(":80", http.HandlerFunc(nbrew.RedirectToHTTPS))
 			go func() {
@@ -354,7 +430,40 @@ func main() {
 				fmt.Printf("notebrew is running on %s\n", server.Addr)
 			}
 		}
-		<-wait
+		for running := true; running; {
+			select {
+			case <-hangup:
+				// Reload stripe.json and signupdisabled.txt, keeping the
+				// current config if the new one is invalid.
+				stripeConfig, signupDisabled, err := readConfig(configDir)
+				if err != nil {
+					nbrew.Logger.Error("config not reloaded: " + err.Error())
+					continue
+				}
+				current := live.Load()
+				if stripeConfig.Provider != current.stripeConfig.Provider {
+					nbrew.Logger.Error("config not reloaded: " + filepath.Join(configDir, "stripe.json") + ": provider cannot be changed without a restart")
+					continue
+				}
+				if stripeConfig.SecretKey != current.stripeConfig.SecretKey {
+					nbrew.Logger.Error("config not reloaded: " + filepath.Join(configDir, "stripe.json") + ": secretKey cannot be changed without a restart")
+					continue
+				}
+				changes := configChanges(current.stripeConfig, stripeConfig, current.signupDisabled, signupDisabled)
+				live.Store(&liveConfig{
+					stripeConfig:   stripeConfig,
+					signupDisabled: signupDisabled,
+					handler:        ServeHTTP(nbrew, stripeConfig, signupDisabled),
+				})
+				if len(changes) == 0 {
+					nbrew.Logger.Info("config reloaded: no changes")
+				} else {
+					nbrew.Logger.Info("config reloaded: " + strings.Join(changes, ", "))
+				}
+			case <-wait:
+				running = false
+			}
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 		server.Shutdown(ctx)
@@ -413,8 +522,11 @@ func ServeHTTP(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, signupDisabl
 			return
 		}
 		urlPath := strings.Trim(r.URL.Path, "/")
+		if (urlPath == "users/profile" || urlPath == "signup") && r.Form.Has("coupon") {
+			setCouponCookie(w, r, stripeConfig)
+		}
 		switch urlPath {
-		case "users/profile":
+		case "users/profile", "redeem":
 			if nbrew.DB == nil {
 				nbrew.NotFound(w, r)
 				return
@@ -471,6 +583,10 @@ func ServeHTTP(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, signupDisabl
 				nbrew.InternalServerError(w, r, err)
 				return
 			}
+			if urlPath == "redeem" {
+				redeem(nbrew, w, r, user, stripeConfig)
+				return
+			}
 			profile(nbrew, w, r, user, stripeConfig)
 			return
 		case "stripe/webhook":
@@ -483,6 +599,89 @@ func ServeHTTP(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, signupDisabl
 		}
 		head, tail, _ := strings.Cut(urlPath, "/")
 		switch head {
+		case "files":
+			if nbrew.DB == nil || r.Method != "POST" {
+				break
+			}
+			siteName, action := splitFilesPath(tail)
+			switch action {
+			case "delete", "deletesite", "calculatestorage":
+				// Always allowed, so that users can get back within their
+				// limits.
+			default:
+				userID, ok, err := getSessionUserID(nbrew, r)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				if !ok {
+					// Let notebrew reject the request.
+					break
+				}
+				locked, err := siteLocked(r.Context(), nbrew, siteName, userID)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				if locked {
+					nbrew.BadRequest(w, r, fmt.Errorf("site is read-only because you own more sites than your plan allows: delete some sites or upgrade your plan"))
+					return
+				}
+			}
+			if action == "uploadfile" {
+				exceeded, err := storageExceeded(r.Context(), nbrew, siteName)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				if exceeded {
+					nbrew.BadRequest(w, r, fmt.Errorf("uploads are disabled because you are using more storage than your plan allows: delete some files or upgrade your plan"))
+					return
+				}
+			}
+			recorder := &statusRecorder{ResponseWriter: w}
+			nbrew.ServeHTTP(recorder, r)
+			if recorder.status >= 400 {
+				return
+			}
+			switch action {
+			case "delete", "deletesite":
+				err := enforceSiteLimitsAfterDelete(r.Context(), nbrew)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+				}
+			case "calculatestorage":
+			default:
+				err := recordSiteActivity(r.Context(), nbrew, siteName)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+				}
+			}
+			return
+		case "users":
+			if nbrew.DB == nil || r.Method != "POST" || (tail != "updateemail" && tail != "updateprofile") {
+				break
+			}
+			nbrew.ServeHTTP(w, r)
+			// Push email and username changes to the user's Stripe customer.
+			// An email change confirmed without a session (from the link in
+			// the confirmation email) is picked up by runCustomerSync instead.
+			userID, ok, err := getSessionUserID(nbrew, r)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				return
+			}
+			if !ok {
+				return
+			}
+			err = syncCustomerDetails(r.Context(), nbrew, stripeConfig, userID)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+			}
+			return
 		case "signup":
 			if nbrew.DB == nil || nbrew.Mailer == nil || signupDisabled {
 				nbrew.NotFound(w, r)
@@ -553,6 +752,16 @@ func ServeHTTP(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, signupDisabl
 				nbrew.InternalServerError(w, r, err)
 				return
 			}
+			// The manual provider has no checkout sessions to return to and
+			// no Stripe subscriptions to manage.
+			if stripeConfig.Provider == "manual" {
+				switch tail {
+				case "checkout", "portal":
+				default:
+					nbrew.NotFound(w, r)
+					return
+				}
+			}
 			switch tail {
 			case "checkout":
 				stripeCheckout(nbrew, w, r, user, stripeConfig)
@@ -561,7 +770,25 @@ func ServeHTTP(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, signupDisabl
 				stripeCheckoutSuccess(nbrew, w, r, user, stripeConfig)
 				return
 			case "portal":
-				stripePortal(nbrew, w, r, user)
+				stripePortal(nbrew, w, r, user, stripeConfig)
+				return
+			case "addon":
+				stripeAddOn(nbrew, w, r, user, stripeConfig)
+				return
+			case "interval":
+				stripeInterval(nbrew, w, r, user, stripeConfig)
+				return
+			case "changeplan":
+				stripeChangePlan(nbrew, w, r, user, stripeConfig)
+				return
+			case "cancel":
+				stripeCancel(nbrew, w, r, user, stripeConfig)
+				return
+			case "team":
+				stripeTeam(nbrew, w, r, user, stripeConfig)
+				return
+			case "gift":
+				stripeGift(nbrew, w, r, user, stripeConfig)
 				return
 			}
 		}
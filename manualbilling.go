@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/notebrew/stacktrace"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// errNoPortal is returned by BillingProvider.Portal if the provider has no
+// page where customers can manage their billing.
+var errNoPortal = errors.New("there is no billing portal: contact us to update your billing details")
+
+// manualRenewalDays is how many days before the end of a billing period the
+// manual provider issues the invoice for the next one.
+const manualRenewalDays = 7
+
+// ManualProvider lets self-hosters run paid plans without Stripe. Checking out
+// creates a subscription and an open invoice in the local tables, which the
+// customer settles outside of notebrew (e.g. by bank transfer). An admin then
+// marks the invoice paid with `notebrew billing markpaid`, which starts or
+// renews the subscription. Invoices for the next billing period are issued by
+// runManualRenewals, and subscriptions whose invoice is not paid by the end
+// of the period go through the same dunning as failed Stripe payments.
+//
+// Manual subscriptions, invoices and customers have IDs prefixed with msub_,
+// minv_ and mcus_, so that they never collide with Stripe IDs.
+type ManualProvider struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+}
+
+// newManualID returns a random ID for a manual subscription, invoice or
+// customer.
+func newManualID(prefix string) string {
+	var b [12]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	return prefix + "_" + hex.EncodeToString(b[:])
+}
+
+func (provider *ManualProvider) Checkout(ctx context.Context, params CheckoutParams) (redirectURL string, err error) {
+	nbrew := provider.Notebrew
+	if params.Plan.OneTime {
+		return "", fmt.Errorf("plan %q: one-time plans require the stripe provider", params.Plan.Name)
+	}
+	customerID := params.User.CustomerID
+	if customerID == "" {
+		customerID = "mcus_" + hex.EncodeToString(params.User.UserID[:])
+		err := linkCustomer(ctx, nbrew, customerID, params.User.UserID, true)
+		if err != nil {
+			return "", err
+		}
+	}
+	now := time.Now()
+	// A customer who checks out again without paying the invoice of their
+	// previous checkout has changed their mind, so the previous invoice is
+	// voided rather than left for the admin to chase.
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE invoice SET status = 'void', event_time = {now}" +
+			" WHERE status = 'open' AND subscription_id IN (" +
+			"SELECT subscription_id FROM subscription WHERE customer_id = {customerID} AND status = 'incomplete'" +
+			")",
+		Values: []any{
+			sq.Int64Param("now", now.Unix()),
+			sq.StringParam("customerID", customerID),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE subscription SET status = 'incomplete_expired', event_time = {now} WHERE customer_id = {customerID} AND status = 'incomplete'",
+		Values: []any{
+			sq.Int64Param("now", now.Unix()),
+			sq.StringParam("customerID", customerID),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal([]SubscriptionItem{{
+		ItemID:   newManualID("msi"),
+		PriceID:  params.PriceID,
+		Quantity: params.Quantity,
+	}})
+	if err != nil {
+		return "", err
+	}
+	// A subscription on a free trial is entitled straight away and is
+	// invoiced by runManualRenewals as the trial nears its end. Otherwise the
+	// subscription is incomplete until its first invoice is paid.
+	subscriptionID := newManualID("msub")
+	status := string(stripe.SubscriptionStatusIncomplete)
+	currentPeriodEnd := now.Unix()
+	var trialEnd sql.NullInt64
+	if params.TrialDays > 0 {
+		status = string(stripe.SubscriptionStatusTrialing)
+		currentPeriodEnd = now.AddDate(0, 0, int(params.TrialDays)).Unix()
+		trialEnd = sql.NullInt64{Int64: currentPeriodEnd, Valid: true}
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO subscription (subscription_id, customer_id, status, items, current_period_end, trial_end, event_time)" +
+			" VALUES ({subscriptionID}, {customerID}, {status}, {items}, {currentPeriodEnd}, {trialEnd}, {eventTime})",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscriptionID),
+			sq.StringParam("customerID", customerID),
+			sq.StringParam("status", status),
+			sq.StringParam("items", string(b)),
+			sq.Int64Param("currentPeriodEnd", currentPeriodEnd),
+			sq.Param("trialEnd", trialEnd),
+			sq.Int64Param("eventTime", now.Unix()),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if params.TrialDays > 0 {
+		_, err = syncEntitlement(ctx, nbrew, provider.StripeConfig, params.User.UserID)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		err = issueManualInvoice(ctx, nbrew, subscriptionID, customerID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return params.ReturnURL, nil
+}
+
+func (provider *ManualProvider) Portal(ctx context.Context, customerID, returnURL string) (portalURL string, err error) {
+	return "", errNoPortal
+}
+
+func (provider *ManualProvider) VerifyWebhook(payload []byte, header http.Header) (event stripe.Event, label string, err error) {
+	return stripe.Event{}, "", fmt.Errorf("the manual billing provider does not receive webhook events")
+}
+
+func (provider *ManualProvider) Subscriptions(ctx context.Context, customerID string) ([]Subscription, error) {
+	subscriptions, err := getSubscriptions(ctx, provider.Notebrew, customerID)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, subscription := range subscriptions {
+		switch stripe.SubscriptionStatus(subscription.Status) {
+		case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+			continue
+		}
+		subscriptions[n] = subscription
+		n++
+	}
+	return subscriptions[:n], nil
+}
+
+// issueManualInvoice creates an open invoice for the next billing period of
+// a manual subscription. The amount is filled in when the invoice is marked
+// paid, since plans only describe their price for display.
+func issueManualInvoice(ctx context.Context, nbrew *notebrew.Notebrew, subscriptionID, customerID string) error {
+	now := time.Now().Unix()
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO invoice (invoice_id, customer_id, subscription_id, status, amount_due, amount_paid, currency, creation_time, event_time)" +
+			" VALUES ({invoiceID}, {customerID}, {subscriptionID}, 'open', 0, 0, '', {creationTime}, {eventTime})",
+		Values: []any{
+			sq.StringParam("invoiceID", newManualID("minv")),
+			sq.StringParam("customerID", customerID),
+			sq.StringParam("subscriptionID", subscriptionID),
+			sq.Int64Param("creationTime", now),
+			sq.Int64Param("eventTime", now),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// markManualInvoicePaid marks an open manual invoice as paid for the given
+// amount (in the smallest currency unit) and extends its subscription by one
+// billing period, counted from the end of the current period or from now,
+// whichever is later.
+func markManualInvoicePaid(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, invoiceID string, amount int64, currency string) error {
+	if !strings.HasPrefix(invoiceID, "minv_") {
+		return fmt.Errorf("%s is not a manual invoice", invoiceID)
+	}
+	type Invoice struct {
+		CustomerID       string
+		SubscriptionID   string
+		Status           string
+		CurrentPeriodEnd int64
+		Items            []SubscriptionItem
+	}
+	invoice, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM invoice" +
+			" JOIN subscription ON subscription.subscription_id = invoice.subscription_id" +
+			" WHERE invoice.invoice_id = {invoiceID}",
+		Values: []any{
+			sq.StringParam("invoiceID", invoiceID),
+		},
+	}, func(row *sq.Row) Invoice {
+		invoice := Invoice{
+			CustomerID:       row.String("invoice.customer_id"),
+			SubscriptionID:   row.String("invoice.subscription_id"),
+			Status:           row.String("invoice.status"),
+			CurrentPeriodEnd: row.Int64("subscription.current_period_end"),
+		}
+		b := row.Bytes(nil, "subscription.items")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &invoice.Items)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return invoice
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no invoice with ID %q", invoiceID)
+		}
+		return err
+	}
+	if invoice.Status != "open" {
+		return fmt.Errorf("invoice %s is %s, not open", invoiceID, invoice.Status)
+	}
+	interval := "month"
+	for _, item := range invoice.Items {
+		plan, ok := stripeConfig.PlanByPriceID(item.PriceID)
+		if !ok {
+			continue
+		}
+		price, _ := plan.PriceByID(item.PriceID)
+		interval = price.Interval
+	}
+	now := time.Now()
+	periodStart := time.Unix(max(now.Unix(), invoice.CurrentPeriodEnd), 0)
+	currentPeriodEnd := periodStart.AddDate(0, 1, 0)
+	if interval == "year" {
+		currentPeriodEnd = periodStart.AddDate(1, 0, 0)
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE invoice SET status = 'paid', amount_due = {amount}, amount_paid = {amount}, currency = {currency}, event_time = {eventTime}" +
+			" WHERE invoice_id = {invoiceID}",
+		Values: []any{
+			sq.Int64Param("amount", amount),
+			sq.StringParam("currency", currency),
+			sq.Int64Param("eventTime", now.Unix()),
+			sq.StringParam("invoiceID", invoiceID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE subscription SET status = 'active', current_period_end = {currentPeriodEnd}, event_time = {eventTime}" +
+			" WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.Int64Param("currentPeriodEnd", currentPeriodEnd.Unix()),
+			sq.Int64Param("eventTime", now.Unix()),
+			sq.StringParam("subscriptionID", invoice.SubscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = endDunning(ctx, nbrew, invoice.SubscriptionID, invoice.CustomerID)
+	if err != nil {
+		return err
+	}
+	return syncCustomerEntitlement(ctx, nbrew, stripeConfig, invoice.CustomerID)
+}
+
+// cancelManualSubscription cancels a manual subscription immediately, voiding
+// its open invoices.
+func cancelManualSubscription(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, subscriptionID string) error {
+	if !strings.HasPrefix(subscriptionID, "msub_") {
+		return fmt.Errorf("%s is not a manual subscription", subscriptionID)
+	}
+	customerID, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM subscription WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("customer_id")
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no subscription with ID %q", subscriptionID)
+		}
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE invoice SET status = 'void', event_time = {now} WHERE subscription_id = {subscriptionID} AND status = 'open'",
+		Values: []any{
+			sq.Int64Param("now", now),
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE subscription SET status = 'canceled', event_time = {now} WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.Int64Param("now", now),
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	err = endDunning(ctx, nbrew, subscriptionID, customerID)
+	if err != nil {
+		return err
+	}
+	return syncCustomerEntitlement(ctx, nbrew, stripeConfig, customerID)
+}
+
+// runManualRenewals issues the invoices of manual subscriptions whose
+// billing period is about to end, and starts dunning on the subscriptions
+// whose billing period has ended without their invoice being paid. It does
+// nothing unless the manual provider is configured.
+func runManualRenewals(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	if stripeConfig.Provider != "manual" {
+		return nil
+	}
+	type Renewal struct {
+		SubscriptionID   string
+		CustomerID       string
+		Status           string
+		CurrentPeriodEnd time.Time
+		Email            string
+		Invoiced         bool
+	}
+	renewals, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM subscription" +
+			" JOIN customer ON customer.customer_id = subscription.customer_id" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE subscription.subscription_id LIKE 'msub%'" +
+			" AND subscription.status IN ('active', 'trialing', 'past_due')" +
+			" AND subscription.current_period_end <= {renewalTime}",
+		Values: []any{
+			sq.Int64Param("renewalTime", time.Now().AddDate(0, 0, manualRenewalDays).Unix()),
+		},
+	}, func(row *sq.Row) Renewal {
+		return Renewal{
+			SubscriptionID:   row.String("subscription.subscription_id"),
+			CustomerID:       row.String("subscription.customer_id"),
+			Status:           row.String("subscription.status"),
+			CurrentPeriodEnd: time.Unix(row.Int64("subscription.current_period_end"), 0).UTC(),
+			Email:            row.String("users.email"),
+			Invoiced: row.Bool("EXISTS (SELECT 1 FROM invoice WHERE invoice.subscription_id = subscription.subscription_id" +
+				" AND invoice.status = 'open')"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	scheme := "https://"
+	if !nbrew.CMSDomainHTTPS {
+		scheme = "http://"
+	}
+	profileURL := scheme + nbrew.CMSDomain + "/users/profile/"
+	for _, renewal := range renewals {
+		if !renewal.Invoiced {
+			err := issueManualInvoice(ctx, nbrew, renewal.SubscriptionID, renewal.CustomerID)
+			if err != nil {
+				return err
+			}
+			if nbrew.Mailer != nil {
+				nbrew.Mailer.C <- notebrew.Mail{
+					MailFrom: nbrew.MailFrom,
+					RcptTo:   renewal.Email,
+					Headers: []string{
+						"Subject", "Your notebrew invoice is due",
+						"Content-Type", "text/html; charset=utf-8",
+					},
+					Body: strings.NewReader(fmt.Sprintf(
+						"<p>The invoice for your next notebrew billing period is due by %[1]s."+
+							" See <a href='%[2]s'>%[2]s</a> for your billing history.</p>",
+						renewal.CurrentPeriodEnd.Format("2006-01-02"), profileURL,
+					)),
+				}
+			}
+			continue
+		}
+		if renewal.Status == string(stripe.SubscriptionStatusPastDue) || time.Now().Before(renewal.CurrentPeriodEnd) {
+			continue
+		}
+		// The user keeps their plan until the dunning grace period is over,
+		// same as when a Stripe payment fails.
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE subscription SET status = 'past_due', event_time = {eventTime} WHERE subscription_id = {subscriptionID}",
+			Values: []any{
+				sq.Int64Param("eventTime", time.Now().Unix()),
+				sq.StringParam("subscriptionID", renewal.SubscriptionID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = startDunning(ctx, nbrew, renewal.SubscriptionID, renewal.CustomerID, "past_due")
+		if err != nil {
+			return err
+		}
+		err = syncCustomerEntitlement(ctx, nbrew, stripeConfig, renewal.CustomerID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/notebrew/sq"
+)
+
+func TestManualBilling(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	manualConfig := StripeConfig{
+		Provider: "manual",
+		Plans:    testStripeConfig.Plans[:3],
+	}
+	err := manualConfig.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	serveManualRequest := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "http://"+nbrew.CMSDomain+target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+		w := httptest.NewRecorder()
+		ServeHTTP(nbrew, manualConfig, false).ServeHTTP(w, r)
+		return w
+	}
+	getInvoiceStatuses := func(customerID string) []string {
+		t.Helper()
+		statuses, err := sq.FetchAll(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM invoice WHERE customer_id = {customerID} ORDER BY creation_time, status",
+			Values: []any{
+				sq.StringParam("customerID", customerID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("status")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return statuses
+	}
+	getOpenInvoiceID := func(customerID string) string {
+		t.Helper()
+		invoiceID, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM invoice WHERE customer_id = {customerID} AND status = 'open'",
+			Values: []any{
+				sq.StringParam("customerID", customerID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("invoice_id")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return invoiceID
+	}
+
+	// Checking out sends the user straight back to their profile with an
+	// open invoice, and the plan is only granted once it is paid.
+	w := serveManualRequest("POST", "/stripe/checkout/", url.Values{
+		"priceID": []string{"price_pro"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); !strings.HasSuffix(location, "/users/profile/") {
+		t.Errorf("checkout: expected redirect to /users/profile/, got %q", location)
+	}
+	// There are no checkout sessions to come back from.
+	w = serveManualRequest("GET", "/stripe/checkout/success/?sessionID=cs_test_1", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("checkout success: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	user := getTestUser(t, nbrew, userID)
+	if !strings.HasPrefix(user.CustomerID, "mcus_") {
+		t.Fatalf("checkout: expected a manual customer, got %q", user.CustomerID)
+	}
+	assertPlan(t, user, testStripeConfig.Plans[0])
+
+	// Checking out again voids the first invoice.
+	w = serveManualRequest("POST", "/stripe/checkout/", url.Values{
+		"priceID": []string{"price_business"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout again: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	statuses := getInvoiceStatuses(user.CustomerID)
+	if len(statuses) != 2 || !slices.Contains(statuses, "open") || !slices.Contains(statuses, "void") {
+		t.Fatalf("checkout again: expected one open and one void invoice, got %q", statuses)
+	}
+
+	invoiceID := getOpenInvoiceID(user.CustomerID)
+	err = markManualInvoicePaid(context.Background(), nbrew, manualConfig, invoiceID, 2000, "usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[2])
+	err = markManualInvoicePaid(context.Background(), nbrew, manualConfig, invoiceID, 2000, "usd")
+	if err == nil {
+		t.Error("expected a paid invoice not to be paid twice")
+	}
+	_, _, _, ok, err := getPlanSubscription(context.Background(), nbrew, manualConfig, user.CustomerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a plan subscription")
+	}
+
+	// Stripe-only pages are not served.
+	w = serveManualRequest("GET", "/stripe/changeplan/?priceID=price_pro", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("changeplan: expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	w = serveManualRequest("POST", "/stripe/portal/", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("portal: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// The renewal invoice is issued as the period nears its end, and the
+	// subscription goes into dunning if the period ends without it being
+	// paid.
+	subscriptions, err := getSubscriptions(context.Background(), nbrew, user.CustomerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subscriptionID string
+	for _, subscription := range subscriptions {
+		if subscription.Status == "active" {
+			subscriptionID = subscription.SubscriptionID
+		}
+	}
+	setPeriodEnd := func(periodEnd time.Time) {
+		t.Helper()
+		_, err := sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE subscription SET current_period_end = {periodEnd} WHERE subscription_id = {subscriptionID}",
+			Values: []any{
+				sq.Int64Param("periodEnd", periodEnd.Unix()),
+				sq.StringParam("subscriptionID", subscriptionID),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPeriodEnd(time.Now().Add(24 * time.Hour))
+	err = runManualRenewals(context.Background(), nbrew, manualConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewalInvoiceID := getOpenInvoiceID(user.CustomerID)
+	setPeriodEnd(time.Now().Add(-time.Hour))
+	err = runManualRenewals(context.Background(), nbrew, manualConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getOpenInvoiceID(user.CustomerID) != renewalInvoiceID {
+		t.Error("expected no second renewal invoice")
+	}
+	inDunning, err := sq.FetchExists(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM dunning WHERE subscription_id = {subscriptionID} AND end_time IS NULL",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscriptionID),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inDunning {
+		t.Fatal("expected the overdue subscription to be in dunning")
+	}
+	// The plan is kept during the grace period.
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[2])
+
+	err = cancelManualSubscription(context.Background(), nbrew, manualConfig, subscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[0])
+	for _, status := range getInvoiceStatuses(user.CustomerID) {
+		if status == "open" {
+			t.Error("expected no open invoices after canceling")
+		}
+	}
+}
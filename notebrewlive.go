@@ -3,8 +3,11 @@ package main
 import (
 	"embed"
 	"io/fs"
+	"slices"
+	"strings"
 
 	"github.com/bokwoon95/notebrew"
+	"github.com/stripe/stripe-go/v79/client"
 )
 
 type User struct {
@@ -13,20 +16,311 @@ type User struct {
 }
 
 type Plan struct {
+	// Archived plans are no longer offered to new customers, but existing
+	// subscribers keep their plan (and its limits) for as long as they stay
+	// subscribed.
 	Archived     bool            `json:"archived"`
 	Name         string          `json:"name"`
 	SiteLimit    int64           `json:"siteLimit"`
 	StorageLimit int64           `json:"storageLimit"`
 	UserFlags    map[string]bool `json:"userFlags"`
-	Price        string          `json:"price"`
-	PriceID      string          `json:"priceID"`
+	// Price and PriceID are the monthly price of the plan.
+	Price   string `json:"price"`
+	PriceID string `json:"priceID"`
+	// Prices are the prices of the plan for other billing intervals, such
+	// as a yearly price.
+	Prices []PlanPrice `json:"prices"`
+	// TrialDays is the length of the free trial new customers get when
+	// subscribing to the plan. Zero means no trial.
+	TrialDays int64 `json:"trialDays"`
+	// OveragePriceID is the priceID of a monthly metered price that storage
+	// used above StorageLimit is billed against. If set, StorageLimit is an
+	// allowance rather than a hard cap, and every other price of the plan
+	// needs a metered price of its own interval (see PlanPrice), since all
+	// the prices of a subscription must share the same billing interval.
+	OveragePriceID string `json:"overagePriceID"`
+	// OverageUnitSize is the number of bytes in one unit of the overage
+	// price. Defaults to 1 GB.
+	OverageUnitSize int64 `json:"overageUnitSize"`
+	// OverageUnitAmount is the price of one unit of overage in the smallest
+	// currency unit (e.g. cents), used to show projected overage charges.
+	OverageUnitAmount int64 `json:"overageUnitAmount"`
+	// OverageCurrency is the currency of OverageUnitAmount. Defaults to
+	// "usd".
+	OverageCurrency string `json:"overageCurrency"`
+	// OneTime plans are paid for once through a payment mode checkout rather
+	// than a subscription, in which case Price and PriceID are a one-time
+	// price and the plan has no other prices.
+	OneTime bool `json:"oneTime"`
+	// DurationDays is how long a one-time plan lasts from the time it is
+	// paid for, after which the user reverts to the free plan. Zero means
+	// the plan never expires (a lifetime plan).
+	DurationDays int64 `json:"durationDays"`
+	// PerSeat plans are team plans billed per seat: the quantity of the
+	// subscription is the number of seats, one of which is taken by the
+	// subscriber. The subscriber can invite other users to fill the rest of
+	// the seats, and every seated member gets the plan's limits and flags.
+	PerSeat bool `json:"perSeat"`
+}
+
+// PlanPrice is the price of a plan for a billing interval.
+type PlanPrice struct {
+	// Interval is the billing interval of the price: "month" or "year", or
+	// "once" for the price of a one-time plan.
+	Interval string `json:"interval"`
+	Price    string `json:"price"`
+	PriceID  string `json:"priceID"`
+	// OveragePriceID is the metered price that storage overage is billed
+	// against on this interval, for plans with an OveragePriceID.
+	OveragePriceID string `json:"overagePriceID"`
+}
+
+// AllPrices returns the prices of the plan for every billing interval,
+// starting with the monthly price (or the one-time price of a one-time plan).
+func (plan Plan) AllPrices() []PlanPrice {
+	var prices []PlanPrice
+	if plan.PriceID != "" && plan.OneTime {
+		prices = append(prices, PlanPrice{
+			Interval: "once",
+			Price:    plan.Price,
+			PriceID:  plan.PriceID,
+		})
+	} else if plan.PriceID != "" {
+		prices = append(prices, PlanPrice{
+			Interval:       "month",
+			Price:          plan.Price,
+			PriceID:        plan.PriceID,
+			OveragePriceID: plan.OveragePriceID,
+		})
+	}
+	for _, price := range plan.Prices {
+		if price.PriceID == "" {
+			continue
+		}
+		if price.Interval == "" {
+			price.Interval = "month"
+		}
+		prices = append(prices, price)
+	}
+	return prices
+}
+
+// PriceFor returns the price of the plan for the given billing interval, or
+// the zero PlanPrice if the plan is not available for that interval.
+func (plan Plan) PriceFor(interval string) PlanPrice {
+	for _, price := range plan.AllPrices() {
+		if price.Interval == interval {
+			return price
+		}
+	}
+	return PlanPrice{}
+}
+
+// OveragePriceFor returns the metered overage price of the plan for the given
+// billing interval, or an empty string if the plan does not bill for overage
+// on that interval.
+func (plan Plan) OveragePriceFor(interval string) string {
+	if plan.OveragePriceID == "" {
+		return ""
+	}
+	return plan.PriceFor(interval).OveragePriceID
+}
+
+// IsOveragePrice reports whether priceID is one of the plan's metered
+// overage prices.
+func (plan Plan) IsOveragePrice(priceID string) bool {
+	if plan.OveragePriceID == "" || priceID == "" {
+		return false
+	}
+	for _, price := range plan.AllPrices() {
+		if price.OveragePriceID == priceID {
+			return true
+		}
+	}
+	return false
+}
+
+// PriceByID returns the price of the plan with the given priceID.
+func (plan Plan) PriceByID(priceID string) (PlanPrice, bool) {
+	for _, price := range plan.AllPrices() {
+		if price.PriceID == priceID {
+			return price, true
+		}
+	}
+	return PlanPrice{}, false
+}
+
+// IsFree reports whether the plan has no prices.
+func (plan Plan) IsFree() bool {
+	return len(plan.AllPrices()) == 0
+}
+
+// AddOn is a product that can be bought in any quantity on top of a plan.
+// Each unit adds SiteLimit sites and StorageLimit bytes to the user's plan.
+type AddOn struct {
+	Name         string `json:"name"`
+	SiteLimit    int64  `json:"siteLimit"`
+	StorageLimit int64  `json:"storageLimit"`
+	Price        string `json:"price"`
+	PriceID      string `json:"priceID"`
+}
+
+// Gift is a prepaid period of a plan that a user buys for someone else with a
+// one-time payment. The recipient is emailed a voucher code, which they
+// redeem on /redeem/ to get the plan for the prepaid period.
+type Gift struct {
+	Name string `json:"name"`
+	// Plan is the name of the plan that the gift grants.
+	Plan string `json:"plan"`
+	// Months is the length of the prepaid period, counted from when the
+	// voucher is redeemed.
+	Months int64 `json:"months"`
+	// Price and PriceID are the one-time price of the gift.
+	Price   string `json:"price"`
+	PriceID string `json:"priceID"`
+}
+
+// Coupon is a Stripe coupon that can be pre-applied at checkout through a
+// ?coupon=Code link on /users/profile/ or /signup/.
+type Coupon struct {
+	Code        string `json:"code"`
+	CouponID    string `json:"couponID"`
+	Description string `json:"description"`
+}
+
+// RetentionOffer is a discount offered on the cancellation page to users who
+// are about to cancel their subscription.
+type RetentionOffer struct {
+	// CouponID is the Stripe coupon applied to the subscription if the user
+	// accepts the offer.
+	CouponID string `json:"couponID"`
+	// Description is shown to the user, e.g. "50% off your next 3 months".
+	Description string `json:"description"`
+}
+
+// WebhookSecret is a webhook endpoint signing secret. The label identifies the
+// secret in the logs without revealing it.
+type WebhookSecret struct {
+	Label  string `json:"label"`
+	Secret string `json:"secret"`
 }
 
 type StripeConfig struct {
+	// Provider is the billing provider that takes payment for paid plans:
+	// "stripe" (the default) or "manual", which issues invoices that are
+	// settled outside of notebrew and marked paid by an admin with `notebrew
+	// billing markpaid`. The manual provider only supports subscription
+	// plans for a single user, without add-ons, gifts or coupons.
+	Provider       string `json:"provider"`
 	PublishableKey string `json:"publishableKey"`
 	SecretKey      string `json:"secretKey"`
 	WebhookSecret  string `json:"webhookSecret"`
-	Plans          []Plan `json:"plans"`
+	// WebhookSecrets are tried in order after WebhookSecret when verifying
+	// webhook events. Listing both the old and new secret while rolling the
+	// endpoint's secret avoids rejecting events in the meantime.
+	WebhookSecrets []WebhookSecret `json:"webhookSecrets"`
+	Plans          []Plan          `json:"plans"`
+	// PlansFromStripe populates Plans from the Stripe products whose
+	// metadata describes a notebrew plan (see plansFromProducts) instead of
+	// from stripe.json, in which case stripe.json must not list any plans.
+	PlansFromStripe bool          `json:"plansFromStripe"`
+	AddOns          []AddOn       `json:"addOns"`
+	Gifts           []Gift        `json:"gifts"`
+	Dunning         DunningConfig `json:"dunning"`
+	// AllowPromotionCodes lets users enter Stripe promotion codes on the
+	// checkout page. It has no effect if a coupon is pre-applied.
+	AllowPromotionCodes bool     `json:"allowPromotionCodes"`
+	Coupons             []Coupon `json:"coupons"`
+	// TrialReminderDays is how many days before a free trial ends the user
+	// is reminded by email that they will be charged. Defaults to 3.
+	TrialReminderDays int `json:"trialReminderDays"`
+	// RetentionOffer, if it has a CouponID, is offered once per customer on
+	// the cancellation page.
+	RetentionOffer RetentionOffer `json:"retentionOffer"`
+	// Test is the config for Stripe test mode, with its own keys, webhook
+	// secrets, plans and add-ons. Webhook events with livemode=false are
+	// verified and processed using it, and API calls about test mode
+	// customers are made with its secret key, so that the test mode and live
+	// mode webhook endpoints can point at the same deployment.
+	Test *StripeConfig `json:"test"`
+}
+
+// ForLivemode returns the config for live mode or test mode. If there is no
+// test mode config, the config is returned as is.
+func (stripeConfig StripeConfig) ForLivemode(livemode bool) StripeConfig {
+	if !livemode && stripeConfig.Test != nil {
+		return *stripeConfig.Test
+	}
+	return stripeConfig
+}
+
+// Client returns a Stripe API client that authenticates with the config's
+// secret key. Objects from test mode must be acted on with a client from the
+// test mode config (see ForLivemode), since the live mode key cannot see
+// them and vice versa.
+func (stripeConfig StripeConfig) Client() *client.API {
+	return client.New(stripeConfig.SecretKey, nil)
+}
+
+// Livemode reports whether the config is for Stripe live mode, going by the
+// prefix of its secret key. ok is false if there is no secret key or it has
+// an unrecognized prefix.
+func (stripeConfig StripeConfig) Livemode() (livemode, ok bool) {
+	switch {
+	case strings.HasPrefix(stripeConfig.SecretKey, "sk_live_"), strings.HasPrefix(stripeConfig.SecretKey, "rk_live_"):
+		return true, true
+	case strings.HasPrefix(stripeConfig.SecretKey, "sk_test_"), strings.HasPrefix(stripeConfig.SecretKey, "rk_test_"):
+		return false, true
+	}
+	return false, false
+}
+
+// FreePlan returns the plan without any prices, or the default free plan if
+// there is none.
+func (stripeConfig StripeConfig) FreePlan() Plan {
+	for _, plan := range stripeConfig.Plans {
+		if plan.IsFree() {
+			return plan
+		}
+	}
+	return Plan{
+		SiteLimit:    1,
+		StorageLimit: 10_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  true,
+			"NoCustomDomain": true,
+		},
+	}
+}
+
+// Intervals returns the billing intervals that subscription plans are offered
+// in.
+func (stripeConfig StripeConfig) Intervals() []string {
+	var intervals []string
+	for _, plan := range stripeConfig.Plans {
+		if plan.Archived || plan.OneTime {
+			continue
+		}
+		for _, price := range plan.AllPrices() {
+			if !slices.Contains(intervals, price.Interval) {
+				intervals = append(intervals, price.Interval)
+			}
+		}
+	}
+	return intervals
+}
+
+type DunningConfig struct {
+	// GracePeriodDays is how long a user keeps their plan after a failed
+	// payment before the Action is taken. Defaults to 14.
+	GracePeriodDays int `json:"gracePeriodDays"`
+	// ReminderIntervalDays is how often the user is reminded by email to
+	// update their payment details during the grace period. Defaults to 3.
+	ReminderIntervalDays int `json:"reminderIntervalDays"`
+	// Action is what happens when the grace period is over: "downgrade"
+	// moves the user to the free plan, "disable" disables the account.
+	// Defaults to "downgrade".
+	Action string `json:"action"`
 }
 
 var (
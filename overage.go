@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/notebrew/stacktrace"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// Overage is the storage overage of a subscription in its current billing
+// period.
+type Overage struct {
+	SubscriptionID   string    `json:"subscriptionID"`
+	PlanName         string    `json:"planName"`
+	StorageAllowance int64     `json:"storageAllowance"`
+	Units            int64     `json:"units"`
+	UnitSize         int64     `json:"unitSize"`
+	Amount           int64     `json:"amount"`
+	Currency         string    `json:"currency"`
+	CurrentPeriodEnd time.Time `json:"currentPeriodEnd"`
+}
+
+// overagePlan returns the plan of a subscription that allows storage overage,
+// along with the storage allowance of the subscription (the plan's
+// StorageLimit plus any storage add-ons on the same subscription).
+func overagePlan(stripeConfig StripeConfig, subscription Subscription) (plan Plan, storageAllowance int64, ok bool) {
+	for _, item := range subscription.Items {
+		if addOn, isAddOn := stripeConfig.AddOnByPriceID(item.PriceID); isAddOn {
+			storageAllowance += addOn.StorageLimit * item.Quantity
+			continue
+		}
+		if ok {
+			continue
+		}
+		p, isPlan := stripeConfig.PlanByPriceID(item.PriceID)
+		if !isPlan || p.OveragePriceID == "" {
+			continue
+		}
+		plan, ok = p, true
+	}
+	if !ok {
+		return Plan{}, 0, false
+	}
+	return plan, plan.StorageLimit + storageAllowance, true
+}
+
+// overageUnits returns the number of overage units that storageUsed is over
+// the storage allowance, rounded up.
+func overageUnits(plan Plan, storageAllowance, storageUsed int64) int64 {
+	if storageUsed <= storageAllowance {
+		return 0
+	}
+	unitSize := plan.OverageUnitSize
+	if unitSize <= 0 {
+		unitSize = 1_000_000_000
+	}
+	return (storageUsed - storageAllowance + unitSize - 1) / unitSize
+}
+
+// userStorageUsed returns the total storage used by the sites a user owns.
+func userStorageUsed(ctx context.Context, nbrew *notebrew.Notebrew, userID notebrew.ID) (int64, error) {
+	return sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM site" +
+			" JOIN site_owner ON site_owner.site_id = site.site_id" +
+			" WHERE site_owner.user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) int64 {
+		return row.Int64("coalesce(sum(site.storage_used), 0)")
+	})
+}
+
+// runOverageBilling reports the storage overage of every subscription on a
+// plan that allows overage to Stripe as usage of the plan's metered overage
+// price.
+//
+// Usage is reported with the "set" action at the current time, so the
+// metered price must aggregate usage using the maximum value during the
+// period (aggregate_usage=max). The customer is then billed for their peak
+// overage in each billing period, and reporting the same overage again is
+// harmless.
+func runOverageBilling(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	type Row struct {
+		Subscription Subscription
+		UserID       notebrew.ID
+	}
+	rows, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM subscription" +
+			" JOIN customer ON customer.customer_id = subscription.customer_id",
+	}, func(row *sq.Row) Row {
+		subscription := Subscription{
+			SubscriptionID:   row.String("subscription.subscription_id"),
+			CustomerID:       row.String("subscription.customer_id"),
+			Status:           row.String("subscription.status"),
+			CurrentPeriodEnd: time.Unix(row.Int64("subscription.current_period_end"), 0).UTC(),
+		}
+		b := row.Bytes(nil, "subscription.items")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &subscription.Items)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return Row{
+			Subscription: subscription,
+			UserID:       row.UUID("customer.user_id"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if !entitled(row.Subscription.Status, false) {
+			continue
+		}
+		err := reportOverage(ctx, nbrew, stripeConfig, row.Subscription, row.UserID)
+		if err != nil {
+			nbrew.Logger.Error(err.Error(), slog.String("subscriptionID", row.Subscription.SubscriptionID))
+		}
+	}
+	return nil
+}
+
+// reportOverage reports the storage overage of a single subscription.
+func reportOverage(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, subscription Subscription, userID notebrew.ID) error {
+	plan, storageAllowance, ok := overagePlan(stripeConfig, subscription)
+	if !ok {
+		return nil
+	}
+	storageUsed, err := userStorageUsed(ctx, nbrew, userID)
+	if err != nil {
+		return err
+	}
+	units := overageUnits(plan, storageAllowance, storageUsed)
+	currentPeriodEnd := subscription.CurrentPeriodEnd.Unix()
+	peakUnits, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM storage_overage WHERE subscription_id = {subscriptionID} AND current_period_end = {currentPeriodEnd}",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscription.SubscriptionID),
+			sq.Int64Param("currentPeriodEnd", currentPeriodEnd),
+		},
+	}, func(row *sq.Row) int64 {
+		return row.Int64("overage_units")
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if units == 0 || units <= peakUnits {
+		return nil
+	}
+	// Subscriptions created before the plan allowed overage won't have the
+	// metered price on them yet.
+	stripeClient, err := customerClient(ctx, nbrew, stripeConfig, subscription.CustomerID)
+	if err != nil {
+		return err
+	}
+	var itemID, overagePriceID string
+	for _, item := range subscription.Items {
+		if plan.IsOveragePrice(item.PriceID) {
+			itemID = item.ItemID
+			break
+		}
+		if planPrice, ok := plan.PriceByID(item.PriceID); ok {
+			overagePriceID = plan.OveragePriceFor(planPrice.Interval)
+		}
+	}
+	if itemID == "" {
+		if overagePriceID == "" {
+			return fmt.Errorf("subscription %s: plan %q has no overage price for the subscription's interval", subscription.SubscriptionID, plan.Name)
+		}
+		subscriptionItem, err := stripeClient.SubscriptionItems.New(&stripe.SubscriptionItemParams{
+			Subscription: stripe.String(subscription.SubscriptionID),
+			Price:        stripe.String(overagePriceID),
+		})
+		if err != nil {
+			return err
+		}
+		itemID = subscriptionItem.ID
+	}
+	reportTime := time.Now().Unix()
+	_, err = stripeClient.UsageRecords.New(&stripe.UsageRecordParams{
+		SubscriptionItem: stripe.String(itemID),
+		Action:           stripe.String("set"),
+		Quantity:         stripe.Int64(units),
+		Timestamp:        stripe.Int64(reportTime),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO storage_overage (subscription_id, current_period_end, overage_units, report_time)" +
+			" VALUES ({subscriptionID}, {currentPeriodEnd}, {overageUnits}, {reportTime})",
+		Values: []any{
+			sq.StringParam("subscriptionID", subscription.SubscriptionID),
+			sq.Int64Param("currentPeriodEnd", currentPeriodEnd),
+			sq.Int64Param("overageUnits", units),
+			sq.Int64Param("reportTime", reportTime),
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isKeyViolation(nbrew, err) {
+		return err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE storage_overage" +
+			" SET current_period_end = {currentPeriodEnd}, overage_units = {overageUnits}, report_time = {reportTime}" +
+			" WHERE subscription_id = {subscriptionID}",
+		Values: []any{
+			sq.Int64Param("currentPeriodEnd", currentPeriodEnd),
+			sq.Int64Param("overageUnits", units),
+			sq.Int64Param("reportTime", reportTime),
+			sq.StringParam("subscriptionID", subscription.SubscriptionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// projectedOverages returns the projected storage overage charges of a
+// customer for the current billing period: the peak overage reported so far
+// or the overage right now, whichever is higher.
+func projectedOverages(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string, storageUsed int64) ([]Overage, error) {
+	subscriptions, err := getSubscriptions(ctx, nbrew, customerID)
+	if err != nil {
+		return nil, err
+	}
+	var overages []Overage
+	for _, subscription := range subscriptions {
+		if !entitled(subscription.Status, false) {
+			continue
+		}
+		plan, storageAllowance, ok := overagePlan(stripeConfig, subscription)
+		if !ok {
+			continue
+		}
+		peakUnits, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM storage_overage WHERE subscription_id = {subscriptionID} AND current_period_end = {currentPeriodEnd}",
+			Values: []any{
+				sq.StringParam("subscriptionID", subscription.SubscriptionID),
+				sq.Int64Param("currentPeriodEnd", subscription.CurrentPeriodEnd.Unix()),
+			},
+		}, func(row *sq.Row) int64 {
+			return row.Int64("overage_units")
+		})
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		units := max(peakUnits, overageUnits(plan, storageAllowance, storageUsed))
+		overage := Overage{
+			SubscriptionID:   subscription.SubscriptionID,
+			PlanName:         plan.Name,
+			StorageAllowance: storageAllowance,
+			Units:            units,
+			UnitSize:         plan.OverageUnitSize,
+			Amount:           units * plan.OverageUnitAmount,
+			Currency:         plan.OverageCurrency,
+			CurrentPeriodEnd: subscription.CurrentPeriodEnd,
+		}
+		if overage.UnitSize <= 0 {
+			overage.UnitSize = 1_000_000_000
+		}
+		if overage.Currency == "" {
+			overage.Currency = "usd"
+		}
+		overages = append(overages, overage)
+	}
+	return overages, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/client"
+)
+
+// Product metadata keys that describe a notebrew plan when
+// StripeConfig.PlansFromStripe is enabled.
+//
+//   - notebrew_plan: must be "true" for the product to be treated as a plan.
+//   - notebrew_site_limit: the plan's SiteLimit (-1 for unlimited).
+//   - notebrew_storage_limit: the plan's StorageLimit in bytes (-1 for
+//     unlimited).
+//   - notebrew_user_flags: the plan's UserFlags as a JSON object, e.g.
+//     {"NoUploadImage":true,"NoCustomDomain":true}. Optional.
+//   - notebrew_trial_days: the plan's TrialDays. Optional.
+//   - notebrew_overage_unit_size: the plan's OverageUnitSize. Optional.
+const (
+	metadataPlan            = "notebrew_plan"
+	metadataSiteLimit       = "notebrew_site_limit"
+	metadataStorageLimit    = "notebrew_storage_limit"
+	metadataUserFlags       = "notebrew_user_flags"
+	metadataTrialDays       = "notebrew_trial_days"
+	metadataOverageUnitSize = "notebrew_overage_unit_size"
+)
+
+// fetchStripePlans fetches every product (active or not) and price from
+// Stripe using stripeClient and converts the products marked as notebrew
+// plans into Plans.
+func fetchStripePlans(stripeClient *client.API) ([]Plan, error) {
+	var products []*stripe.Product
+	productIter := stripeClient.Products.List(&stripe.ProductListParams{})
+	for productIter.Next() {
+		products = append(products, productIter.Product())
+	}
+	err := productIter.Err()
+	if err != nil {
+		return nil, err
+	}
+	var prices []*stripe.Price
+	priceIter := stripeClient.Prices.List(&stripe.PriceListParams{})
+	for priceIter.Next() {
+		prices = append(prices, priceIter.Price())
+	}
+	err = priceIter.Err()
+	if err != nil {
+		return nil, err
+	}
+	return plansFromProducts(products, prices)
+}
+
+// plansFromProducts converts the products whose metadata marks them as
+// notebrew plans into Plans, returning an error if any of their metadata or
+// prices can't be represented as a plan.
+//
+// The active licensed prices of an active product become the plan's monthly
+// and yearly prices, and its active metered prices (if any) become the
+// overage prices of the same intervals. An active product without any prices
+// at all is the free plan.
+// Inactive products and inactive prices can no longer be subscribed to but
+// existing subscribers keep their entitlements, so each of them becomes an
+// archived plan. An active product whose prices are all inactive is retired
+// and only appears as those archived plans.
+func plansFromProducts(products []*stripe.Product, prices []*stripe.Price) ([]Plan, error) {
+	type sortablePlan struct {
+		plan   Plan
+		amount int64
+	}
+	pricesByProduct := make(map[string][]*stripe.Price)
+	for _, price := range prices {
+		if price.Product == nil {
+			continue
+		}
+		pricesByProduct[price.Product.ID] = append(pricesByProduct[price.Product.ID], price)
+	}
+	var plans, archivedPlans []sortablePlan
+	hasFreePlan := false
+	for _, product := range products {
+		if product.Metadata[metadataPlan] != "true" {
+			continue
+		}
+		basePlan, err := planFromMetadata(product)
+		if err != nil {
+			return nil, fmt.Errorf("product %s (%s): %w", product.ID, product.Name, err)
+		}
+		plan := basePlan
+		plan.Archived = !product.Active
+		var amount int64
+		hasPrices := false
+		overagePriceIDs := make(map[string]string)
+		for _, price := range pricesByProduct[product.ID] {
+			if price.Recurring == nil {
+				return nil, fmt.Errorf("product %s (%s): price %s: one-time prices are not supported", product.ID, product.Name, price.ID)
+			}
+			if price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+				if !price.Active || !product.Active {
+					continue
+				}
+				interval := string(price.Recurring.Interval)
+				if overagePriceIDs[interval] != "" {
+					return nil, fmt.Errorf("product %s (%s): more than one active %sly metered price (%s, %s)", product.ID, product.Name, interval, overagePriceIDs[interval], price.ID)
+				}
+				overagePriceIDs[interval] = price.ID
+				if interval == "month" {
+					plan.OveragePriceID = price.ID
+					plan.OverageUnitAmount = price.UnitAmount
+					plan.OverageCurrency = string(price.Currency)
+				}
+				continue
+			}
+			hasPrices = true
+			interval := string(price.Recurring.Interval)
+			if (interval != "month" && interval != "year") || price.Recurring.IntervalCount != 1 {
+				return nil, fmt.Errorf("product %s (%s): price %s: unsupported billing interval (every %d %s)", product.ID, product.Name, price.ID, price.Recurring.IntervalCount, interval)
+			}
+			planPrice := PlanPrice{
+				Interval: interval,
+				Price:    price.Nickname,
+				PriceID:  price.ID,
+			}
+			if planPrice.Price == "" {
+				planPrice.Price = fmt.Sprintf("%d.%02d %s/%s", price.UnitAmount/100, price.UnitAmount%100, strings.ToUpper(string(price.Currency)), interval)
+			}
+			if !price.Active || !product.Active {
+				archivedPlan := basePlan
+				archivedPlan.Archived = true
+				if interval == "month" {
+					archivedPlan.Price, archivedPlan.PriceID = planPrice.Price, planPrice.PriceID
+				} else {
+					archivedPlan.Prices = []PlanPrice{planPrice}
+				}
+				archivedPlans = append(archivedPlans, sortablePlan{plan: archivedPlan, amount: price.UnitAmount})
+				continue
+			}
+			if plan.PriceFor(interval).PriceID != "" {
+				return nil, fmt.Errorf("product %s (%s): more than one active %sly price (%s, %s)", product.ID, product.Name, interval, plan.PriceFor(interval).PriceID, price.ID)
+			}
+			if interval == "month" {
+				plan.Price, plan.PriceID = planPrice.Price, planPrice.PriceID
+				amount = price.UnitAmount
+			} else {
+				plan.Prices = append(plan.Prices, planPrice)
+				if amount == 0 {
+					amount = price.UnitAmount / 12
+				}
+			}
+		}
+		for interval, overagePriceID := range overagePriceIDs {
+			if plan.OveragePriceID == "" {
+				return nil, fmt.Errorf("product %s (%s): a %sly metered price (%s) requires a monthly metered price", product.ID, product.Name, interval, overagePriceID)
+			}
+			for i := range plan.Prices {
+				if plan.Prices[i].Interval == interval {
+					plan.Prices[i].OveragePriceID = overagePriceID
+				}
+			}
+		}
+		if !product.Active {
+			continue
+		}
+		if plan.IsFree() && hasPrices {
+			continue
+		}
+		if plan.IsFree() {
+			if plan.OveragePriceID != "" {
+				return nil, fmt.Errorf("product %s (%s): a metered price requires a licensed price", product.ID, product.Name)
+			}
+			if hasFreePlan {
+				return nil, fmt.Errorf("product %s (%s): more than one product without prices (there can only be one free plan)", product.ID, product.Name)
+			}
+			hasFreePlan = true
+		}
+		plans = append(plans, sortablePlan{plan: plan, amount: amount})
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("no active products have the metadata %s=true", metadataPlan)
+	}
+	// Plans are listed from cheapest to most expensive.
+	slices.SortStableFunc(plans, func(a, b sortablePlan) int {
+		return cmp.Compare(a.amount, b.amount)
+	})
+	slices.SortStableFunc(archivedPlans, func(a, b sortablePlan) int {
+		return cmp.Compare(a.amount, b.amount)
+	})
+	result := make([]Plan, 0, len(plans)+len(archivedPlans))
+	for _, plan := range plans {
+		result = append(result, plan.plan)
+	}
+	for _, plan := range archivedPlans {
+		result = append(result, plan.plan)
+	}
+	return result, nil
+}
+
+// planFromMetadata returns the plan described by a product's metadata,
+// without any prices.
+func planFromMetadata(product *stripe.Product) (Plan, error) {
+	plan := Plan{
+		Name: product.Name,
+	}
+	if plan.Name == "" {
+		return Plan{}, fmt.Errorf("product has no name")
+	}
+	var err error
+	for _, field := range []struct {
+		key      string
+		value    *int64
+		required bool
+		min      int64
+	}{
+		{key: metadataSiteLimit, value: &plan.SiteLimit, required: true, min: -1},
+		{key: metadataStorageLimit, value: &plan.StorageLimit, required: true, min: -1},
+		{key: metadataTrialDays, value: &plan.TrialDays, min: 0},
+		{key: metadataOverageUnitSize, value: &plan.OverageUnitSize, min: 0},
+	} {
+		s, ok := product.Metadata[field.key]
+		if !ok {
+			if field.required {
+				return Plan{}, fmt.Errorf("metadata %s is missing", field.key)
+			}
+			continue
+		}
+		*field.value, err = strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return Plan{}, fmt.Errorf("metadata %s: %q is not an integer", field.key, s)
+		}
+		if *field.value < field.min {
+			return Plan{}, fmt.Errorf("metadata %s: %d is less than %d", field.key, *field.value, field.min)
+		}
+	}
+	if s := product.Metadata[metadataUserFlags]; s != "" {
+		decoder := json.NewDecoder(strings.NewReader(s))
+		err := decoder.Decode(&plan.UserFlags)
+		if err != nil {
+			return Plan{}, fmt.Errorf("metadata %s: %q is not a JSON object of booleans: %w", metadataUserFlags, s, err)
+		}
+	}
+	return plan, nil
+}
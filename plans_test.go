@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v79"
+)
+
+func TestPlansFromProducts(t *testing.T) {
+	recurring := func(interval string) *stripe.PriceRecurring {
+		return &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringInterval(interval),
+			IntervalCount: 1,
+			UsageType:     stripe.PriceRecurringUsageTypeLicensed,
+		}
+	}
+	products := []*stripe.Product{{
+		ID:     "prod_pro",
+		Name:   "Pro",
+		Active: true,
+		Metadata: map[string]string{
+			"notebrew_plan":          "true",
+			"notebrew_site_limit":    "10",
+			"notebrew_storage_limit": "10000000000",
+			"notebrew_user_flags":    `{"NoUploadImage":false,"NoCustomDomain":false}`,
+			"notebrew_trial_days":    "14",
+		},
+	}, {
+		ID:     "prod_free",
+		Name:   "Free",
+		Active: true,
+		Metadata: map[string]string{
+			"notebrew_plan":          "true",
+			"notebrew_site_limit":    "1",
+			"notebrew_storage_limit": "10000000",
+			"notebrew_user_flags":    `{"NoUploadImage":true,"NoCustomDomain":true}`,
+		},
+	}, {
+		ID:     "prod_legacy",
+		Name:   "Legacy",
+		Active: false,
+		Metadata: map[string]string{
+			"notebrew_plan":          "true",
+			"notebrew_site_limit":    "20",
+			"notebrew_storage_limit": "20000000000",
+		},
+	}, {
+		ID:     "prod_starter",
+		Name:   "Starter",
+		Active: true,
+		Metadata: map[string]string{
+			"notebrew_plan":          "true",
+			"notebrew_site_limit":    "3",
+			"notebrew_storage_limit": "3000000000",
+		},
+	}, {
+		ID:     "prod_other",
+		Name:   "T-shirt",
+		Active: true,
+	}}
+	prices := []*stripe.Price{{
+		ID:         "price_pro_yearly",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 6000,
+		Recurring:  recurring("year"),
+		Product:    &stripe.Product{ID: "prod_pro"},
+	}, {
+		ID:         "price_pro",
+		Active:     true,
+		Nickname:   "$6/month",
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 600,
+		Recurring:  recurring("month"),
+		Product:    &stripe.Product{ID: "prod_pro"},
+	}, {
+		ID:         "price_pro_old",
+		Active:     false,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 400,
+		Recurring:  recurring("month"),
+		Product:    &stripe.Product{ID: "prod_pro"},
+	}, {
+		ID:         "price_legacy",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 500,
+		Recurring:  recurring("month"),
+		Product:    &stripe.Product{ID: "prod_legacy"},
+	}, {
+		ID:         "price_starter",
+		Active:     false,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 300,
+		Recurring:  recurring("month"),
+		Product:    &stripe.Product{ID: "prod_starter"},
+	}, {
+		ID:         "price_tshirt",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 2000,
+		Product:    &stripe.Product{ID: "prod_other"},
+	}}
+	plans, err := plansFromProducts(products, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proLimits := Plan{
+		Name:         "Pro",
+		SiteLimit:    10,
+		StorageLimit: 10_000_000_000,
+		UserFlags:    map[string]bool{"NoUploadImage": false, "NoCustomDomain": false},
+		TrialDays:    14,
+	}
+	expectedPlans := []Plan{{
+		Name:         "Free",
+		SiteLimit:    1,
+		StorageLimit: 10_000_000,
+		UserFlags:    map[string]bool{"NoUploadImage": true, "NoCustomDomain": true},
+	}, {
+		Name:         "Pro",
+		SiteLimit:    10,
+		StorageLimit: 10_000_000_000,
+		UserFlags:    map[string]bool{"NoUploadImage": false, "NoCustomDomain": false},
+		Price:        "$6/month",
+		PriceID:      "price_pro",
+		Prices:       []PlanPrice{{Interval: "year", Price: "60.00 USD/year", PriceID: "price_pro_yearly"}},
+		TrialDays:    14,
+	}, {
+		// An active product whose prices are all inactive is not the free
+		// plan.
+		Archived:     true,
+		Name:         "Starter",
+		SiteLimit:    3,
+		StorageLimit: 3_000_000_000,
+		Price:        "3.00 USD/month",
+		PriceID:      "price_starter",
+	}, func() Plan {
+		plan := proLimits
+		plan.Archived = true
+		plan.Price = "4.00 USD/month"
+		plan.PriceID = "price_pro_old"
+		return plan
+	}(), {
+		Archived:     true,
+		Name:         "Legacy",
+		SiteLimit:    20,
+		StorageLimit: 20_000_000_000,
+		Price:        "5.00 USD/month",
+		PriceID:      "price_legacy",
+	}}
+	if !reflect.DeepEqual(plans, expectedPlans) {
+		t.Errorf("expected plans:\n%+v\ngot:\n%+v", expectedPlans, plans)
+	}
+
+	type TestTable struct {
+		description string
+		metadata    map[string]string
+		price       *stripe.Price
+		err         string
+	}
+	tests := []TestTable{{
+		description: "missing site limit",
+		metadata:    map[string]string{"notebrew_plan": "true", "notebrew_storage_limit": "1"},
+		err:         "metadata notebrew_site_limit is missing",
+	}, {
+		description: "invalid storage limit",
+		metadata:    map[string]string{"notebrew_plan": "true", "notebrew_site_limit": "1", "notebrew_storage_limit": "10GB"},
+		err:         `metadata notebrew_storage_limit: "10GB" is not an integer`,
+	}, {
+		description: "invalid user flags",
+		metadata:    map[string]string{"notebrew_plan": "true", "notebrew_site_limit": "1", "notebrew_storage_limit": "1", "notebrew_user_flags": "NoUploadImage"},
+		err:         "metadata notebrew_user_flags",
+	}, {
+		description: "one-time price",
+		metadata:    map[string]string{"notebrew_plan": "true", "notebrew_site_limit": "1", "notebrew_storage_limit": "1"},
+		price:       &stripe.Price{ID: "price_x", Active: true, Product: &stripe.Product{ID: "prod_x"}},
+		err:         "one-time prices are not supported",
+	}, {
+		description: "weekly price",
+		metadata:    map[string]string{"notebrew_plan": "true", "notebrew_site_limit": "1", "notebrew_storage_limit": "1"},
+		price:       &stripe.Price{ID: "price_x", Active: true, Recurring: recurring("week"), Product: &stripe.Product{ID: "prod_x"}},
+		err:         "unsupported billing interval",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			products := []*stripe.Product{{ID: "prod_x", Name: "X", Active: true, Metadata: tt.metadata}}
+			var prices []*stripe.Price
+			if tt.price != nil {
+				prices = append(prices, tt.price)
+			}
+			_, err := plansFromProducts(products, prices)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
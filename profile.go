@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,7 +20,6 @@ import (
 	"github.com/bokwoon95/notebrew/sq"
 	"github.com/bokwoon95/notebrew/stacktrace"
 	"github.com/stripe/stripe-go/v79"
-	"github.com/stripe/stripe-go/v79/subscription"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/sync/errgroup"
 )
@@ -26,6 +29,7 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 		SiteID      notebrew.ID `json:"siteID"`
 		SiteName    string      `json:"siteName"`
 		StorageUsed int64       `json:"storageUsed"`
+		Locked      bool        `json:"locked"`
 	}
 	type Session struct {
 		sessionTokenHash   []byte    `json:"-"`
@@ -34,22 +38,65 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 		Label              string    `json:"label"`
 		Current            bool      `json:"current"`
 	}
+	type Dunning struct {
+		Status          string    `json:"status"`
+		StartTime       time.Time `json:"startTime"`
+		GracePeriodEnd  time.Time `json:"gracePeriodEnd"`
+		GracePeriodOver bool      `json:"gracePeriodOver"`
+	}
+	type Trial struct {
+		PlanName      string    `json:"planName"`
+		TrialEnd      time.Time `json:"trialEnd"`
+		DaysRemaining int       `json:"daysRemaining"`
+	}
+	type CurrentPlan struct {
+		Plan     Plan        `json:"plan"`
+		Price    PlanPrice   `json:"price"`
+		Switches []PlanPrice `json:"switches"`
+		CancelAt time.Time   `json:"cancelAt"`
+	}
+	type OneTimePlan struct {
+		Plan       Plan      `json:"plan"`
+		ExpiryTime time.Time `json:"expiryTime"`
+	}
+	type Team struct {
+		OwnerEmail string `json:"ownerEmail"`
+		PlanName   string `json:"planName"`
+		Seated     bool   `json:"seated"`
+	}
 	type Response struct {
-		UserID                notebrew.ID     `json:"userID"`
-		Username              string          `json:"username"`
-		Email                 string          `json:"email"`
-		TimezoneOffsetSeconds int             `json:"timezoneOffsetSeconds"`
-		DisableReason         string          `json:"disableReason"`
-		SiteLimit             int64           `json:"siteLimit"`
-		StorageLimit          int64           `json:"storageLimit"`
-		UserFlags             map[string]bool `json:"userFlags"`
-		StorageUsed           int64           `json:"storageUsed"`
-		Sites                 []Site          `json:"sites"`
-		Sessions              []Session       `json:"sessions"`
-		Plans                 []Plan          `json:"plans"`
-		CustomerID            string          `json:"customerID"`
-		HasSubscription       bool            `json:"hasSubscription"`
-		PostRedirectGet       map[string]any  `json:"postRedirectGet"`
+		UserID                notebrew.ID      `json:"userID"`
+		Username              string           `json:"username"`
+		Email                 string           `json:"email"`
+		TimezoneOffsetSeconds int              `json:"timezoneOffsetSeconds"`
+		DisableReason         string           `json:"disableReason"`
+		SiteLimit             int64            `json:"siteLimit"`
+		StorageLimit          int64            `json:"storageLimit"`
+		UserFlags             map[string]bool  `json:"userFlags"`
+		StorageUsed           int64            `json:"storageUsed"`
+		SiteLimitExceeded     bool             `json:"siteLimitExceeded"`
+		StorageLimitExceeded  bool             `json:"storageLimitExceeded"`
+		Sites                 []Site           `json:"sites"`
+		Sessions              []Session        `json:"sessions"`
+		Plans                 []Plan           `json:"plans"`
+		Interval              string           `json:"interval"`
+		Intervals             []string         `json:"intervals"`
+		CurrentPlan           *CurrentPlan     `json:"currentPlan"`
+		OneTimePlans          []OneTimePlan    `json:"oneTimePlans"`
+		GiftPlans             []OneTimePlan    `json:"giftPlans"`
+		Gifts                 []Gift           `json:"gifts"`
+		Team                  *Team            `json:"team"`
+		AddOns                []AddOn          `json:"addOns"`
+		AddOnQuantities       map[string]int64 `json:"addOnQuantities"`
+		CustomerID            string           `json:"customerID"`
+		HasSubscription       bool             `json:"hasSubscription"`
+		ManualBilling         bool             `json:"manualBilling"`
+		Dunning               *Dunning         `json:"dunning"`
+		Overages              []Overage        `json:"overages"`
+		Invoices              []Invoice        `json:"invoices"`
+		Trial                 *Trial           `json:"trial"`
+		Coupon                *Coupon          `json:"coupon"`
+		PostRedirectGet       map[string]any   `json:"postRedirectGet"`
 	}
 	if r.Method != "GET" && r.Method != "HEAD" {
 		nbrew.MethodNotAllowed(w, r)
@@ -83,6 +130,9 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 			"referer":               func() string { return referer },
 			"safeHTML":              func(s string) template.HTML { return template.HTML(s) },
 			"float64ToInt64":        func(n float64) int64 { return int64(n) },
+			"formatAmount": func(amount int64, currency string) string {
+				return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, strings.ToUpper(currency))
+			},
 			"formatTime": func(t time.Time, layout string, offset int) string {
 				return t.In(time.FixedZone("", offset)).Format(layout)
 			},
@@ -139,6 +189,24 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 	response.StorageLimit = user.StorageLimit
 	response.UserFlags = user.UserFlags
 	response.Plans = stripeConfig.Plans
+	response.ManualBilling = stripeConfig.Provider == "manual"
+	response.Intervals = stripeConfig.Intervals()
+	response.Interval = "month"
+	if len(response.Intervals) > 0 {
+		response.Interval = response.Intervals[0]
+	}
+	if interval := r.Form.Get("interval"); slices.Contains(response.Intervals, interval) {
+		response.Interval = interval
+	}
+	response.AddOns = stripeConfig.AddOns
+	for _, gift := range stripeConfig.Gifts {
+		if _, plan, ok := stripeConfig.GiftByPriceID(gift.PriceID); ok && !plan.Archived {
+			response.Gifts = append(response.Gifts, gift)
+		}
+	}
+	if coupon, ok := getCoupon(r, stripeConfig); ok {
+		response.Coupon = &coupon
+	}
 	group, groupctx := errgroup.WithContext(r.Context())
 	group.Go(func() (err error) {
 		defer stacktrace.RecoverPanic(&err)
@@ -147,6 +215,7 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 			Format: "SELECT {*}" +
 				" FROM site" +
 				" JOIN site_owner ON site_owner.site_id = site.site_id" +
+				" LEFT JOIN site_lock ON site_lock.site_name = site.site_name AND site_lock.user_id = site_owner.user_id" +
 				" WHERE site_owner.user_id = {userID}",
 			Values: []any{
 				sq.UUIDParam("userID", user.UserID),
@@ -156,6 +225,7 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 				SiteID:      row.UUID("site.site_id"),
 				SiteName:    row.String("site.site_name"),
 				StorageUsed: row.Int64("site.storage_used"),
+				Locked:      row.Int64("coalesce(site_lock.lock_time, 0)") > 0,
 			}
 		})
 		if err != nil {
@@ -165,6 +235,8 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 		for _, site := range response.Sites {
 			response.StorageUsed += site.StorageUsed
 		}
+		response.SiteLimitExceeded = user.SiteLimit > 0 && int64(len(response.Sites)) > user.SiteLimit
+		response.StorageLimitExceeded = user.StorageLimit > 0 && response.StorageUsed > user.StorageLimit
 		return nil
 	})
 	group.Go(func() (err error) {
@@ -220,20 +292,198 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 		response.Sessions = sessions
 		return nil
 	})
-	if user.CustomerID != "" && stripe.Key != "" {
+	if user.CustomerID != "" {
+		group.Go(func() (err error) {
+			defer stacktrace.RecoverPanic(&err)
+			dunning, err := sq.FetchOne(groupctx, nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM dunning WHERE customer_id = {customerID} ORDER BY start_time LIMIT 1",
+				Values: []any{
+					sq.StringParam("customerID", user.CustomerID),
+				},
+			}, func(row *sq.Row) Dunning {
+				return Dunning{
+					Status:    row.String("status"),
+					StartTime: time.Unix(row.Int64("start_time"), 0).UTC(),
+				}
+			})
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil
+				}
+				return err
+			}
+			gracePeriodDays := stripeConfig.Dunning.GracePeriodDays
+			if gracePeriodDays <= 0 {
+				gracePeriodDays = 14
+			}
+			dunning.GracePeriodEnd = dunning.StartTime.AddDate(0, 0, gracePeriodDays)
+			dunning.GracePeriodOver = time.Now().After(dunning.GracePeriodEnd)
+			response.Dunning = &dunning
+			return nil
+		})
+	}
+	if user.CustomerID != "" {
 		group.Go(func() (err error) {
 			defer stacktrace.RecoverPanic(&err)
-			iter := subscription.List(&stripe.SubscriptionListParams{
-				Customer: &user.CustomerID,
+			subscriptions, err := getSubscriptions(groupctx, nbrew, user.CustomerID)
+			if err != nil {
+				return err
+			}
+			response.AddOnQuantities = make(map[string]int64)
+			for _, subscription := range subscriptions {
+				if !entitled(subscription.Status, false) {
+					continue
+				}
+				for _, item := range subscription.Items {
+					if _, ok := stripeConfig.AddOnByPriceID(item.PriceID); ok {
+						response.AddOnQuantities[item.PriceID] += item.Quantity
+					}
+				}
+				if response.CurrentPlan == nil {
+					for _, item := range subscription.Items {
+						plan, ok := stripeConfig.PlanByPriceID(item.PriceID)
+						if !ok {
+							continue
+						}
+						currentPlan := CurrentPlan{Plan: plan, CancelAt: subscription.CancelAt}
+						currentPlan.Price, _ = plan.PriceByID(item.PriceID)
+						for _, price := range plan.AllPrices() {
+							if price.Interval != currentPlan.Price.Interval {
+								currentPlan.Switches = append(currentPlan.Switches, price)
+							}
+						}
+						response.CurrentPlan = &currentPlan
+						break
+					}
+				}
+				if subscription.Status == string(stripe.SubscriptionStatusTrialing) && response.Trial == nil {
+					trial := Trial{
+						TrialEnd: subscription.TrialEnd,
+					}
+					for _, item := range subscription.Items {
+						if plan, ok := stripeConfig.PlanByPriceID(item.PriceID); ok {
+							trial.PlanName = plan.Name
+							break
+						}
+					}
+					trial.DaysRemaining = int(math.Ceil(time.Until(trial.TrialEnd).Hours() / 24))
+					response.Trial = &trial
+				}
+			}
+			return nil
+		})
+	}
+	if user.CustomerID != "" {
+		group.Go(func() (err error) {
+			defer stacktrace.RecoverPanic(&err)
+			invoices, err := getInvoices(groupctx, nbrew, user.CustomerID, 24)
+			if err != nil {
+				return err
+			}
+			response.Invoices = invoices
+			return nil
+		})
+		group.Go(func() (err error) {
+			defer stacktrace.RecoverPanic(&err)
+			purchases, err := getPurchases(groupctx, nbrew, user.CustomerID)
+			if err != nil {
+				return err
+			}
+			// Purchases are sorted newest first, and the newest purchase of
+			// a fixed-term plan has the latest expiry time.
+			for _, purchase := range purchases {
+				if !purchase.active() {
+					continue
+				}
+				plan, ok := stripeConfig.PlanByPriceID(purchase.PriceID)
+				if !ok || slices.ContainsFunc(response.OneTimePlans, func(oneTimePlan OneTimePlan) bool {
+					return oneTimePlan.Plan.Name == plan.Name
+				}) {
+					continue
+				}
+				response.OneTimePlans = append(response.OneTimePlans, OneTimePlan{
+					Plan:       plan,
+					ExpiryTime: purchase.ExpiryTime,
+				})
+			}
+			return nil
+		})
+	}
+	group.Go(func() (err error) {
+		defer stacktrace.RecoverPanic(&err)
+		vouchers, err := getRedeemedVouchers(groupctx, nbrew, user.UserID)
+		if err != nil {
+			return err
+		}
+		// Redeeming a gift of a plan that is still active extends it, so the
+		// latest expiry time of each plan is when it runs out.
+		for _, voucher := range vouchers {
+			if !voucher.active() {
+				continue
+			}
+			_, plan, ok := stripeConfig.GiftByPriceID(voucher.PriceID)
+			if !ok {
+				continue
+			}
+			i := slices.IndexFunc(response.GiftPlans, func(giftPlan OneTimePlan) bool {
+				return giftPlan.Plan.Name == plan.Name
 			})
-			for iter.Next() {
-				response.HasSubscription = true
-				break
+			if i < 0 {
+				response.GiftPlans = append(response.GiftPlans, OneTimePlan{
+					Plan:       plan,
+					ExpiryTime: voucher.ExpiryTime,
+				})
+			} else if voucher.ExpiryTime.After(response.GiftPlans[i].ExpiryTime) {
+				response.GiftPlans[i].ExpiryTime = voucher.ExpiryTime
 			}
-			err = iter.Err()
+		}
+		return nil
+	})
+	group.Go(func() (err error) {
+		defer stacktrace.RecoverPanic(&err)
+		ownerEmail, err := sq.FetchOne(groupctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format: "SELECT {*}" +
+				" FROM team_member" +
+				" JOIN customer ON customer.customer_id = team_member.customer_id" +
+				" JOIN users ON users.user_id = customer.user_id" +
+				" WHERE team_member.email = {email}",
+			Values: []any{
+				sq.StringParam("email", user.Email),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("users.email")
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		team := Team{
+			OwnerEmail: ownerEmail,
+		}
+		teamSubscription, ok, err := getTeamSubscription(groupctx, nbrew, stripeConfig, user.UserID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			plan, _ := stripeConfig.PlanByPriceID(teamSubscription.Items[0].PriceID)
+			team.PlanName = plan.Name
+			team.Seated = true
+		}
+		response.Team = &team
+		return nil
+	})
+	if user.CustomerID != "" && (stripe.Key != "" || stripeConfig.Provider == "manual") {
+		group.Go(func() (err error) {
+			defer stacktrace.RecoverPanic(&err)
+			subscriptions, err := newBillingProvider(nbrew, stripeConfig).Subscriptions(groupctx, user.CustomerID)
 			if err != nil {
-				return stacktrace.New(err)
+				return err
 			}
+			response.HasSubscription = len(subscriptions) > 0
 			return nil
 		})
 	}
@@ -243,5 +493,13 @@ func profile(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, u
 		nbrew.InternalServerError(w, r, err)
 		return
 	}
+	if user.CustomerID != "" {
+		response.Overages, err = projectedOverages(r.Context(), nbrew, stripeConfig, user.CustomerID, response.StorageUsed)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+	}
 	writeResponse(w, r, response)
 }
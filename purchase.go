@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// Purchase is a one-time plan bought through a payment mode checkout.
+type Purchase struct {
+	CheckoutSessionID string `json:"checkoutSessionID"`
+	CustomerID        string `json:"customerID"`
+	PriceID           string `json:"priceID"`
+	PaymentIntentID   string `json:"paymentIntentID"`
+	// Status is "pending" until the payment succeeds, then "paid" until the
+	// plan expires, then "expired".
+	Status       string    `json:"status"`
+	PurchaseTime time.Time `json:"purchaseTime"`
+	// ExpiryTime is when the plan expires, or the zero time if it never
+	// does.
+	ExpiryTime time.Time `json:"expiryTime"`
+}
+
+// active reports whether the purchase grants its plan to the user.
+func (purchase Purchase) active() bool {
+	return purchase.Status == "paid" && (purchase.ExpiryTime.IsZero() || purchase.ExpiryTime.After(time.Now()))
+}
+
+// savePurchase records the one-time plan bought through a completed payment
+// mode checkout session. It is called from both the checkout success page and
+// the checkout.session.completed webhook, whichever comes first. The purchase
+// only grants its plan once the payment has succeeded, which for delayed
+// payment methods happens later on payment_intent.succeeded.
+func savePurchase(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, checkoutSession *stripe.CheckoutSession) error {
+	if checkoutSession.Mode != stripe.CheckoutSessionModePayment || checkoutSession.Customer == nil {
+		return nil
+	}
+	plan, ok := stripeConfig.PlanByPriceID(checkoutSession.Metadata["priceID"])
+	if !ok || !plan.OneTime {
+		// Not a checkout session created by stripeCheckout.
+		return nil
+	}
+	var paymentIntentID string
+	if checkoutSession.PaymentIntent != nil {
+		paymentIntentID = checkoutSession.PaymentIntent.ID
+	}
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO purchase (checkout_session_id, customer_id, price_id, payment_intent_id, status)" +
+			" VALUES ({checkoutSessionID}, {customerID}, {priceID}, {paymentIntentID}, 'pending')",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSession.ID),
+			sq.StringParam("customerID", checkoutSession.Customer.ID),
+			sq.StringParam("priceID", plan.PriceID),
+			sq.StringParam("paymentIntentID", paymentIntentID),
+		},
+	})
+	if err != nil && !isKeyViolation(nbrew, err) {
+		return err
+	}
+	if checkoutSession.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
+		return nil
+	}
+	return markPurchasePaid(ctx, nbrew, plan, checkoutSession.ID, checkoutSession.Customer.ID)
+}
+
+// completePaymentIntent marks the pending purchase paid for by a payment
+// intent as paid and syncs the entitlement of its customer. It does nothing if
+// the payment intent does not belong to a pending purchase.
+func completePaymentIntent(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, paymentIntentID string) error {
+	purchase, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM purchase WHERE payment_intent_id = {paymentIntentID} AND status = 'pending'",
+		Values: []any{
+			sq.StringParam("paymentIntentID", paymentIntentID),
+		},
+	}, func(row *sq.Row) Purchase {
+		return Purchase{
+			CheckoutSessionID: row.String("checkout_session_id"),
+			CustomerID:        row.String("customer_id"),
+			PriceID:           row.String("price_id"),
+		}
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	plan, ok := stripeConfig.PlanByPriceID(purchase.PriceID)
+	if !ok {
+		return fmt.Errorf("purchase %s: no plan with priceID %q", purchase.CheckoutSessionID, purchase.PriceID)
+	}
+	err = markPurchasePaid(ctx, nbrew, plan, purchase.CheckoutSessionID, purchase.CustomerID)
+	if err != nil {
+		return err
+	}
+	return syncCustomerEntitlement(ctx, nbrew, stripeConfig, purchase.CustomerID)
+}
+
+// markPurchasePaid starts the plan granted by a pending purchase. Buying a
+// fixed-term plan again before the previous purchase of it expires extends it
+// rather than overlapping it.
+func markPurchasePaid(ctx context.Context, nbrew *notebrew.Notebrew, plan Plan, checkoutSessionID, customerID string) error {
+	purchaseTime := time.Now().Unix()
+	var expiryTime sql.NullInt64
+	if plan.DurationDays > 0 {
+		latestExpiryTime, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM purchase WHERE customer_id = {customerID} AND price_id = {priceID} AND status = 'paid'",
+			Values: []any{
+				sq.StringParam("customerID", customerID),
+				sq.StringParam("priceID", plan.PriceID),
+			},
+		}, func(row *sq.Row) int64 {
+			return row.Int64("coalesce(max(expiry_time), 0)")
+		})
+		if err != nil {
+			return err
+		}
+		expiryTime = sql.NullInt64{
+			Int64: max(purchaseTime, latestExpiryTime) + plan.DurationDays*24*60*60,
+			Valid: true,
+		}
+	}
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE purchase SET status = 'paid', purchase_time = {purchaseTime}, expiry_time = {expiryTime}" +
+			" WHERE checkout_session_id = {checkoutSessionID} AND status = 'pending'",
+		Values: []any{
+			sq.Int64Param("purchaseTime", purchaseTime),
+			sq.Param("expiryTime", expiryTime),
+			sq.StringParam("checkoutSessionID", checkoutSessionID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// getPurchases returns the paid (possibly expired) purchases of a customer,
+// most recent first.
+func getPurchases(ctx context.Context, nbrew *notebrew.Notebrew, customerID string) ([]Purchase, error) {
+	return sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM purchase WHERE customer_id = {customerID} AND status = 'paid' ORDER BY purchase_time DESC",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) Purchase {
+		purchase := Purchase{
+			CheckoutSessionID: row.String("checkout_session_id"),
+			CustomerID:        row.String("customer_id"),
+			PriceID:           row.String("price_id"),
+			PaymentIntentID:   row.String("payment_intent_id"),
+			Status:            row.String("status"),
+			PurchaseTime:      time.Unix(row.Int64("coalesce(purchase_time, 0)"), 0).UTC(),
+		}
+		expiryTime := row.Int64("coalesce(expiry_time, 0)")
+		if expiryTime > 0 {
+			purchase.ExpiryTime = time.Unix(expiryTime, 0).UTC()
+		}
+		return purchase
+	})
+}
+
+// runPurchaseExpiry expires the fixed-term one-time plans whose duration is
+// over and syncs the entitlement of their users, reverting them to the free
+// plan unless they are entitled to another plan.
+func runPurchaseExpiry(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	type Expiry struct {
+		CheckoutSessionID string
+		UserID            notebrew.ID
+	}
+	expiries, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM purchase" +
+			" JOIN customer ON customer.customer_id = purchase.customer_id" +
+			" WHERE purchase.status = 'paid' AND purchase.expiry_time <= {now}",
+		Values: []any{
+			sq.Int64Param("now", time.Now().Unix()),
+		},
+	}, func(row *sq.Row) Expiry {
+		return Expiry{
+			CheckoutSessionID: row.String("purchase.checkout_session_id"),
+			UserID:            row.UUID("customer.user_id"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, expiry := range expiries {
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE purchase SET status = 'expired' WHERE checkout_session_id = {checkoutSessionID}",
+			Values: []any{
+				sq.StringParam("checkoutSessionID", expiry.CheckoutSessionID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = syncEntitlement(ctx, nbrew, stripeConfig, expiry.UserID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
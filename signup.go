@@ -36,21 +36,9 @@ func signup(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, st
 		Email                  string       `json:"email"`
 		Error                  string       `json:"error"`
 		FormErrors             url.Values   `json:"formErrors"`
+		Coupon                 *Coupon      `json:"coupon"`
 	}
-	freePlan := Plan{
-		SiteLimit:    1,
-		StorageLimit: 10_000_000,
-		UserFlags: map[string]bool{
-			"NoUploadImage":  true,
-			"NoCustomDomain": true,
-		},
-	}
-	for _, plan := range stripeConfig.Plans {
-		if plan.PriceID == "" {
-			freePlan = plan
-			break
-		}
-	}
+	freePlan := stripeConfig.FreePlan()
 
 	switch r.Method {
 	case "GET", "HEAD":
@@ -96,6 +84,9 @@ func signup(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, st
 		response.CaptchaWidgetScriptSrc = nbrew.CaptchaConfig.WidgetScriptSrc
 		response.CaptchaWidgetClass = nbrew.CaptchaConfig.WidgetClass
 		response.CaptchaSiteKey = nbrew.CaptchaConfig.SiteKey
+		if coupon, ok := getCoupon(r, stripeConfig); ok {
+			response.Coupon = &coupon
+		}
 		if response.Error != "" {
 			writeResponse(w, r, response)
 			return
@@ -287,45 +278,16 @@ func signup(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, st
 			writeResponse(w, r, response)
 			return
 		}
-		var inviteTokenBytes [8 + 16]byte
-		binary.BigEndian.PutUint64(inviteTokenBytes[:8], uint64(time.Now().Unix()))
-		_, err = rand.Read(inviteTokenBytes[8:])
-		if err != nil {
-			nbrew.GetLogger(r.Context()).Error(err.Error())
-			nbrew.InternalServerError(w, r, err)
-			return
-		}
-		checksum := blake2b.Sum256(inviteTokenBytes[8:])
-		var inviteTokenHash [8 + blake2b.Size256]byte
-		copy(inviteTokenHash[:8], inviteTokenBytes[:8])
-		copy(inviteTokenHash[8:], checksum[:])
-		userFlags, err := json.Marshal(freePlan.UserFlags)
-		if err != nil {
-			nbrew.GetLogger(r.Context()).Error(err.Error())
-			nbrew.InternalServerError(w, r, err)
-			return
-		}
-		_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
-			Dialect: nbrew.Dialect,
-			Format: "INSERT INTO invite (invite_token_hash, email, site_limit, storage_limit, user_flags)" +
-				" VALUES ({inviteTokenHash}, {email}, {siteLimit}, {storageLimit}, {userFlags})",
-			Values: []any{
-				sq.BytesParam("inviteTokenHash", inviteTokenHash[:]),
-				sq.StringParam("email", response.Email),
-				sq.Int64Param("siteLimit", freePlan.SiteLimit),
-				sq.Int64Param("storageLimit", freePlan.StorageLimit),
-				sq.BytesParam("userFlags", userFlags),
-			},
+		inviteLink, _, err := createInvite(r.Context(), nbrew, response.Email, Entitlement{
+			SiteLimit:    freePlan.SiteLimit,
+			StorageLimit: freePlan.StorageLimit,
+			UserFlags:    freePlan.UserFlags,
 		})
 		if err != nil {
 			nbrew.GetLogger(r.Context()).Error(err.Error())
 			nbrew.InternalServerError(w, r, err)
 			return
 		}
-		scheme := "https://"
-		if !nbrew.CMSDomainHTTPS {
-			scheme = "http://"
-		}
 		nbrew.Mailer.C <- notebrew.Mail{
 			MailFrom: nbrew.MailFrom,
 			RcptTo:   response.Email,
@@ -335,7 +297,7 @@ func signup(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, st
 			},
 			Body: strings.NewReader(fmt.Sprintf(
 				"<p>Your notebrew invite link: <a href='%[1]s'>%[1]s</a></p>",
-				scheme+nbrew.CMSDomain+"/users/invite/?token="+strings.TrimLeft(hex.EncodeToString(inviteTokenBytes[:]), "0"),
+				inviteLink,
 			)),
 		}
 		writeResponse(w, r, response)
@@ -393,3 +355,44 @@ func signupSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Requ
 	}
 	writeResponse(w, r, response)
 }
+
+// createInvite creates an invite for an email, returning the link that the
+// invitee signs up with and the hash of its token (which identifies the
+// invite). The user created from the invite starts off with the given
+// entitlement.
+func createInvite(ctx context.Context, nbrew *notebrew.Notebrew, email string, entitlement Entitlement) (inviteLink string, inviteTokenHash []byte, err error) {
+	var inviteTokenBytes [8 + 16]byte
+	binary.BigEndian.PutUint64(inviteTokenBytes[:8], uint64(time.Now().Unix()))
+	_, err = rand.Read(inviteTokenBytes[8:])
+	if err != nil {
+		return "", nil, err
+	}
+	checksum := blake2b.Sum256(inviteTokenBytes[8:])
+	inviteTokenHash = make([]byte, 8+blake2b.Size256)
+	copy(inviteTokenHash[:8], inviteTokenBytes[:8])
+	copy(inviteTokenHash[8:], checksum[:])
+	userFlags, err := json.Marshal(entitlement.UserFlags)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO invite (invite_token_hash, email, site_limit, storage_limit, user_flags)" +
+			" VALUES ({inviteTokenHash}, {email}, {siteLimit}, {storageLimit}, {userFlags})",
+		Values: []any{
+			sq.BytesParam("inviteTokenHash", inviteTokenHash),
+			sq.StringParam("email", email),
+			sq.Int64Param("siteLimit", entitlement.SiteLimit),
+			sq.Int64Param("storageLimit", entitlement.StorageLimit),
+			sq.BytesParam("userFlags", userFlags),
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	scheme := "https://"
+	if !nbrew.CMSDomainHTTPS {
+		scheme = "http://"
+	}
+	return scheme + nbrew.CMSDomain + "/users/invite/?token=" + strings.TrimLeft(hex.EncodeToString(inviteTokenBytes[:]), "0"), inviteTokenHash, nil
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bokwoon95/notebrew"
 	"github.com/bokwoon95/notebrew/sq"
 	"github.com/stripe/stripe-go/v79"
-	portalsession "github.com/stripe/stripe-go/v79/billingportal/session"
-	"github.com/stripe/stripe-go/v79/checkout/session"
+	"github.com/stripe/stripe-go/v79/client"
 	"github.com/stripe/stripe-go/v79/webhook"
 )
 
@@ -32,42 +37,100 @@ func stripeCheckout(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Req
 		nbrew.BadRequest(w, r, fmt.Errorf("priceID not provided"))
 		return
 	}
-	valid := false
-	for _, plan := range stripeConfig.Plans {
-		if plan.PriceID == priceID {
-			valid = true
-			break
-		}
-	}
-	if !valid {
+	plan, ok := stripeConfig.PlanByPriceID(priceID)
+	if !ok {
 		nbrew.BadRequest(w, r, fmt.Errorf("invalid priceID"))
 		return
 	}
+	if plan.Archived {
+		nbrew.BadRequest(w, r, fmt.Errorf("plan %q is no longer available", plan.Name))
+		return
+	}
+	if plan.OneTime {
+		// One-time plans are held alongside any subscription, and buying a
+		// fixed-term plan again extends it, but a lifetime plan only needs
+		// to be bought once.
+		if plan.DurationDays == 0 && user.CustomerID != "" {
+			purchases, err := getPurchases(r.Context(), nbrew, user.CustomerID)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			for _, purchase := range purchases {
+				if purchase.PriceID == priceID && purchase.active() {
+					nbrew.BadRequest(w, r, fmt.Errorf("you already own the %s plan", plan.Name))
+					return
+				}
+			}
+		}
+	} else {
+		// Users who are already subscribed to a plan change their existing
+		// subscription instead of creating a second one.
+		_, _, _, hasSubscription, err := getPlanSubscription(r.Context(), nbrew, stripeConfig, user.CustomerID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		if hasSubscription {
+			if stripeConfig.Provider == "manual" {
+				nbrew.BadRequest(w, r, fmt.Errorf("you are already subscribed to a plan: contact us to change plans"))
+				return
+			}
+			http.Redirect(w, r, "/stripe/changeplan/?priceID="+url.QueryEscape(priceID), http.StatusSeeOther)
+			return
+		}
+	}
+	// The quantity of a per-seat plan is the number of seats, including the
+	// subscriber's own.
+	quantity := int64(1)
+	if plan.PerSeat && r.Form.Has("seats") {
+		quantity, err = strconv.ParseInt(r.Form.Get("seats"), 10, 64)
+		if err != nil || quantity < 1 || quantity > 1000 {
+			nbrew.BadRequest(w, r, fmt.Errorf("invalid seats %q", r.Form.Get("seats")))
+			return
+		}
+	}
 	scheme := "https://"
 	if r.TLS == nil {
 		scheme = "http://"
 	}
-	var customerID, email *string
-	if user.CustomerID != "" {
-		customerID = &user.CustomerID
-	} else {
-		email = &user.Email
-	}
-	expiresAt := time.Now().Add(30 * time.Minute)
-	checkoutSession, err := session.New(&stripe.CheckoutSessionParams{
-		Customer:      customerID,
-		CustomerEmail: email,
-		ExpiresAt:     stripe.Int64(expiresAt.Unix()),
-		Mode:          stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(1),
-			},
-		},
-		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{},
-		SuccessURL:       stripe.String(scheme + nbrew.CMSDomain + "/stripe/checkout/success/?sessionID={CHECKOUT_SESSION_ID}"),
-		CancelURL:        stripe.String(scheme + nbrew.CMSDomain + "/users/profile/"),
+	var coupon *Coupon
+	if c, ok := getCoupon(r, stripeConfig); ok {
+		coupon = &c
+	}
+	// Free trials are only for customers who have never subscribed before.
+	var trialDays int64
+	if plan.TrialDays > 0 {
+		hasSubscribed := false
+		if user.CustomerID != "" {
+			hasSubscribed, err = sq.FetchExists(r.Context(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT 1 FROM subscription WHERE customer_id = {customerID}",
+				Values: []any{
+					sq.StringParam("customerID", user.CustomerID),
+				},
+			})
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+		}
+		if !hasSubscribed {
+			trialDays = plan.TrialDays
+		}
+	}
+	redirectURL, err := newBillingProvider(nbrew, stripeConfig).Checkout(r.Context(), CheckoutParams{
+		User:       user,
+		Plan:       plan,
+		PriceID:    priceID,
+		Quantity:   quantity,
+		Coupon:     coupon,
+		TrialDays:  trialDays,
+		SuccessURL: scheme + nbrew.CMSDomain + "/stripe/checkout/success/?sessionID={CHECKOUT_SESSION_ID}",
+		ReturnURL:  scheme + nbrew.CMSDomain + "/users/profile/",
 	})
 	if err != nil {
 		var stripeErr *stripe.Error
@@ -81,7 +144,7 @@ func stripeCheckout(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Req
 		nbrew.InternalServerError(w, r, err)
 		return
 	}
-	http.Redirect(w, r, checkoutSession.URL, http.StatusSeeOther)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
 }
 
 func stripeCheckoutSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
@@ -96,8 +159,12 @@ func stripeCheckoutSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *h
 		return
 	}
 	sessionID := r.Form.Get("sessionID")
-	checkoutSession, err := session.Get(sessionID, &stripe.CheckoutSessionParams{
-		Expand: stripe.StringSlice([]string{"line_items"}),
+	// The user may not be linked to a customer yet, but the ID of a checkout
+	// session says which mode it was created in.
+	stripeClient := stripeConfig.ForLivemode(!strings.HasPrefix(sessionID, "cs_test_")).Client()
+	fetchTime := time.Now().Unix()
+	checkoutSession, err := stripeClient.CheckoutSessions.Get(sessionID, &stripe.CheckoutSessionParams{
+		Expand: stripe.StringSlice([]string{"subscription", "total_details.breakdown"}),
 	})
 	if err != nil {
 		var stripeErr *stripe.Error
@@ -111,68 +178,49 @@ func stripeCheckoutSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *h
 		nbrew.InternalServerError(w, r, err)
 		return
 	}
+	// The sessionID is in the success URL, so anyone who gets hold of it
+	// could otherwise claim another user's customer, purchase or voucher.
+	if checkoutSession.ClientReferenceID != user.UserID.String() {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid sessionID %q", sessionID))
+		return
+	}
 	if user.CustomerID == "" {
-		_, err := sq.Exec(r.Context(), nbrew.DB, sq.Query{
-			Dialect: nbrew.Dialect,
-			Format:  "INSERT INTO customer (customer_id, user_id) VALUES ({customerID}, {userID})",
-			Values: []any{
-				sq.StringParam("customerID", checkoutSession.Customer.ID),
-				sq.UUIDParam("userID", user.UserID),
-			},
-		})
+		err := linkCustomer(r.Context(), nbrew, checkoutSession.Customer.ID, user.UserID, checkoutSession.Livemode)
 		if err != nil {
-			if nbrew.ErrorCode == nil {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
-			}
-			errorCode := nbrew.ErrorCode(err)
-			if !notebrew.IsKeyViolation(nbrew.Dialect, errorCode) {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
-			}
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
 		}
 	}
-	var plan *Plan
-	for _, lineItem := range checkoutSession.LineItems.Data {
-		if lineItem.Price == nil {
-			continue
-		}
-		for i := range stripeConfig.Plans {
-			if stripeConfig.Plans[i].PriceID == lineItem.Price.ID {
-				plan = &stripeConfig.Plans[i]
-				break
-			}
-		}
-		if plan != nil {
-			break
-		}
+	err = recordRedemption(r.Context(), nbrew, checkoutSession)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
 	}
-	if plan != nil {
-		b, err := json.Marshal(plan.UserFlags)
+	if checkoutSession.Metadata["coupon"] != "" {
+		http.SetCookie(w, &http.Cookie{
+			Path:     "/",
+			Name:     "coupon",
+			Value:    "",
+			MaxAge:   -1,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if checkoutSession.Mode == stripe.CheckoutSessionModePayment && checkoutSession.Metadata["recipientEmail"] != "" {
+		err = saveVoucher(r.Context(), nbrew, stripeConfig, checkoutSession)
 		if err != nil {
 			nbrew.GetLogger(r.Context()).Error(err.Error())
 			nbrew.InternalServerError(w, r, err)
 			return
 		}
-		_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
-			Dialect: nbrew.Dialect,
-			Format:  "UPDATE users SET site_limit = {siteLimit}, storage_limit = {storageLimit}, user_flags = {userFlags} WHERE user_id = {userID}",
-			Values: []any{
-				sq.Int64Param("siteLimit", plan.SiteLimit),
-				sq.Int64Param("storageLimit", plan.StorageLimit),
-				sq.Param("userFlags", sq.DialectExpression{
-					Default: sq.Expr("json_patch(coalesce(user_flags, json_object()), {})", string(b)),
-					Cases: []sq.DialectCase{{
-						Dialect: "postgres",
-						Result:  sq.Expr("coalesce(user_flags, jsonb_build_object()) || CAST({} AS JSONB)", string(b)),
-					}, {
-						Dialect: "mysql",
-						Result:  sq.Expr("json_merge_patch(coalesce(user_flags, json_object(), CAST({} AS JSON)))", string(b)),
-					}},
-				}),
-				sq.UUIDParam("userID", user.UserID),
+		err = nbrew.SetFlashSession(w, r, map[string]any{
+			"postRedirectGet": map[string]any{
+				"from":           "stripe/gift",
+				"recipientEmail": checkoutSession.Metadata["recipientEmail"],
+				"paid":           checkoutSession.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid,
 			},
 		})
 		if err != nil {
@@ -180,11 +228,28 @@ func stripeCheckoutSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *h
 			nbrew.InternalServerError(w, r, err)
 			return
 		}
+	} else if checkoutSession.Subscription != nil || checkoutSession.Mode == stripe.CheckoutSessionModePayment {
+		if checkoutSession.Subscription != nil {
+			_, err = saveSubscription(r.Context(), nbrew, checkoutSession.Subscription, fetchTime)
+		} else {
+			err = savePurchase(r.Context(), nbrew, stripeConfig, checkoutSession)
+		}
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		entitlement, err := syncEntitlement(r.Context(), nbrew, stripeConfig, user.UserID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
 		err = nbrew.SetFlashSession(w, r, map[string]any{
 			"postRedirectGet": map[string]any{
 				"from":         "stripe/checkout/success",
-				"siteLimit":    plan.SiteLimit,
-				"storageLimit": plan.StorageLimit,
+				"siteLimit":    entitlement.SiteLimit,
+				"storageLimit": entitlement.StorageLimit,
 			},
 		})
 		if err != nil {
@@ -196,7 +261,7 @@ func stripeCheckoutSuccess(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *h
 	http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
 }
 
-func stripePortal(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User) {
+func stripePortal(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
 	if r.Method != "POST" {
 		nbrew.MethodNotAllowed(w, r)
 		return
@@ -209,11 +274,12 @@ func stripePortal(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Reque
 	if r.TLS == nil {
 		scheme = "http://"
 	}
-	billingPortalSession, err := portalsession.New(&stripe.BillingPortalSessionParams{
-		Customer:  stripe.String(user.CustomerID),
-		ReturnURL: stripe.String(scheme + nbrew.CMSDomain + "/users/profile/"),
-	})
+	portalURL, err := newBillingProvider(nbrew, stripeConfig).Portal(r.Context(), user.CustomerID, scheme+nbrew.CMSDomain+"/users/profile/")
 	if err != nil {
+		if errors.Is(err, errNoPortal) {
+			nbrew.BadRequest(w, r, err)
+			return
+		}
 		var stripeErr *stripe.Error
 		if errors.As(err, &stripeErr) {
 			if stripeErr.Code == stripe.ErrorCodeResourceMissing {
@@ -225,7 +291,270 @@ func stripePortal(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Reque
 		nbrew.InternalServerError(w, r, err)
 		return
 	}
-	http.Redirect(w, r, billingPortalSession.URL, http.StatusSeeOther)
+	http.Redirect(w, r, portalURL, http.StatusSeeOther)
+}
+
+// stripeAddOn sets the quantity of an add-on on the user's subscription. If
+// the user has no subscription yet, they are sent to checkout to buy the
+// add-on on top of the free plan.
+func stripeAddOn(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	if r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	priceID := r.Form.Get("priceID")
+	if priceID == "" {
+		nbrew.BadRequest(w, r, fmt.Errorf("priceID not provided"))
+		return
+	}
+	_, ok := stripeConfig.AddOnByPriceID(priceID)
+	if !ok {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid priceID"))
+		return
+	}
+	quantity, err := strconv.ParseInt(r.Form.Get("quantity"), 10, 64)
+	if err != nil || quantity < 0 || quantity > 1000 {
+		nbrew.BadRequest(w, r, fmt.Errorf("invalid quantity %q", r.Form.Get("quantity")))
+		return
+	}
+	// Find the subscription to add the add-on to: preferably the one that
+	// already has the add-on, otherwise any subscription that is currently
+	// entitled.
+	var subscriptionID, itemID string
+	if user.CustomerID != "" {
+		subscriptions, err := getSubscriptions(r.Context(), nbrew, user.CustomerID)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		for _, subscription := range subscriptions {
+			if !entitled(subscription.Status, false) {
+				continue
+			}
+			if subscriptionID == "" {
+				subscriptionID = subscription.SubscriptionID
+			}
+			for _, item := range subscription.Items {
+				if item.PriceID == priceID {
+					subscriptionID = subscription.SubscriptionID
+					itemID = item.ItemID
+					break
+				}
+			}
+			if itemID != "" {
+				break
+			}
+		}
+	}
+	stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if subscriptionID == "" {
+		if quantity == 0 {
+			http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+			return
+		}
+		scheme := "https://"
+		if r.TLS == nil {
+			scheme = "http://"
+		}
+		var customerID, email *string
+		if user.CustomerID != "" {
+			customerID = &user.CustomerID
+		} else {
+			email = &user.Email
+		}
+		checkoutSession, err := stripeClient.CheckoutSessions.New(&stripe.CheckoutSessionParams{
+			Customer:          customerID,
+			CustomerEmail:     email,
+			ClientReferenceID: stripe.String(user.UserID.String()),
+			ExpiresAt:         stripe.Int64(time.Now().Add(30 * time.Minute).Unix()),
+			Mode:              stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+			LineItems: []*stripe.CheckoutSessionLineItemParams{
+				{
+					Price:    stripe.String(priceID),
+					Quantity: stripe.Int64(quantity),
+				},
+			},
+			Metadata: map[string]string{
+				"userID": user.UserID.String(),
+			},
+			SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+				Metadata: map[string]string{
+					"userID": user.UserID.String(),
+				},
+			},
+			SuccessURL: stripe.String(scheme + nbrew.CMSDomain + "/stripe/checkout/success/?sessionID={CHECKOUT_SESSION_ID}"),
+			CancelURL:  stripe.String(scheme + nbrew.CMSDomain + "/users/profile/"),
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, checkoutSession.URL, http.StatusSeeOther)
+		return
+	}
+	switch {
+	case itemID == "" && quantity > 0:
+		_, err = stripeClient.SubscriptionItems.New(&stripe.SubscriptionItemParams{
+			Subscription:      stripe.String(subscriptionID),
+			Price:             stripe.String(priceID),
+			Quantity:          stripe.Int64(quantity),
+			ProrationBehavior: stripe.String("create_prorations"),
+		})
+	case itemID != "" && quantity > 0:
+		_, err = stripeClient.SubscriptionItems.Update(itemID, &stripe.SubscriptionItemParams{
+			Quantity:          stripe.Int64(quantity),
+			ProrationBehavior: stripe.String("create_prorations"),
+		})
+	case itemID != "" && quantity == 0:
+		_, err = stripeClient.SubscriptionItems.Del(itemID, &stripe.SubscriptionItemParams{
+			ProrationBehavior: stripe.String("create_prorations"),
+		})
+	}
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	// Don't wait for the customer.subscription.updated event, so that the
+	// user sees their new limits as soon as they are redirected.
+	fetchTime := time.Now().Unix()
+	stripeSubscription, err := stripeClient.Subscriptions.Get(subscriptionID, nil)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	_, err = saveSubscription(r.Context(), nbrew, stripeSubscription, fetchTime)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	entitlement, err := syncEntitlement(r.Context(), nbrew, stripeConfig, user.UserID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	err = nbrew.SetFlashSession(w, r, map[string]any{
+		"postRedirectGet": map[string]any{
+			"from":         "stripe/addon",
+			"siteLimit":    entitlement.SiteLimit,
+			"storageLimit": entitlement.StorageLimit,
+		},
+	})
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+}
+
+// stripeInterval switches the billing interval of the user's plan (e.g. from
+// monthly to yearly) in place, prorating the difference.
+func stripeInterval(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	if r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	interval := r.Form.Get("interval")
+	if interval == "" {
+		nbrew.BadRequest(w, r, fmt.Errorf("interval not provided"))
+		return
+	}
+	currentSubscription, currentItem, plan, ok, err := getPlanSubscription(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if !ok {
+		nbrew.BadRequest(w, r, fmt.Errorf("user has no subscription"))
+		return
+	}
+	price := plan.PriceFor(interval)
+	if price.PriceID == "" {
+		nbrew.BadRequest(w, r, fmt.Errorf("plan %q is not available with interval %q", plan.Name, interval))
+		return
+	}
+	if price.PriceID == currentItem.PriceID {
+		http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
+		return
+	}
+	// Every price on a subscription must have the same billing interval, so
+	// the overage price is swapped along with the plan's price. Add-ons
+	// don't have a price for every interval, so they have to be removed
+	// first.
+	items := []*stripe.SubscriptionItemsParams{{
+		ID:    stripe.String(currentItem.ItemID),
+		Price: stripe.String(price.PriceID),
+	}}
+	for _, item := range currentSubscription.Items {
+		if _, ok := stripeConfig.AddOnByPriceID(item.PriceID); ok {
+			nbrew.BadRequest(w, r, fmt.Errorf("the billing interval cannot be changed while the subscription has add-ons"))
+			return
+		}
+		if plan.IsOveragePrice(item.PriceID) {
+			items = append(items, &stripe.SubscriptionItemsParams{
+				ID:    stripe.String(item.ItemID),
+				Price: stripe.String(price.OveragePriceID),
+			})
+		}
+	}
+	stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	fetchTime := time.Now().Unix()
+	stripeSubscription, err := stripeClient.Subscriptions.Update(currentSubscription.SubscriptionID, &stripe.SubscriptionParams{
+		Items:             items,
+		ProrationBehavior: stripe.String("create_prorations"),
+	})
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	_, err = saveSubscription(r.Context(), nbrew, stripeSubscription, fetchTime)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	err = nbrew.SetFlashSession(w, r, map[string]any{
+		"postRedirectGet": map[string]any{
+			"from":     "stripe/interval",
+			"interval": interval,
+		},
+	})
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/users/profile/", http.StatusSeeOther)
 }
 
 func stripeWebhook(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, stripeConfig StripeConfig) {
@@ -240,179 +569,381 @@ func stripeWebhook(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Requ
 		nbrew.InternalServerError(w, r, err)
 		return
 	}
-	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), stripeConfig.WebhookSecret)
+	event, label, err := newBillingProvider(nbrew, stripeConfig).VerifyWebhook(b, r.Header)
 	if err != nil {
 		nbrew.BadRequest(w, r, err)
 		return
 	}
-	switch event.Type {
-	case "customer.subscription.created":
-		var subscription stripe.Subscription
-		err := json.Unmarshal(event.Data.Raw, &subscription)
+	nbrew.GetLogger(r.Context()).Info("verified webhook event",
+		slog.String("eventID", event.ID),
+		slog.Bool("livemode", event.Livemode),
+		slog.String("webhookSecret", label),
+	)
+	// Record the event before processing it. Stripe delivers events at least
+	// once, so if we have already processed an event with the same ID we
+	// acknowledge it without applying it a second time. A delivery claims
+	// the event by setting its status to processing, so that a redelivery
+	// arriving while an earlier delivery is still processing the event
+	// doesn't process it again.
+	now := time.Now()
+	_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO stripe_event (event_id, event_type, payload, status, creation_time, processing_time)" +
+			" VALUES ({eventID}, {eventType}, {payload}, {status}, {creationTime}, {processingTime})",
+		Values: []any{
+			sq.StringParam("eventID", event.ID),
+			sq.StringParam("eventType", string(event.Type)),
+			sq.StringParam("payload", string(b)),
+			sq.StringParam("status", "processing"),
+			sq.Int64Param("creationTime", event.Created),
+			sq.Int64Param("processingTime", now.Unix()),
+		},
+	})
+	if err != nil {
+		if !isKeyViolation(nbrew, err) {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		status, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM stripe_event WHERE event_id = {eventID}",
+			Values: []any{
+				sq.StringParam("eventID", event.ID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("status")
+		})
 		if err != nil {
-			nbrew.BadRequest(w, r, err)
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
 			return
 		}
-		if subscription.Status != stripe.SubscriptionStatusActive {
+		if status == "processed" {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		var plan *Plan
-		for _, subscriptionItem := range subscription.Items.Data {
-			if subscriptionItem.Price == nil {
-				continue
-			}
-			for i := range stripeConfig.Plans {
-				if stripeConfig.Plans[i].PriceID == subscriptionItem.Plan.ID {
-					plan = &stripeConfig.Plans[i]
-					break
-				}
-			}
-			if plan != nil {
-				break
+		// An event that is still being processed after 10 minutes was
+		// abandoned (e.g. the server was restarted), so it can be claimed
+		// again.
+		result, err := sq.Exec(r.Context(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format: "UPDATE stripe_event SET status = 'processing', processing_time = {processingTime}" +
+				" WHERE event_id = {eventID}" +
+				" AND (status IN ('pending', 'failed') OR (status = 'processing' AND coalesce(processing_time, 0) < {abandonTime}))",
+			Values: []any{
+				sq.Int64Param("processingTime", now.Unix()),
+				sq.StringParam("eventID", event.ID),
+				sq.Int64Param("abandonTime", now.Add(-10*time.Minute).Unix()),
+			},
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		if result.RowsAffected == 0 {
+			// Another delivery is processing the event (or has just
+			// processed it).
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	err = processStripeEvent(r.Context(), nbrew, stripeConfig.ForLivemode(event.Livemode), event)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error(), slog.String("eventID", event.ID), slog.String("eventType", string(event.Type)))
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// constructEvent verifies the signature of a webhook event against each of
+// the live mode and test mode webhook secrets in turn, returning the event
+// along with the label of the secret that verified it. An event whose
+// livemode does not match the mode of the config that verified it is
+// rejected, since it would otherwise be applied with the other mode's plans.
+func constructEvent(payload []byte, header string, stripeConfig StripeConfig) (event stripe.Event, label string, err error) {
+	var webhookSecrets []WebhookSecret
+	for _, config := range []*StripeConfig{&stripeConfig, stripeConfig.Test} {
+		if config == nil {
+			continue
+		}
+		prefix := ""
+		if config == stripeConfig.Test {
+			prefix = "test."
+		}
+		if config.WebhookSecret != "" {
+			webhookSecrets = append(webhookSecrets, WebhookSecret{
+				Label:  prefix + "webhookSecret",
+				Secret: config.WebhookSecret,
+			})
+		}
+		for i, webhookSecret := range config.WebhookSecrets {
+			if webhookSecret.Label == "" {
+				webhookSecret.Label = "webhookSecrets[" + strconv.Itoa(i) + "]"
 			}
+			webhookSecret.Label = prefix + webhookSecret.Label
+			webhookSecrets = append(webhookSecrets, webhookSecret)
 		}
-		if plan != nil {
-			b, err := json.Marshal(plan.UserFlags)
-			if err != nil {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
+	}
+	if len(webhookSecrets) == 0 {
+		return stripe.Event{}, "", fmt.Errorf("no webhook secret configured")
+	}
+	for _, webhookSecret := range webhookSecrets {
+		event, err = webhook.ConstructEvent(payload, header, webhookSecret.Secret)
+		if err == nil {
+			var livemode, ok bool
+			if strings.HasPrefix(webhookSecret.Label, "test.") {
+				livemode, ok = false, true
+			} else if stripeConfig.Test != nil {
+				livemode, ok = true, true
+			} else {
+				livemode, ok = stripeConfig.Livemode()
 			}
-			_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
-				Dialect: nbrew.Dialect,
-				Format: "UPDATE users" +
-					" SET site_limit = {siteLimit}, storage_limit = {storageLimit}, user_flags = {userFlags}" +
-					" WHERE user_id = (SELECT user_id FROM customer WHERE customer_id = {customerID})",
-				Values: []any{
-					sq.Int64Param("siteLimit", plan.SiteLimit),
-					sq.Int64Param("storageLimit", plan.StorageLimit),
-					sq.Param("userFlags", sq.DialectExpression{
-						Default: sq.Expr("json_patch(coalesce(user_flags, json_object()), {})", string(b)),
-						Cases: []sq.DialectCase{{
-							Dialect: "postgres",
-							Result:  sq.Expr("coalesce(user_flags, jsonb_build_object()) || CAST({} AS JSONB)", string(b)),
-						}, {
-							Dialect: "mysql",
-							Result:  sq.Expr("json_merge_patch(coalesce(user_flags, json_object(), CAST({} AS JSON)))", string(b)),
-						}},
-					}),
-					sq.StringParam("customerID", subscription.Customer.ID),
-				},
-			})
-			if err != nil {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
+			if ok && event.Livemode != livemode {
+				return stripe.Event{}, "", fmt.Errorf("event %s has livemode=%t but was verified by %s", event.ID, event.Livemode, webhookSecret.Label)
 			}
+			return event, webhookSecret.Label, nil
+		}
+		// Any other error (a malformed header, an expired timestamp) would
+		// be the same for every secret.
+		if !errors.Is(err, webhook.ErrNoValidSignature) {
+			return stripe.Event{}, "", err
+		}
+	}
+	return stripe.Event{}, "", err
+}
+
+// processStripeEvent applies a Stripe event and records the outcome in the
+// stripe_event table. The event must already have a row in the stripe_event
+// table.
+func processStripeEvent(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, event stripe.Event) error {
+	status, errorMessage := "processed", ""
+	handleErr := handleStripeEvent(ctx, nbrew, stripeConfig, event)
+	if handleErr != nil {
+		status, errorMessage = "failed", handleErr.Error()
+	}
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "UPDATE stripe_event" +
+			" SET status = {status}, error_message = {errorMessage}, processing_time = {processingTime}" +
+			" WHERE event_id = {eventID}",
+		Values: []any{
+			sq.StringParam("status", status),
+			sq.Param("errorMessage", sql.NullString{String: errorMessage, Valid: errorMessage != ""}),
+			sq.Int64Param("processingTime", time.Now().Unix()),
+			sq.StringParam("eventID", event.ID),
+		},
+	})
+	if err != nil {
+		if handleErr != nil {
+			return errors.Join(handleErr, err)
+		}
+		return err
+	}
+	return handleErr
+}
+
+// handleStripeEvent applies the changes described by a Stripe event.
+func handleStripeEvent(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, event stripe.Event) error {
+	switch event.Type {
+	case "checkout.session.completed":
+		var checkoutSession stripe.CheckoutSession
+		err := json.Unmarshal(event.Data.Raw, &checkoutSession)
+		if err != nil {
+			return err
+		}
+		if checkoutSession.Customer == nil {
+			return nil
+		}
+		userIDString := checkoutSession.ClientReferenceID
+		if userIDString == "" {
+			userIDString = checkoutSession.Metadata["userID"]
+		}
+		if userIDString == "" {
+			// Not a checkout session created by stripeCheckout.
+			return nil
+		}
+		userID, err := notebrew.ParseID(userIDString)
+		if err != nil {
+			return fmt.Errorf("checkout session %s: invalid userID %q: %w", checkoutSession.ID, userIDString, err)
+		}
+		err = linkCustomer(ctx, nbrew, checkoutSession.Customer.ID, userID, checkoutSession.Livemode)
+		if err != nil {
+			return err
+		}
+		err = recordRedemption(ctx, nbrew, &checkoutSession)
+		if err != nil {
+			return err
+		}
+		err = savePurchase(ctx, nbrew, stripeConfig, &checkoutSession)
+		if err != nil {
+			return err
+		}
+		err = saveVoucher(ctx, nbrew, stripeConfig, &checkoutSession)
+		if err != nil {
+			return err
+		}
+		// The customer.subscription.created event may have arrived before
+		// the customer was linked to the user, in which case it would not
+		// have updated anyone. The subscription has been saved regardless,
+		// so syncing the user's entitlement now picks it up (along with any
+		// one-time purchase saved above).
+		_, err = syncEntitlement(ctx, nbrew, stripeConfig, userID)
+		if err != nil {
+			return err
 		}
-	case "customer.subscription.updated":
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
 		var subscription stripe.Subscription
 		err := json.Unmarshal(event.Data.Raw, &subscription)
 		if err != nil {
-			nbrew.BadRequest(w, r, err)
-			return
+			return err
 		}
-		var plan *Plan
-		if subscription.Status == stripe.SubscriptionStatusActive {
-			if subscription.CancelAtPeriodEnd {
-				// If we reach here it means that the customer canceled the
-				// subscription, but it only kicks in at the end of the billing
-				// period. Once that happens we will receive another webhook
-				// event, this time where the subscription status ==
-				// "canceled". So, there is nothing to do right now and the
-				// customer gets to keep using their currently active
-				// subscription (at least until the end of the billing period).
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			for _, subscriptionItem := range subscription.Items.Data {
-				if subscriptionItem.Price == nil {
-					continue
-				}
-				for i := range stripeConfig.Plans {
-					if stripeConfig.Plans[i].PriceID == subscriptionItem.Plan.ID {
-						plan = &stripeConfig.Plans[i]
-						break
-					}
-				}
-				if plan != nil {
-					break
-				}
-			}
-		} else {
-			plan = &Plan{
-				SiteLimit:    1,
-				StorageLimit: 10_000_000,
-				UserFlags: map[string]bool{
-					"NoUploadImage":  true,
-					"NoCustomDomain": true,
-				},
-			}
-			for i := range stripeConfig.Plans {
-				if stripeConfig.Plans[i].PriceID == "" {
-					plan = &stripeConfig.Plans[i]
-					break
-				}
-			}
+		saved, err := saveSubscription(ctx, nbrew, &subscription, event.Created)
+		if err != nil {
+			return err
 		}
-		if plan != nil {
-			b, err := json.Marshal(plan.UserFlags)
+		if !saved {
+			// A newer state of the subscription has already been saved, and
+			// acting on this one could restart dunning for a subscription
+			// that has since been paid.
+			return nil
+		}
+		switch subscription.Status {
+		case stripe.SubscriptionStatusPastDue, stripe.SubscriptionStatusUnpaid:
+			// Payment has failed but the user keeps their plan until the
+			// grace period is over, at which point runDunning takes over.
+			err := startDunning(ctx, nbrew, subscription.ID, subscription.Customer.ID, string(subscription.Status))
 			if err != nil {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
+				return err
 			}
-			_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
-				Dialect: nbrew.Dialect,
-				Format: "UPDATE users" +
-					" SET site_limit = {siteLimit}, storage_limit = {storageLimit}, user_flags = {userFlags}" +
-					" WHERE user_id = (SELECT user_id FROM customer WHERE customer_id = {customerID})",
-				Values: []any{
-					sq.Int64Param("siteLimit", plan.SiteLimit),
-					sq.Int64Param("storageLimit", plan.StorageLimit),
-					sq.Param("userFlags", sq.DialectExpression{
-						Default: sq.Expr("json_patch(coalesce(user_flags, json_object()), {})", string(b)),
-						Cases: []sq.DialectCase{{
-							Dialect: "postgres",
-							Result:  sq.Expr("coalesce(user_flags, jsonb_build_object()) || CAST({} AS JSONB)", string(b)),
-						}, {
-							Dialect: "mysql",
-							Result:  sq.Expr("json_merge_patch(coalesce(user_flags, json_object(), CAST({} AS JSON)))", string(b)),
-						}},
-					}),
-					sq.StringParam("customerID", subscription.Customer.ID),
-				},
-			})
+		default:
+			// If the customer canceled the subscription but it only kicks in
+			// at the end of the billing period, the status remains "active"
+			// and the customer gets to keep using their plan until we
+			// receive another event where the status is "canceled".
+			err := endDunning(ctx, nbrew, subscription.ID, subscription.Customer.ID)
 			if err != nil {
-				nbrew.GetLogger(r.Context()).Error(err.Error())
-				nbrew.InternalServerError(w, r, err)
-				return
+				return err
 			}
 		}
-	case "customer.subscription.deleted":
-		var subscription stripe.Subscription
-		err := json.Unmarshal(event.Data.Raw, &subscription)
+		err = syncCustomerEntitlement(ctx, nbrew, stripeConfig, subscription.Customer.ID)
 		if err != nil {
-			nbrew.BadRequest(w, r, err)
-			return
+			return err
 		}
-		_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
-			Dialect: nbrew.Dialect,
-			Format: "UPDATE users" +
-				" SET site_limit = {siteLimit}, storage_limit = {storageLimit}" +
-				" WHERE user_id = (SELECT user_id FROM customer WHERE customer_id = {customerID})",
-			Values: []any{
-				sq.Int64Param("siteLimit", 1),
-				sq.Int64Param("storageLimit", 10_000_000),
-				sq.StringParam("customerID", subscription.Customer.ID),
-			},
-		})
+	case "customer.updated":
+		var stripeCustomer stripe.Customer
+		err := json.Unmarshal(event.Data.Raw, &stripeCustomer)
 		if err != nil {
-			nbrew.GetLogger(r.Context()).Error(err.Error())
-			nbrew.InternalServerError(w, r, err)
-			return
+			return err
+		}
+		mismatch, err := saveCustomerEmail(ctx, nbrew, &stripeCustomer, event.Created)
+		if err != nil {
+			return err
+		}
+		if mismatch {
+			// The user's email is not pushed over the customer's, since the
+			// customer may have changed it deliberately. It is left for an
+			// admin to review with `notebrew stripe customers`.
+			nbrew.GetLogger(ctx).Warn("customer " + stripeCustomer.ID + ": stripe email " + stripeCustomer.Email + " does not match the user's email")
+		}
+	case "payment_intent.succeeded":
+		var paymentIntent stripe.PaymentIntent
+		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+		if err != nil {
+			return err
+		}
+		err = completePaymentIntent(ctx, nbrew, stripeConfig, paymentIntent.ID)
+		if err != nil {
+			return err
+		}
+		err = completeVoucherPayment(ctx, nbrew, stripeConfig, paymentIntent.ID)
+		if err != nil {
+			return err
+		}
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			return err
+		}
+		if invoice.Customer == nil {
+			return nil
 		}
+		err = saveInvoice(ctx, nbrew, &invoice, event.Created)
+		if err != nil {
+			return err
+		}
+	case "invoice.payment_failed":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			return err
+		}
+		if invoice.Customer == nil {
+			return nil
+		}
+		err = saveInvoice(ctx, nbrew, &invoice, event.Created)
+		if err != nil {
+			return err
+		}
+		if invoice.Subscription == nil {
+			return nil
+		}
+		return startDunning(ctx, nbrew, invoice.Subscription.ID, invoice.Customer.ID, "payment_failed")
 	}
-	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// linkCustomer associates a Stripe customer with a user. livemode is whether
+// the customer was created in live mode or test mode. It is a no-op if the
+// customer is already linked.
+func linkCustomer(ctx context.Context, nbrew *notebrew.Notebrew, customerID string, userID notebrew.ID, livemode bool) error {
+	_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO customer (customer_id, user_id, test_mode, synced_email, synced_name)" +
+			" SELECT {customerID}, {userID}, {testMode}, email, username FROM users WHERE user_id = {userID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+			sq.UUIDParam("userID", userID),
+			sq.BoolParam("testMode", !livemode),
+		},
+	})
+	if err != nil {
+		if isKeyViolation(nbrew, err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// customerClient returns a Stripe API client for the mode (live or test) that
+// a customer was created in. Customers that are not linked to a user yet are
+// assumed to be live mode customers.
+func customerClient(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string) (*client.API, error) {
+	if customerID == "" || stripeConfig.Test == nil {
+		return stripeConfig.Client(), nil
+	}
+	testMode, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM customer WHERE customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) bool {
+		return row.Bool("test_mode")
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return stripeConfig.ForLivemode(!testMode).Client(), nil
+}
+
+func isKeyViolation(nbrew *notebrew.Notebrew, err error) bool {
+	if nbrew.ErrorCode == nil {
+		return false
+	}
+	return notebrew.IsKeyViolation(nbrew.Dialect, nbrew.ErrorCode(err))
 }
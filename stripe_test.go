@@ -0,0 +1,2153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/cli"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/sqddl/ddl"
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/webhook"
+	"golang.org/x/crypto/blake2b"
+)
+
+const testWebhookSecret = "whsec_test"
+
+var testStripeConfig = StripeConfig{
+	PublishableKey: "pk_test_fake",
+	SecretKey:      "sk_test_fake",
+	WebhookSecret:  testWebhookSecret,
+	Plans: []Plan{{
+		Name:         "Free",
+		SiteLimit:    1,
+		StorageLimit: 10_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  true,
+			"NoCustomDomain": true,
+		},
+	}, {
+		Name:         "Pro",
+		SiteLimit:    10,
+		StorageLimit: 10_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:   "$6/month",
+		PriceID: "price_pro",
+		Prices: []PlanPrice{{
+			Interval: "year",
+			Price:    "$60/year",
+			PriceID:  "price_pro_yearly",
+		}},
+	}, {
+		Name:         "Business",
+		SiteLimit:    50,
+		StorageLimit: 100_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:   "$20/month",
+		PriceID: "price_business",
+	}, {
+		Archived:     true,
+		Name:         "Legacy",
+		SiteLimit:    20,
+		StorageLimit: 20_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:   "$5/month",
+		PriceID: "price_legacy",
+	}, {
+		Name:         "Lifetime",
+		SiteLimit:    30,
+		StorageLimit: 30_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:   "$200 once",
+		PriceID: "price_lifetime",
+		OneTime: true,
+	}, {
+		Name:         "30-day pass",
+		SiteLimit:    5,
+		StorageLimit: 5_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:        "$8 for 30 days",
+		PriceID:      "price_pass",
+		OneTime:      true,
+		DurationDays: 30,
+	}, {
+		Name:         "Team",
+		SiteLimit:    20,
+		StorageLimit: 50_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:   "$10/seat/month",
+		PriceID: "price_team",
+		PerSeat: true,
+	}, {
+		Name:         "Pay as you go",
+		SiteLimit:    10,
+		StorageLimit: 10_000_000_000,
+		UserFlags: map[string]bool{
+			"NoUploadImage":  false,
+			"NoCustomDomain": false,
+		},
+		Price:          "$5/month + $1/GB",
+		PriceID:        "price_payg",
+		OveragePriceID: "price_payg_overage",
+		Prices: []PlanPrice{{
+			Interval:       "year",
+			Price:          "$50/year + $1/GB",
+			PriceID:        "price_payg_yearly",
+			OveragePriceID: "price_payg_overage_yearly",
+		}},
+	}},
+	AddOns: []AddOn{{
+		Name:      "+1 site",
+		SiteLimit: 1,
+		Price:     "$1/month",
+		PriceID:   "price_site",
+	}, {
+		Name:         "+10 GB storage",
+		StorageLimit: 10_000_000_000,
+		Price:        "$2/month",
+		PriceID:      "price_storage",
+	}},
+	Gifts: []Gift{{
+		Name:    "3 months of Business",
+		Plan:    "Business",
+		Months:  3,
+		Price:   "$60",
+		PriceID: "price_gift_business",
+	}},
+	RetentionOffer: RetentionOffer{
+		CouponID:    "coupon_retention",
+		Description: "50% off your next 3 months",
+	},
+}
+
+// newTestNotebrew returns a notebrew instance backed by a fresh SQLite
+// database with both the notebrew and notebrewlive schemas applied.
+func newTestNotebrew(t *testing.T) *notebrew.Notebrew {
+	t.Helper()
+	configDir := t.TempDir()
+	dataDir := t.TempDir()
+	b, err := json.Marshal(map[string]any{
+		"dialect":  "sqlite",
+		"filePath": filepath.Join(dataDir, "notebrew-database.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(configDir, "database.json"), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nbrew, closers, err := cli.Notebrew(configDir, dataDir, nil)
+	t.Cleanup(func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nbrew.Close()
+	})
+	databaseCatalog, err := notebrew.UnmarshalCatalog(nbrew.Dialect, databaseSchemaBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	automigrateCmd := &ddl.AutomigrateCmd{
+		DB:             nbrew.DB,
+		Dialect:        nbrew.Dialect,
+		DestCatalog:    databaseCatalog,
+		AcceptWarnings: true,
+		Stderr:         io.Discard,
+	}
+	err = automigrateCmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nbrew
+}
+
+// createTestUser creates a user on the free plan and returns their userID
+// and a session token that can be used to authenticate as them.
+func createTestUser(t *testing.T, nbrew *notebrew.Notebrew, username string) (notebrew.ID, string) {
+	t.Helper()
+	userID := notebrew.NewID()
+	freePlan := testStripeConfig.FreePlan()
+	userFlags, err := json.Marshal(freePlan.UserFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "INSERT INTO users (user_id, username, email, password_hash, timezone_offset_seconds, site_limit, storage_limit, user_flags)" +
+			" VALUES ({userID}, {username}, {email}, {passwordHash}, 0, {siteLimit}, {storageLimit}, {userFlags})",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+			sq.StringParam("username", username),
+			sq.StringParam("email", username+"@example.com"),
+			sq.StringParam("passwordHash", "x"),
+			sq.Int64Param("siteLimit", freePlan.SiteLimit),
+			sq.Int64Param("storageLimit", freePlan.StorageLimit),
+			sq.BytesParam("userFlags", userFlags),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessionTokenBytes [8 + 16]byte
+	binary.BigEndian.PutUint64(sessionTokenBytes[:8], uint64(time.Now().Unix()))
+	_, err = rand.Read(sessionTokenBytes[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessionTokenHash [8 + blake2b.Size256]byte
+	checksum := blake2b.Sum256(sessionTokenBytes[8:])
+	copy(sessionTokenHash[:8], sessionTokenBytes[:8])
+	copy(sessionTokenHash[8:], checksum[:])
+	_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "INSERT INTO session (session_token_hash, user_id) VALUES ({sessionTokenHash}, {userID})",
+		Values: []any{
+			sq.BytesParam("sessionTokenHash", sessionTokenHash[:]),
+			sq.UUIDParam("userID", userID),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, hex.EncodeToString(sessionTokenBytes[:])
+}
+
+func getTestUser(t *testing.T, nbrew *notebrew.Notebrew, userID notebrew.ID) User {
+	t.Helper()
+	user, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM users" +
+			" LEFT JOIN customer ON customer.user_id = users.user_id" +
+			" WHERE users.user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) User {
+		var user User
+		user.UserID = row.UUID("users.user_id")
+		user.SiteLimit = row.Int64("coalesce(users.site_limit, -1)")
+		user.StorageLimit = row.Int64("coalesce(users.storage_limit, -1)")
+		b := row.Bytes(nil, "users.user_flags")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &user.UserFlags)
+			if err != nil {
+				panic(err)
+			}
+		}
+		user.CustomerID = row.String("customer.customer_id")
+		return user
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func serveTestRequest(t *testing.T, nbrew *notebrew.Notebrew, method, target, sessionToken string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r := httptest.NewRequest(method, "http://"+nbrew.CMSDomain+target, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if sessionToken != "" {
+		r.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+	}
+	w := httptest.NewRecorder()
+	ServeHTTP(nbrew, testStripeConfig, false).ServeHTTP(w, r)
+	return w
+}
+
+// sendTestEvent signs a Stripe event wrapping object and posts it to the
+// webhook.
+func sendTestEvent(t *testing.T, nbrew *notebrew.Notebrew, eventID string, eventType string, object any) *httptest.ResponseRecorder {
+	t.Helper()
+	return sendSignedTestEvent(t, nbrew, testStripeConfig, testWebhookSecret, false, eventID, eventType, object)
+}
+
+// sendSignedTestEvent is like sendTestEvent but lets the caller choose the
+// config that the webhook runs with, the secret that the event is signed
+// with and the event's livemode.
+func sendSignedTestEvent(t *testing.T, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, webhookSecret string, livemode bool, eventID string, eventType string, object any) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(map[string]any{
+		"id":          eventID,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"livemode":    livemode,
+		"type":        eventType,
+		"data": map[string]any{
+			"object": json.RawMessage(b),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedPayload := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  webhookSecret,
+	})
+	r := httptest.NewRequest("POST", "http://"+nbrew.CMSDomain+"/stripe/webhook/", strings.NewReader(string(payload)))
+	r.Header.Set("Stripe-Signature", signedPayload.Header)
+	w := httptest.NewRecorder()
+	ServeHTTP(nbrew, stripeConfig, false).ServeHTTP(w, r)
+	return w
+}
+
+// checkout goes through /stripe/checkout/ for the given price and returns
+// the ID of the checkout session that was created.
+func checkout(t *testing.T, nbrew *notebrew.Notebrew, sessionToken, priceID string) string {
+	t.Helper()
+	w := serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+		"priceID": []string{priceID},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	sessionID := strings.TrimPrefix(location, "https://checkout.stripe.com/c/pay/")
+	if sessionID == location {
+		t.Fatalf("checkout: unexpected redirect %q", location)
+	}
+	return sessionID
+}
+
+func assertPlan(t *testing.T, user User, plan Plan) {
+	t.Helper()
+	if user.SiteLimit != plan.SiteLimit {
+		t.Errorf("site limit: expected %d, got %d", plan.SiteLimit, user.SiteLimit)
+	}
+	if user.StorageLimit != plan.StorageLimit {
+		t.Errorf("storage limit: expected %d, got %d", plan.StorageLimit, user.StorageLimit)
+	}
+	for name, value := range plan.UserFlags {
+		if user.UserFlags[name] != value {
+			t.Errorf("user flag %s: expected %t, got %t", name, value, user.UserFlags[name])
+		}
+	}
+}
+
+func TestStripeCheckout(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+
+	t.Run("NotAuthenticated", func(t *testing.T) {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", "", url.Values{
+			"priceID": []string{"price_pro"},
+		})
+		if w.Code == http.StatusSeeOther {
+			t.Fatalf("expected checkout to be refused without a session")
+		}
+	})
+
+	t.Run("InvalidPriceID", func(t *testing.T) {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+			"priceID": []string{"price_nonexistent"},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("ArchivedPlan", func(t *testing.T) {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+			"priceID": []string{"price_legacy"},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("ClientReferenceID", func(t *testing.T) {
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		checkoutSession := fake.checkoutSessions[sessionID]
+		if checkoutSession.ClientReferenceID != userID.String() {
+			t.Errorf("client_reference_id: expected %q, got %q", userID.String(), checkoutSession.ClientReferenceID)
+		}
+		if checkoutSession.CustomerEmail != "alice@example.com" {
+			t.Errorf("customer_email: expected %q, got %q", "alice@example.com", checkoutSession.CustomerEmail)
+		}
+	})
+}
+
+func TestStripeCheckoutSuccess(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	checkoutSession, _ := fake.completeCheckout(t, sessionID)
+
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "/users/profile/" {
+		t.Errorf("expected redirect to /users/profile/, got %q", location)
+	}
+	user := getTestUser(t, nbrew, userID)
+	if user.CustomerID != checkoutSession.Customer.ID {
+		t.Errorf("customer: expected %q, got %q", checkoutSession.Customer.ID, user.CustomerID)
+	}
+	assertPlan(t, user, testStripeConfig.Plans[1])
+
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID=cs_nonexistent", sessionToken, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid sessionID: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Another user can't claim the checkout session.
+	bobID, bobSessionToken := createTestUser(t, nbrew, "bob")
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, bobSessionToken, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("other user: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if bob := getTestUser(t, nbrew, bobID); bob.CustomerID != "" {
+		t.Errorf("other user: expected no customer, got %q", bob.CustomerID)
+	}
+}
+
+func TestSaveSubscription(t *testing.T) {
+	// A customer.subscription.created event that is delivered after the
+	// checkout success page has already saved the active subscription must
+	// not overwrite it with the incomplete status it was created with.
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	staleSubscription := *subscription
+	staleSubscription.Status = stripe.SubscriptionStatusIncomplete
+	saved, err := saveSubscription(context.Background(), nbrew, &staleSubscription, time.Now().Add(-time.Minute).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved {
+		t.Errorf("expected the stale subscription not to be saved")
+	}
+	_, err = syncEntitlement(context.Background(), nbrew, testStripeConfig, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+	canceledSubscription := *subscription
+	canceledSubscription.Status = stripe.SubscriptionStatusCanceled
+	saved, err = saveSubscription(context.Background(), nbrew, &canceledSubscription, time.Now().Add(time.Minute).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved {
+		t.Errorf("expected the canceled subscription to be saved")
+	}
+	_, err = syncEntitlement(context.Background(), nbrew, testStripeConfig, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+}
+
+func TestStripeWebhook(t *testing.T) {
+	t.Run("InvalidSignature", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		r := httptest.NewRequest("POST", "http://"+nbrew.CMSDomain+"/stripe/webhook/", strings.NewReader(`{"id":"evt_1"}`))
+		r.Header.Set("Stripe-Signature", "t=1,v1=deadbeef")
+		w := httptest.NewRecorder()
+		ServeHTTP(nbrew, testStripeConfig, false).ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("WithoutRedirect", func(t *testing.T) {
+		// The user closes the tab after paying, so only the webhook events
+		// arrive. customer.subscription.created arrives before
+		// checkout.session.completed, when the customer is not yet linked
+		// to the user.
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		checkoutSession, subscription := fake.completeCheckout(t, sessionID)
+		w := sendTestEvent(t, nbrew, "evt_1", "customer.subscription.created", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("customer.subscription.created: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+		w = sendTestEvent(t, nbrew, "evt_2", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("checkout.session.completed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		user := getTestUser(t, nbrew, userID)
+		if user.CustomerID != checkoutSession.Customer.ID {
+			t.Errorf("customer: expected %q, got %q", checkoutSession.Customer.ID, user.CustomerID)
+		}
+		assertPlan(t, user, testStripeConfig.Plans[1])
+	})
+
+	t.Run("SecretRotation", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		checkoutSession, subscription := fake.completeCheckout(t, sessionID)
+		stripeConfig := testStripeConfig
+		stripeConfig.WebhookSecrets = []WebhookSecret{
+			{Label: "new", Secret: "whsec_new"},
+		}
+		w := sendSignedTestEvent(t, nbrew, stripeConfig, testWebhookSecret, false, "evt_1", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("old secret: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		w = sendSignedTestEvent(t, nbrew, stripeConfig, "whsec_new", false, "evt_2", "customer.subscription.created", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("new secret: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+		w = sendSignedTestEvent(t, nbrew, stripeConfig, "whsec_unknown", false, "evt_3", "customer.subscription.updated", subscription)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("unknown secret: expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("TestMode", func(t *testing.T) {
+		// Test mode events are verified with the test mode secret and
+		// resolved against the test mode plans.
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		checkoutSession, subscription := fake.completeCheckout(t, sessionID)
+		subscription.Items.Data[0].Price = &stripe.Price{ID: "price_testmode"}
+		stripeConfig := testStripeConfig
+		stripeConfig.Test = &StripeConfig{
+			WebhookSecret: "whsec_testmode",
+			Plans: []Plan{{
+				Name:         "Test",
+				SiteLimit:    99,
+				StorageLimit: 99_000_000_000,
+				PriceID:      "price_testmode",
+			}},
+		}
+		w := sendSignedTestEvent(t, nbrew, stripeConfig, "whsec_testmode", false, "evt_1", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("checkout.session.completed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		w = sendSignedTestEvent(t, nbrew, stripeConfig, "whsec_testmode", false, "evt_2", "customer.subscription.created", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("customer.subscription.created: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), stripeConfig.Test.Plans[0])
+
+		// An event must not be applied with the config of the other mode.
+		w = sendSignedTestEvent(t, nbrew, stripeConfig, testWebhookSecret, false, "evt_3", "customer.subscription.updated", subscription)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("test mode event verified by the live mode secret: expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+		w = sendSignedTestEvent(t, nbrew, stripeConfig, "whsec_testmode", true, "evt_4", "customer.subscription.updated", subscription)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("live mode event verified by the test mode secret: expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("DuplicateEvent", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		_, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		checkoutSession, _ := fake.completeCheckout(t, sessionID)
+		for i := 0; i < 2; i++ {
+			w := sendTestEvent(t, nbrew, "evt_1", "checkout.session.completed", checkoutSession)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("delivery %d: expected status %d, got %d: %s", i+1, http.StatusNoContent, w.Code, w.Body.String())
+			}
+		}
+		statuses, err := sq.FetchAll(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM stripe_event WHERE event_id = 'evt_1'",
+		}, func(row *sq.Row) string {
+			return row.String("status")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 || statuses[0] != "processed" {
+			t.Fatalf("expected a single processed event, got %v", statuses)
+		}
+
+		// A delivery that arrives while another is processing the event
+		// leaves it to the other delivery, unless it has been abandoned.
+		getStatus := func(eventID string) string {
+			t.Helper()
+			status, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM stripe_event WHERE event_id = {eventID}",
+				Values: []any{
+					sq.StringParam("eventID", eventID),
+				},
+			}, func(row *sq.Row) string {
+				return row.String("status")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return status
+		}
+		_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format: "INSERT INTO stripe_event (event_id, event_type, payload, status, creation_time, processing_time)" +
+				" VALUES ('evt_2', 'checkout.session.completed', '{}', 'processing', {now}, {now})",
+			Values: []any{
+				sq.Int64Param("now", time.Now().Unix()),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := sendTestEvent(t, nbrew, "evt_2", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusOK {
+			t.Fatalf("delivery during processing: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if status := getStatus("evt_2"); status != "processing" {
+			t.Errorf("delivery during processing: expected status %q, got %q", "processing", status)
+		}
+		_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE stripe_event SET processing_time = {processingTime} WHERE event_id = 'evt_2'",
+			Values: []any{
+				sq.Int64Param("processingTime", time.Now().Add(-time.Hour).Unix()),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = sendTestEvent(t, nbrew, "evt_2", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("delivery after abandoned processing: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		if status := getStatus("evt_2"); status != "processed" {
+			t.Errorf("delivery after abandoned processing: expected status %q, got %q", "processed", status)
+		}
+	})
+
+	t.Run("Cancellation", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		fake.completeCheckout(t, sessionID)
+		w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+		subscription := fake.cancelSubscription(t, fake.checkoutSessions[sessionID].Subscription.ID)
+		w = sendTestEvent(t, nbrew, "evt_1", "customer.subscription.deleted", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("customer.subscription.deleted: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		// The free plan's flags must be restored along with its limits.
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+	})
+}
+
+func TestStripePortal(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	_, sessionToken := createTestUser(t, nbrew, "alice")
+
+	w := serveTestRequest(t, nbrew, "POST", "/stripe/portal/", sessionToken, url.Values{})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("without customer: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	fake.completeCheckout(t, sessionID)
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/portal/", sessionToken, url.Values{})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://billing.stripe.com/") {
+		t.Errorf("unexpected redirect %q", location)
+	}
+}
+
+func TestStripeAddOn(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+
+	t.Run("WithoutSubscription", func(t *testing.T) {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/addon/", sessionToken, url.Values{
+			"priceID":  []string{"price_site"},
+			"quantity": []string{"1"},
+		})
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://checkout.stripe.com/") {
+			t.Errorf("expected redirect to checkout, got %q", location)
+		}
+	})
+
+	t.Run("InvalidPriceID", func(t *testing.T) {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/addon/", sessionToken, url.Values{
+			"priceID":  []string{"price_pro"},
+			"quantity": []string{"1"},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	proPlan := testStripeConfig.Plans[1]
+	tests := []struct {
+		priceID      string
+		quantity     string
+		siteLimit    int64
+		storageLimit int64
+	}{
+		{"price_site", "2", proPlan.SiteLimit + 2, proPlan.StorageLimit},
+		{"price_storage", "1", proPlan.SiteLimit + 2, proPlan.StorageLimit + 10_000_000_000},
+		{"price_site", "3", proPlan.SiteLimit + 3, proPlan.StorageLimit + 10_000_000_000},
+		{"price_site", "0", proPlan.SiteLimit, proPlan.StorageLimit + 10_000_000_000},
+	}
+	for _, tt := range tests {
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/addon/", sessionToken, url.Values{
+			"priceID":  []string{tt.priceID},
+			"quantity": []string{tt.quantity},
+		})
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s x %s: expected status %d, got %d: %s", tt.priceID, tt.quantity, http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		user := getTestUser(t, nbrew, userID)
+		if user.SiteLimit != tt.siteLimit {
+			t.Errorf("%s x %s: site limit: expected %d, got %d", tt.priceID, tt.quantity, tt.siteLimit, user.SiteLimit)
+		}
+		if user.StorageLimit != tt.storageLimit {
+			t.Errorf("%s x %s: storage limit: expected %d, got %d", tt.priceID, tt.quantity, tt.storageLimit, user.StorageLimit)
+		}
+	}
+}
+
+func TestStripeTrial(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	stripeConfig := testStripeConfig
+	stripeConfig.Plans = append([]Plan{}, testStripeConfig.Plans...)
+	stripeConfig.Plans[1].TrialDays = 14
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		var body io.Reader
+		if form != nil {
+			body = strings.NewReader(form.Encode())
+		}
+		r := httptest.NewRequest(method, "http://"+nbrew.CMSDomain+target, body)
+		if form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+		w := httptest.NewRecorder()
+		ServeHTTP(nbrew, stripeConfig, false).ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("POST", "/stripe/checkout/", url.Values{"priceID": []string{"price_pro"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	sessionID := strings.TrimPrefix(w.Header().Get("Location"), "https://checkout.stripe.com/c/pay/")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	if subscription.Status != stripe.SubscriptionStatusTrialing {
+		t.Fatalf("expected a trialing subscription, got %q", subscription.Status)
+	}
+	w = serve("GET", "/stripe/checkout/success/?sessionID="+sessionID, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), stripeConfig.Plans[1])
+
+	// A customer who has already subscribed doesn't get another trial.
+	w = serve("POST", "/stripe/checkout/", url.Values{"priceID": []string{"price_pro"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	sessionID = strings.TrimPrefix(w.Header().Get("Location"), "https://checkout.stripe.com/c/pay/")
+	_, subscription = fake.completeCheckout(t, sessionID)
+	if subscription.Status != stripe.SubscriptionStatusActive {
+		t.Fatalf("expected an active subscription, got %q", subscription.Status)
+	}
+}
+
+func TestStripeCoupon(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	_, sessionToken := createTestUser(t, nbrew, "alice")
+	stripeConfig := testStripeConfig
+	stripeConfig.AllowPromotionCodes = true
+	stripeConfig.Coupons = []Coupon{{
+		Code:        "LAUNCH",
+		CouponID:    "coupon_launch",
+		Description: "50% off your first month",
+	}}
+	checkout := func(couponCookie string) *stripe.CheckoutSession {
+		t.Helper()
+		r := httptest.NewRequest("POST", "http://"+nbrew.CMSDomain+"/stripe/checkout/", strings.NewReader("priceID=price_pro"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+		if couponCookie != "" {
+			r.AddCookie(&http.Cookie{Name: "coupon", Value: couponCookie})
+		}
+		w := httptest.NewRecorder()
+		ServeHTTP(nbrew, stripeConfig, false).ServeHTTP(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		sessionID := strings.TrimPrefix(w.Header().Get("Location"), "https://checkout.stripe.com/c/pay/")
+		return fake.checkoutSessions[sessionID]
+	}
+
+	checkoutSession := checkout("")
+	if !checkoutSession.AllowPromotionCodes {
+		t.Errorf("expected promotion codes to be allowed without a coupon")
+	}
+	checkoutSession = checkout("NONEXISTENT")
+	if !checkoutSession.AllowPromotionCodes || checkoutSession.Metadata["coupon"] != "" {
+		t.Errorf("expected an unknown coupon to be ignored")
+	}
+	checkoutSession = checkout("LAUNCH")
+	if checkoutSession.AllowPromotionCodes {
+		t.Errorf("expected promotion codes to be disallowed with a coupon")
+	}
+	if checkoutSession.Metadata["coupon"] != "LAUNCH" {
+		t.Errorf("expected coupon metadata %q, got %q", "LAUNCH", checkoutSession.Metadata["coupon"])
+	}
+	fake.completeCheckout(t, checkoutSession.ID)
+	r := httptest.NewRequest("GET", "http://"+nbrew.CMSDomain+"/stripe/checkout/success/?sessionID="+checkoutSession.ID, nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: sessionToken})
+	w := httptest.NewRecorder()
+	ServeHTTP(nbrew, stripeConfig, false).ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	couponID, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM coupon_redemption WHERE checkout_session_id = {checkoutSessionID}",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", checkoutSession.ID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("coupon_id")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if couponID != "coupon_launch" {
+		t.Errorf("expected redemption of %q, got %q", "coupon_launch", couponID)
+	}
+}
+
+func TestStripeInterval(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+
+	w := serveTestRequest(t, nbrew, "POST", "/stripe/interval/", sessionToken, url.Values{
+		"interval": []string{"year"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("without subscription: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro_yearly")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/interval/", sessionToken, url.Values{
+		"interval": []string{"week"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid interval: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/interval/", sessionToken, url.Values{
+		"interval": []string{"month"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if priceID := subscription.Items.Data[0].Price.ID; priceID != "price_pro" {
+		t.Errorf("expected subscription to be switched to %q, got %q", "price_pro", priceID)
+	}
+	subscriptions, err := getSubscriptions(context.Background(), nbrew, subscription.Customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 || len(subscriptions[0].Items) != 1 || subscriptions[0].Items[0].PriceID != "price_pro" {
+		t.Errorf("expected local subscription to be switched to %q, got %+v", "price_pro", subscriptions)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+	// The metered overage price is not an add-on, and is switched to the
+	// overage price of the new interval along with the plan's price.
+	_, bobSessionToken := createTestUser(t, nbrew, "bob")
+	sessionID = checkout(t, nbrew, bobSessionToken, "price_payg")
+	_, subscription = fake.completeCheckout(t, sessionID)
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, bobSessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/interval/", bobSessionToken, url.Values{
+		"interval": []string{"year"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("overage plan: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	var priceIDs []string
+	for _, item := range subscription.Items.Data {
+		priceIDs = append(priceIDs, item.Price.ID)
+	}
+	if want := []string{"price_payg_yearly", "price_payg_overage_yearly"}; !slices.Equal(priceIDs, want) {
+		t.Errorf("overage plan: expected prices %v, got %v", want, priceIDs)
+	}
+
+	// Add-ons still block the switch.
+	subscription.Items.Data = append(subscription.Items.Data, &stripe.SubscriptionItem{
+		ID:           "si_addon",
+		Price:        &stripe.Price{ID: "price_site"},
+		Quantity:     1,
+		Subscription: subscription.ID,
+	})
+	_, err = saveSubscription(context.Background(), nbrew, subscription, time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/interval/", bobSessionToken, url.Values{
+		"interval": []string{"month"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("with add-on: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestStripeChangePlan(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/changeplan/?priceID=price_business", sessionToken, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("without subscription: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+	// Checking out again must not create a second subscription.
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+		"priceID": []string{"price_business"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("second checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "/stripe/changeplan/?priceID=price_business" {
+		t.Fatalf("second checkout: expected redirect to the change plan page, got %q", location)
+	}
+
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/changeplan/?priceID=price_business&api", sessionToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("preview: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var preview struct {
+		ProrationDate     int64 `json:"prorationDate"`
+		ProrationAmount   int64 `json:"prorationAmount"`
+		NextInvoiceAmount int64 `json:"nextInvoiceAmount"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &preview)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.ProrationAmount != fakeProrationAmount {
+		t.Errorf("preview: expected proration amount %d, got %d", fakeProrationAmount, preview.ProrationAmount)
+	}
+	if preview.NextInvoiceAmount != fakeProrationAmount+fakeRenewalAmount {
+		t.Errorf("preview: expected next invoice amount %d, got %d", fakeProrationAmount+fakeRenewalAmount, preview.NextInvoiceAmount)
+	}
+	if priceID := subscription.Items.Data[0].Price.ID; priceID != "price_pro" {
+		t.Fatalf("preview: expected subscription to be unchanged, got %q", priceID)
+	}
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/changeplan/", sessionToken, url.Values{
+		"priceID": []string{"price_business"},
+	})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/stripe/changeplan/?priceID=price_business" {
+		t.Fatalf("confirm without proration date: expected redirect to the preview, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/changeplan/", sessionToken, url.Values{
+		"priceID":       []string{"price_business"},
+		"prorationDate": []string{strconv.FormatInt(preview.ProrationDate, 10)},
+	})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/users/profile/" {
+		t.Fatalf("confirm: expected redirect to the profile, got %d %q: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	if len(fake.subscriptions) != 1 {
+		t.Errorf("expected 1 subscription, got %d", len(fake.subscriptions))
+	}
+	if len(subscription.Items.Data) != 1 || subscription.Items.Data[0].Price.ID != "price_business" {
+		t.Errorf("expected subscription item to be switched to %q, got %+v", "price_business", subscription.Items.Data)
+	}
+	if prorationDate := fake.prorationDates[subscription.ID]; prorationDate != preview.ProrationDate {
+		t.Errorf("expected proration date %d, got %d", preview.ProrationDate, prorationDate)
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[2])
+
+	// The metered overage item is added and removed along with the plan.
+	for _, test := range []struct {
+		priceID  string
+		priceIDs []string
+	}{
+		{priceID: "price_payg", priceIDs: []string{"price_payg", "price_payg_overage"}},
+		{priceID: "price_business", priceIDs: []string{"price_business"}},
+	} {
+		w = serveTestRequest(t, nbrew, "POST", "/stripe/changeplan/", sessionToken, url.Values{
+			"priceID":       []string{test.priceID},
+			"prorationDate": []string{strconv.FormatInt(preview.ProrationDate, 10)},
+		})
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/users/profile/" {
+			t.Fatalf("%s: expected redirect to the profile, got %d %q: %s", test.priceID, w.Code, w.Header().Get("Location"), w.Body.String())
+		}
+		var priceIDs []string
+		for _, item := range subscription.Items.Data {
+			priceIDs = append(priceIDs, item.Price.ID)
+		}
+		if !slices.Equal(priceIDs, test.priceIDs) {
+			t.Errorf("%s: expected prices %v, got %v", test.priceID, test.priceIDs, priceIDs)
+		}
+	}
+}
+
+func TestStripeInvoices(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	_, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	now := time.Now().Unix()
+	firstInvoice := &stripe.Invoice{
+		ID:               "in_1",
+		Object:           "invoice",
+		Customer:         subscription.Customer,
+		Subscription:     &stripe.Subscription{ID: subscription.ID},
+		Number:           "NB-0001",
+		Status:           stripe.InvoiceStatusPaid,
+		AmountDue:        600,
+		AmountPaid:       600,
+		Currency:         stripe.CurrencyUSD,
+		Created:          now - 2*24*60*60,
+		HostedInvoiceURL: "https://invoice.stripe.com/i/in_1",
+		InvoicePDF:       "https://pay.stripe.com/invoice/in_1/pdf",
+	}
+	w = sendTestEvent(t, nbrew, "evt_1", "invoice.paid", firstInvoice)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("invoice.paid: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	secondInvoice := &stripe.Invoice{
+		ID:           "in_2",
+		Object:       "invoice",
+		Customer:     subscription.Customer,
+		Subscription: &stripe.Subscription{ID: subscription.ID},
+		Number:       "NB-0002",
+		Status:       stripe.InvoiceStatusOpen,
+		AmountDue:    600,
+		Currency:     stripe.CurrencyUSD,
+		Created:      now,
+	}
+	w = sendTestEvent(t, nbrew, "evt_2", "invoice.payment_failed", secondInvoice)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("invoice.payment_failed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Invoices []Invoice `json:"invoices"`
+	}
+	w = serveTestRequest(t, nbrew, "GET", "/users/profile/?api", sessionToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("profile: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Invoices) != 2 {
+		t.Fatalf("expected 2 invoices, got %+v", response.Invoices)
+	}
+	if invoice := response.Invoices[0]; invoice.InvoiceID != "in_2" || invoice.Status != "open" {
+		t.Errorf("expected the failed invoice first, got %+v", invoice)
+	}
+	if invoice := response.Invoices[1]; invoice.InvoiceID != "in_1" || invoice.Status != "paid" || invoice.AmountPaid != 600 || invoice.InvoicePDF != firstInvoice.InvoicePDF {
+		t.Errorf("expected the paid invoice second, got %+v", invoice)
+	}
+
+	// Paying the failed invoice updates it in place.
+	secondInvoice.Status = stripe.InvoiceStatusPaid
+	secondInvoice.AmountPaid = 600
+	w = sendTestEvent(t, nbrew, "evt_3", "invoice.paid", secondInvoice)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("invoice.paid: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	invoices, err := getInvoices(context.Background(), nbrew, subscription.Customer.ID, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 2 || invoices[0].Status != "paid" || invoices[0].AmountPaid != 600 {
+		t.Errorf("expected the second invoice to be paid, got %+v", invoices)
+	}
+}
+
+func TestStripeArchivedPlan(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+
+	// Pretend that the user subscribed to the Legacy plan before it was
+	// archived.
+	subscription.Items.Data[0].Price = &stripe.Price{ID: "price_legacy"}
+	w = sendTestEvent(t, nbrew, "evt_1", "customer.subscription.updated", subscription)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("customer.subscription.updated: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[3])
+
+	var response struct {
+		CurrentPlan struct {
+			Plan Plan `json:"plan"`
+		} `json:"currentPlan"`
+	}
+	w = serveTestRequest(t, nbrew, "GET", "/users/profile/?api", sessionToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("profile: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.CurrentPlan.Plan.Name != "Legacy" || !response.CurrentPlan.Plan.Archived {
+		t.Errorf("expected current plan to be the archived Legacy plan, got %+v", response.CurrentPlan.Plan)
+	}
+
+	var stdout strings.Builder
+	cmd, err := StripeArchivedCommand(nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = &stdout
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "Legacy: 1 user(s)\n" {
+		t.Errorf("expected report %q, got %q", "Legacy: 1 user(s)\n", stdout.String())
+	}
+}
+
+func TestStripeCancel(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	getRetentionOffer := func() *RetentionOffer {
+		t.Helper()
+		w := serveTestRequest(t, nbrew, "GET", "/stripe/cancel/?api", sessionToken, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("cancel page: expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var response struct {
+			RetentionOffer *RetentionOffer `json:"retentionOffer"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.RetentionOffer
+	}
+	if getRetentionOffer() == nil {
+		t.Fatal("expected a retention offer")
+	}
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/cancel/", sessionToken, url.Values{
+		"action": []string{"cancel"},
+		"reason": []string{"bored"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid reason: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Accepting the offer applies the coupon instead of canceling, and the
+	// offer is not shown again.
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/cancel/", sessionToken, url.Values{
+		"action": []string{"acceptOffer"},
+		"reason": []string{"too_expensive"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("accept offer: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if subscription.Discount == nil || subscription.Discount.Coupon.ID != "coupon_retention" {
+		t.Errorf("accept offer: expected coupon %q to be applied, got %+v", "coupon_retention", subscription.Discount)
+	}
+	if subscription.CancelAtPeriodEnd {
+		t.Errorf("accept offer: expected subscription not to be canceled")
+	}
+	if getRetentionOffer() != nil {
+		t.Error("expected the retention offer to be shown only once")
+	}
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/cancel/", sessionToken, url.Values{
+		"action":  []string{"cancel"},
+		"reason":  []string{"unused"},
+		"comment": []string{"  not blogging much these days  "},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("cancel: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if !subscription.CancelAtPeriodEnd {
+		t.Fatal("cancel: expected subscription to be canceled at period end")
+	}
+	if subscription.CancellationDetails == nil || subscription.CancellationDetails.Feedback != "unused" || subscription.CancellationDetails.Comment != "not blogging much these days" {
+		t.Errorf("cancel: unexpected cancellation details %+v", subscription.CancellationDetails)
+	}
+	subscriptions, err := getSubscriptions(context.Background(), nbrew, subscription.Customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].CancelAt.IsZero() {
+		t.Errorf("cancel: expected the local subscription to have a cancellation date, got %+v", subscriptions)
+	}
+	// The plan is kept until the end of the billing period.
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+	w = serveTestRequest(t, nbrew, "POST", "/stripe/cancel/", sessionToken, url.Values{
+		"action": []string{"resume"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("resume: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	if subscription.CancelAtPeriodEnd {
+		t.Error("resume: expected subscription not to be canceled")
+	}
+	statuses, err := sq.FetchAll(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM cancellation ORDER BY reason",
+	}, func(row *sq.Row) string {
+		return row.String("reason") + ":" + row.String("status")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"too_expensive:retained", "unused:resumed"}; !slices.Equal(statuses, expected) {
+		t.Errorf("expected cancellations %q, got %q", expected, statuses)
+	}
+}
+
+func TestStripeOneTimePlan(t *testing.T) {
+	getExpiryTime := func(t *testing.T, nbrew *notebrew.Notebrew, customerID string) time.Time {
+		t.Helper()
+		purchases, err := getPurchases(context.Background(), nbrew, customerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(purchases) == 0 {
+			t.Fatal("expected a paid purchase")
+		}
+		return purchases[0].ExpiryTime
+	}
+
+	t.Run("FixedTerm", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		passPlan := testStripeConfig.Plans[5]
+		sessionID := checkout(t, nbrew, sessionToken, "price_pass")
+		checkoutSession := fake.checkoutSessions[sessionID]
+		if checkoutSession.Mode != stripe.CheckoutSessionModePayment {
+			t.Fatalf("expected a payment mode checkout session, got %q", checkoutSession.Mode)
+		}
+		if checkoutSession.CustomerCreation != stripe.CheckoutSessionCustomerCreationAlways {
+			t.Errorf("expected customer creation %q, got %q", stripe.CheckoutSessionCustomerCreationAlways, checkoutSession.CustomerCreation)
+		}
+
+		// A delayed payment only grants the plan once it succeeds.
+		checkoutSession = fake.completePayment(t, sessionID, false)
+		w := sendTestEvent(t, nbrew, "evt_1", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("checkout.session.completed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+		w = sendTestEvent(t, nbrew, "evt_2", "payment_intent.succeeded", map[string]any{
+			"id":     checkoutSession.PaymentIntent.ID,
+			"object": "payment_intent",
+			"status": "succeeded",
+		})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("payment_intent.succeeded: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), passPlan)
+		customerID := checkoutSession.Customer.ID
+		expiryTime := getExpiryTime(t, nbrew, customerID)
+		if d := time.Until(expiryTime); d < 29*24*time.Hour || d > 30*24*time.Hour {
+			t.Errorf("expected the pass to expire in 30 days, got %s", expiryTime)
+		}
+
+		// Buying the pass again before it expires extends it.
+		sessionID = checkout(t, nbrew, sessionToken, "price_pass")
+		fake.completePayment(t, sessionID, true)
+		w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		if extendedExpiryTime := getExpiryTime(t, nbrew, customerID); !extendedExpiryTime.Equal(expiryTime.AddDate(0, 0, 30)) {
+			t.Errorf("expected the pass to be extended to %s, got %s", expiryTime.AddDate(0, 0, 30), extendedExpiryTime)
+		}
+
+		_, err := sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE purchase SET expiry_time = {expiryTime}",
+			Values: []any{
+				sq.Int64Param("expiryTime", time.Now().Add(-time.Minute).Unix()),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runPurchaseExpiry(context.Background(), nbrew, testStripeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+	})
+
+	t.Run("Lifetime", func(t *testing.T) {
+		nbrew := newTestNotebrew(t)
+		fake := newFakeStripe(t)
+		userID, sessionToken := createTestUser(t, nbrew, "alice")
+		sessionID := checkout(t, nbrew, sessionToken, "price_lifetime")
+		checkoutSession := fake.completePayment(t, sessionID, true)
+		w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[4])
+		if expiryTime := getExpiryTime(t, nbrew, checkoutSession.Customer.ID); !expiryTime.IsZero() {
+			t.Errorf("expected a lifetime plan to never expire, got %s", expiryTime)
+		}
+		// The webhook arriving after the success page changes nothing.
+		w = sendTestEvent(t, nbrew, "evt_1", "checkout.session.completed", checkoutSession)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("checkout.session.completed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[4])
+
+		w = serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+			"priceID": []string{"price_lifetime"},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("buying a lifetime plan twice: expected status %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestStripeTeam(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	_, sessionToken := createTestUser(t, nbrew, "alice")
+	bobID, _ := createTestUser(t, nbrew, "bob")
+	teamPlan := testStripeConfig.Plans[6]
+	w := serveTestRequest(t, nbrew, "POST", "/stripe/checkout/", sessionToken, url.Values{
+		"priceID": []string{"price_team"},
+		"seats":   []string{"3"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	sessionID := strings.TrimPrefix(w.Header().Get("Location"), "https://checkout.stripe.com/c/pay/")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	if quantity := subscription.Items.Data[0].Quantity; quantity != 3 {
+		t.Fatalf("checkout: expected 3 seats, got %d", quantity)
+	}
+	w = serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	customerID := subscription.Customer.ID
+	team := func(action string, values url.Values) int {
+		t.Helper()
+		values.Set("action", action)
+		w := serveTestRequest(t, nbrew, "POST", "/stripe/team/", sessionToken, values)
+		if w.Code != http.StatusSeeOther && w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: unexpected status %d: %s", action, w.Code, w.Body.String())
+		}
+		return w.Code
+	}
+	getSeated := func() []string {
+		t.Helper()
+		members, err := getTeamMembers(context.Background(), nbrew, customerID, subscription.Items.Data[0].Quantity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seated []string
+		for _, member := range members {
+			if member.Seated {
+				seated = append(seated, member.Email)
+			}
+		}
+		return seated
+	}
+
+	// An existing user gets the plan as soon as they are invited, while an
+	// invitee without an account gets an invite that starts them on the plan.
+	if code := team("invite", url.Values{"email": []string{"bob@example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("invite bob: expected status %d, got %d", http.StatusSeeOther, code)
+	}
+	assertPlan(t, getTestUser(t, nbrew, bobID), teamPlan)
+	if code := team("invite", url.Values{"email": []string{"carol@example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("invite carol: expected status %d, got %d", http.StatusSeeOther, code)
+	}
+	siteLimit, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM invite WHERE email = 'carol@example.com'",
+	}, func(row *sq.Row) int64 {
+		return row.Int64("site_limit")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if siteLimit != teamPlan.SiteLimit {
+		t.Errorf("invite carol: expected site limit %d, got %d", teamPlan.SiteLimit, siteLimit)
+	}
+	if code := team("invite", url.Values{"email": []string{"dave@example.com"}}); code != http.StatusBadRequest {
+		t.Errorf("invite with no seats left: expected status %d, got %d", http.StatusBadRequest, code)
+	}
+
+	inviteExists := func(email string) bool {
+		t.Helper()
+		exists, err := sq.FetchExists(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT 1 FROM invite WHERE email = {email}",
+			Values: []any{
+				sq.StringParam("email", email),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	// Reducing seats unseats the most recently invited members first, and
+	// revokes the invites of those who haven't signed up.
+	team("seats", url.Values{"seats": []string{"2"}})
+	if seated, expected := getSeated(), []string{"bob@example.com"}; !slices.Equal(seated, expected) {
+		t.Errorf("2 seats: expected %q to be seated, got %q", expected, seated)
+	}
+	if inviteExists("carol@example.com") {
+		t.Error("2 seats: expected carol's invite to be deleted")
+	}
+	team("seats", url.Values{"seats": []string{"1"}})
+	assertPlan(t, getTestUser(t, nbrew, bobID), testStripeConfig.FreePlan())
+	team("seats", url.Values{"seats": []string{"2"}})
+	assertPlan(t, getTestUser(t, nbrew, bobID), teamPlan)
+
+	// Removing a member who hasn't signed up revokes their invite.
+	if code := team("remove", url.Values{"email": []string{"carol@example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("remove carol: expected status %d, got %d", http.StatusSeeOther, code)
+	}
+	team("seats", url.Values{"seats": []string{"3"}})
+	if code := team("invite", url.Values{"email": []string{"dave@example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("invite dave: expected status %d, got %d", http.StatusSeeOther, code)
+	}
+	if !inviteExists("dave@example.com") {
+		t.Fatal("invite dave: expected an invite")
+	}
+	// Only the team's invite is revoked, not one issued by an admin.
+	_, adminInviteTokenHash, err := createInvite(context.Background(), nbrew, "dave@example.com", Entitlement{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := team("remove", url.Values{"email": []string{"dave@example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("remove dave: expected status %d, got %d", http.StatusSeeOther, code)
+	}
+	inviteTokenHashes, err := sq.FetchAll(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM invite WHERE email = 'dave@example.com'",
+	}, func(row *sq.Row) []byte {
+		return row.Bytes(nil, "invite_token_hash")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inviteTokenHashes) != 1 || !bytes.Equal(inviteTokenHashes[0], adminInviteTokenHash) {
+		t.Errorf("remove dave: expected only the admin's invite to remain, got %d invites", len(inviteTokenHashes))
+	}
+
+	// Members lose the plan along with the subscriber.
+	w = sendTestEvent(t, nbrew, "evt_1", "customer.subscription.deleted", fake.cancelSubscription(t, subscription.ID))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("customer.subscription.deleted: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	assertPlan(t, getTestUser(t, nbrew, bobID), testStripeConfig.FreePlan())
+}
+
+func TestStripeGift(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	_, aliceSessionToken := createTestUser(t, nbrew, "alice")
+	bobID, bobSessionToken := createTestUser(t, nbrew, "bob")
+	businessPlan := testStripeConfig.Plans[2]
+	w := serveTestRequest(t, nbrew, "POST", "/stripe/gift/", aliceSessionToken, url.Values{
+		"priceID":        []string{"price_gift_business"},
+		"recipientEmail": []string{"bob@example.com"},
+	})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("gift: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	sessionID := strings.TrimPrefix(w.Header().Get("Location"), "https://checkout.stripe.com/c/pay/")
+
+	// The voucher is only issued once the payment succeeds.
+	checkoutSession := fake.completePayment(t, sessionID, false)
+	w = sendTestEvent(t, nbrew, "evt_1", "checkout.session.completed", checkoutSession)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("checkout.session.completed: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	voucherCode, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT {*} FROM voucher WHERE checkout_session_id = {checkoutSessionID}",
+		Values: []any{
+			sq.StringParam("checkoutSessionID", sessionID),
+		},
+	}, func(row *sq.Row) string {
+		return row.String("voucher_code")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// redeemCode returns the form errors of the code, if any.
+	redeemCode := func(code string) []string {
+		t.Helper()
+		w := serveTestRequest(t, nbrew, "POST", "/redeem/?api", bobSessionToken, url.Values{
+			"code": []string{code},
+		})
+		var response struct {
+			FormErrors url.Values `json:"formErrors"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("redeem: %v: %s", err, w.Body.String())
+		}
+		return response.FormErrors["code"]
+	}
+	if errs := redeemCode(voucherCode); !slices.Equal(errs, []string{"invalid voucher code"}) {
+		t.Errorf("redeeming an unpaid voucher: expected an invalid voucher code error, got %q", errs)
+	}
+	w = sendTestEvent(t, nbrew, "evt_2", "payment_intent.succeeded", map[string]any{
+		"id":     checkoutSession.PaymentIntent.ID,
+		"object": "payment_intent",
+		"status": "succeeded",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("payment_intent.succeeded: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+
+	// Codes are accepted however they are typed.
+	if errs := redeemCode(strings.ToLower(strings.ReplaceAll(voucherCode, "-", " "))); len(errs) > 0 {
+		t.Fatalf("redeem: unexpected errors %q", errs)
+	}
+	assertPlan(t, getTestUser(t, nbrew, bobID), businessPlan)
+	vouchers, err := getRedeemedVouchers(context.Background(), nbrew, bobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vouchers) != 1 {
+		t.Fatalf("expected 1 redeemed voucher, got %d", len(vouchers))
+	}
+	if expiryTime := vouchers[0].ExpiryTime; time.Until(expiryTime) < 89*24*time.Hour || time.Until(expiryTime) > 93*24*time.Hour {
+		t.Errorf("expected the gift to expire in 3 months, got %s", expiryTime)
+	}
+	if errs := redeemCode(voucherCode); !slices.Equal(errs, []string{"this voucher has already been redeemed"}) {
+		t.Errorf("redeeming a voucher twice: expected an already redeemed error, got %q", errs)
+	}
+
+	_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE voucher SET expiry_time = {expiryTime}",
+		Values: []any{
+			sq.Int64Param("expiryTime", time.Now().Add(-time.Minute).Unix()),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runVoucherExpiry(context.Background(), nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPlan(t, getTestUser(t, nbrew, bobID), testStripeConfig.FreePlan())
+}
+
+func TestStripeCustomerSync(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	checkoutSession, _ := fake.completeCheckout(t, sessionID)
+	w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	customerID := checkoutSession.Customer.ID
+
+	// Customers are synced from the moment they are linked, and customers
+	// linked before syncing existed are treated as synced once initialized,
+	// so neither is overwritten until the user changes something.
+	err := runCustomerSync(context.Background(), nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE customer SET synced_email = NULL, synced_name = NULL",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initCustomerSync(context.Background(), nbrew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCustomerSync(context.Background(), nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates := fake.customerUpdates[customerID]; len(updates) != 0 {
+		t.Fatalf("expected no customer updates, got %+v", updates)
+	}
+
+	_, err = sq.Exec(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "UPDATE users SET email = {email}, username = {username} WHERE user_id = {userID}",
+		Values: []any{
+			sq.StringParam("email", "alice@example.org"),
+			sq.StringParam("username", "alice2"),
+			sq.UUIDParam("userID", userID),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCustomerSync(context.Background(), nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := fake.customerUpdates[customerID]
+	if len(updates) != 1 || updates[0].Email != "alice@example.org" || updates[0].Name != "alice2" {
+		t.Fatalf("expected the customer to be updated with the new email and username, got %+v", updates)
+	}
+	// Nothing has changed since, so Stripe is not called again.
+	err = syncCustomerDetails(context.Background(), nbrew, testStripeConfig, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.customerUpdates[customerID]) != 1 {
+		t.Errorf("expected no further customer updates, got %+v", fake.customerUpdates[customerID])
+	}
+
+	listMismatches := func() string {
+		t.Helper()
+		var stdout strings.Builder
+		cmd, err := StripeCustomersCommand(nbrew, testStripeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Stdout = &stdout
+		err = cmd.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+	w = sendTestEvent(t, nbrew, "evt_1", "customer.updated", stripe.Customer{ID: customerID, Email: "ALICE@example.org"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("customer.updated: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if report := listMismatches(); report != "no mismatched customers\n" {
+		t.Errorf("expected emails differing only in case to match, got %q", report)
+	}
+	w = sendTestEvent(t, nbrew, "evt_2", "customer.updated", stripe.Customer{ID: customerID, Email: "billing@example.com"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("customer.updated: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	expected := customerID + ": user alice2 has email alice@example.org, stripe has billing@example.com\n"
+	if report := listMismatches(); report != expected {
+		t.Errorf("expected report %q, got %q", expected, report)
+	}
+	// The mismatch is left for an admin to resolve rather than overwritten.
+	err = runCustomerSync(context.Background(), nbrew, testStripeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.customerUpdates[customerID]) != 1 {
+		t.Errorf("expected no further customer updates, got %+v", fake.customerUpdates[customerID])
+	}
+}
+
+func TestStripeReconcile(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	userID, sessionToken := createTestUser(t, nbrew, "alice")
+	// The checkout completes without the success page being visited or the
+	// webhook arriving.
+	sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+	_, subscription := fake.completeCheckout(t, sessionID)
+	customerID := subscription.Customer.ID
+	reconcile := func(args ...string) string {
+		t.Helper()
+		var stdout strings.Builder
+		cmd, err := StripeReconcileCommand(nbrew, testStripeConfig, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd.Stdout = &stdout
+		err = cmd.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+
+	// A dry run reports the entitlement of a customer it would link, without
+	// linking it.
+	report := reconcile()
+	for _, expected := range []string{
+		customerID + ": link to user " + userID.String() + "\n",
+		customerID + " (alice@example.com):\n",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("dry run: expected report to contain %q, got %q", expected, report)
+		}
+	}
+	linked, err := sq.FetchExists(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM customer WHERE customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked {
+		t.Error("dry run: expected the customer not to be linked")
+	}
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+
+	reconcile("-apply")
+	assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+}
+
+func TestStripeDunning(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	fake := newFakeStripe(t)
+	mails := make(chan notebrew.Mail, 10)
+	nbrew.Mailer = &notebrew.Mailer{C: mails}
+	t.Cleanup(func() {
+		nbrew.Mailer = nil
+	})
+	// startPastDue subscribes a new user to the Pro plan and fails their
+	// payment, returning their userID and subscriptionID.
+	startPastDue := func(username string) (notebrew.ID, string) {
+		t.Helper()
+		userID, sessionToken := createTestUser(t, nbrew, username)
+		sessionID := checkout(t, nbrew, sessionToken, "price_pro")
+		_, subscription := fake.completeCheckout(t, sessionID)
+		w := serveTestRequest(t, nbrew, "GET", "/stripe/checkout/success/?sessionID="+sessionID, sessionToken, nil)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("checkout success: expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+		subscription.Status = stripe.SubscriptionStatusPastDue
+		w = sendTestEvent(t, nbrew, "evt_"+username, "customer.subscription.updated", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("customer.subscription.updated: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		return userID, subscription.ID
+	}
+	// endGracePeriod moves the start of a subscription's dunning back past
+	// the default grace period.
+	endGracePeriod := func(subscriptionID string) {
+		t.Helper()
+		_, err := sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE dunning SET start_time = {startTime} WHERE subscription_id = {subscriptionID}",
+			Values: []any{
+				sq.Int64Param("startTime", time.Now().AddDate(0, 0, -15).Unix()),
+				sq.StringParam("subscriptionID", subscriptionID),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	receivedMails := func() []string {
+		t.Helper()
+		var subjects []string
+		for {
+			select {
+			case mail := <-mails:
+				subjects = append(subjects, mail.RcptTo+": "+mail.Headers[1])
+			default:
+				return subjects
+			}
+		}
+	}
+
+	t.Run("Downgrade", func(t *testing.T) {
+		userID, subscriptionID := startPastDue("alice")
+		// The user keeps their plan during the grace period, and is reminded
+		// once per reminder interval.
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+		for i := 0; i < 2; i++ {
+			err := runDunning(context.Background(), nbrew, testStripeConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := []string{"alice@example.com: Your notebrew subscription payment failed"}
+		if subjects := receivedMails(); !slices.Equal(subjects, expected) {
+			t.Errorf("grace period: expected mails %q, got %q", expected, subjects)
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+
+		endGracePeriod(subscriptionID)
+		err := runDunning(context.Background(), nbrew, testStripeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.FreePlan())
+		expected = []string{"alice@example.com: Your notebrew subscription payment is overdue"}
+		if subjects := receivedMails(); !slices.Equal(subjects, expected) {
+			t.Errorf("grace period over: expected mails %q, got %q", expected, subjects)
+		}
+		// The dunning has ended, so there is nothing left to do.
+		err = runDunning(context.Background(), nbrew, testStripeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subjects := receivedMails(); len(subjects) != 0 {
+			t.Errorf("after dunning: expected no mails, got %q", subjects)
+		}
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		stripeConfig := testStripeConfig
+		stripeConfig.Dunning.Action = "disable"
+		userID, subscriptionID := startPastDue("bob")
+		endGracePeriod(subscriptionID)
+		err := runDunning(context.Background(), nbrew, stripeConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receivedMails()
+		disableReason, err := sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM users WHERE user_id = {userID}",
+			Values: []any{
+				sq.UUIDParam("userID", userID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("disable_reason")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disableReason != dunningDisableReason {
+			t.Errorf("expected disable reason %q, got %q", dunningDisableReason, disableReason)
+		}
+
+		// Paying re-enables the account.
+		subscription := fake.subscriptions[subscriptionID]
+		subscription.Status = stripe.SubscriptionStatusActive
+		w := sendTestEvent(t, nbrew, "evt_bob_paid", "customer.subscription.updated", subscription)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("customer.subscription.updated: expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+		}
+		disableReason, err = sq.FetchOne(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM users WHERE user_id = {userID}",
+			Values: []any{
+				sq.UUIDParam("userID", userID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("disable_reason")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disableReason != "" {
+			t.Errorf("expected the account to be re-enabled, got disable reason %q", disableReason)
+		}
+		assertPlan(t, getTestUser(t, nbrew, userID), testStripeConfig.Plans[1])
+	})
+}
+
+func TestSiteLimit(t *testing.T) {
+	nbrew := newTestNotebrew(t)
+	aliceID, aliceToken := createTestUser(t, nbrew, "alice")
+	bobID, _ := createTestUser(t, nbrew, "bob")
+	exec := func(format string, values ...any) {
+		t.Helper()
+		_, err := sq.Exec(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  format,
+			Values:  values,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createSite := func(siteName string, storageUsed, lastWriteTime int64, ownerIDs ...notebrew.ID) {
+		t.Helper()
+		siteID := notebrew.NewID()
+		exec("INSERT INTO site (site_id, site_name, storage_used) VALUES ({siteID}, {siteName}, {storageUsed})",
+			sq.UUIDParam("siteID", siteID),
+			sq.StringParam("siteName", siteName),
+			sq.Int64Param("storageUsed", storageUsed),
+		)
+		for _, ownerID := range ownerIDs {
+			exec("INSERT INTO site_owner (site_id, user_id) VALUES ({siteID}, {userID})",
+				sq.UUIDParam("siteID", siteID),
+				sq.UUIDParam("userID", ownerID),
+			)
+		}
+		if lastWriteTime > 0 {
+			exec("INSERT INTO site_activity (site_name, last_write_time) VALUES ({siteName}, {lastWriteTime})",
+				sq.StringParam("siteName", siteName),
+				sq.Int64Param("lastWriteTime", lastWriteTime),
+			)
+		}
+	}
+	deleteSite := func(siteName string) {
+		t.Helper()
+		exec("DELETE FROM site_owner WHERE site_id = (SELECT site_id FROM site WHERE site_name = {siteName})",
+			sq.StringParam("siteName", siteName),
+		)
+		exec("DELETE FROM site WHERE site_name = {siteName}",
+			sq.StringParam("siteName", siteName),
+		)
+	}
+	lockedSites := func(userID notebrew.ID) []string {
+		t.Helper()
+		siteNames, err := sq.FetchAll(context.Background(), nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "SELECT {*} FROM site_lock WHERE user_id = {userID} ORDER BY site_name",
+			Values: []any{
+				sq.UUIDParam("userID", userID),
+			},
+		}, func(row *sq.Row) string {
+			return row.String("site_name")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return siteNames
+	}
+
+	// The least recently updated sites are locked first, and a site that was
+	// never written to counts as the least recently updated.
+	createSite("alpha", 0, 200, aliceID, bobID)
+	createSite("bravo", 0, 0, aliceID)
+	createSite("charlie", 0, 300, aliceID)
+	createSite("delta", 0, 100, aliceID)
+	exec("UPDATE users SET site_limit = 2 WHERE user_id = {userID}", sq.UUIDParam("userID", aliceID))
+	err := enforceSiteLimit(context.Background(), nbrew, aliceID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lockedSites(aliceID), []string{"bravo", "delta"}; !slices.Equal(got, want) {
+		t.Fatalf("expected locked sites %v, got %v", want, got)
+	}
+	w := serveTestRequest(t, nbrew, "POST", "/files/@delta/createfile/", aliceToken, url.Values{"name": {"hello"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("createfile on a locked site: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// A lock only applies to the owner who is over their site limit.
+	err = enforceSiteLimit(context.Background(), nbrew, bobID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec("UPDATE site_activity SET last_write_time = 0 WHERE site_name = 'alpha'")
+	err = enforceSiteLimit(context.Background(), nbrew, aliceID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := siteLocked(context.Background(), nbrew, "alpha", aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Errorf("expected alpha to be locked for alice")
+	}
+	locked, err = siteLocked(context.Background(), nbrew, "alpha", bobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Errorf("expected alpha not to be locked for bob, who is within his site limit")
+	}
+
+	// Deleting sites to get back within the site limit unlocks the rest
+	// straight away, and clears the locks of the deleted sites.
+	deleteSite("alpha")
+	deleteSite("bravo")
+	err = enforceSiteLimitsAfterDelete(context.Background(), nbrew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lockedSites(aliceID); len(got) != 0 {
+		t.Errorf("expected no locked sites after deleting down to the site limit, got %v", got)
+	}
+
+	// A new site created with the name of a deleted site does not inherit
+	// its lock or its activity.
+	exec("INSERT INTO site_lock (site_name, user_id, lock_time) VALUES ('bravo', {userID}, 1)", sq.UUIDParam("userID", bobID))
+	err = enforceSiteLimitsAfterDelete(context.Background(), nbrew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createSite("bravo", 0, 0, bobID)
+	locked, err = siteLocked(context.Background(), nbrew, "bravo", bobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Errorf("expected a new site named bravo not to be locked")
+	}
+	exists, err := sq.FetchExists(context.Background(), nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format:  "SELECT 1 FROM site_activity WHERE site_name = 'alpha'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("expected the activity of the deleted site alpha to be cleared")
+	}
+
+	// Uploads are blocked once any owner is over their storage limit.
+	exec("UPDATE users SET storage_limit = 100 WHERE user_id = {userID}", sq.UUIDParam("userID", aliceID))
+	exec("UPDATE site SET storage_used = 150 WHERE site_name = 'charlie'")
+	exceeded, err := storageExceeded(context.Background(), nbrew, "charlie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exceeded {
+		t.Errorf("expected storage to be exceeded")
+	}
+	w = serveTestRequest(t, nbrew, "POST", "/files/@charlie/uploadfile/", aliceToken, url.Values{})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("uploadfile over the storage limit: expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	exec("UPDATE site SET storage_used = 50 WHERE site_name = 'charlie'")
+	exceeded, err = storageExceeded(context.Background(), nbrew, "charlie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exceeded {
+		t.Errorf("expected storage not to be exceeded")
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/notebrew/stacktrace"
+	"github.com/stripe/stripe-go/v79"
+)
+
+type Command interface {
+	Run() error
+}
+
+func StripeCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (Command, error) {
+	if nbrew.DB == nil {
+		return nil, fmt.Errorf("no database configured: to fix, run `notebrew config database.dialect sqlite`")
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing subcommand (archived, coupons, customers, plans, reconcile, replay)")
+	}
+	if stripeConfig.Provider == "manual" && args[0] != "archived" {
+		return nil, fmt.Errorf("%s: not available with the manual provider (see `notebrew billing`)", args[0])
+	}
+	switch args[0] {
+	case "archived":
+		cmd, err := StripeArchivedCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "coupons":
+		cmd, err := StripeCouponsCommand(nbrew, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "customers":
+		cmd, err := StripeCustomersCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "plans":
+		cmd, err := StripePlansCommand(stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "reconcile":
+		cmd, err := StripeReconcileCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	case "replay":
+		cmd, err := StripeReplayCommand(nbrew, stripeConfig, args[1:]...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", args[0], err)
+		}
+		return cmd, nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+}
+
+type StripeArchivedCmd struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+}
+
+func StripeArchivedCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*StripeArchivedCmd, error) {
+	var cmd StripeArchivedCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe archived
+Reports how many users remain subscribed to each archived plan.`)
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagset.Args(), " "))
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripeArchivedCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	type Row struct {
+		UserID notebrew.ID
+		Status string
+		Items  []SubscriptionItem
+	}
+	var archivedPlans []Plan
+	for _, plan := range cmd.StripeConfig.Plans {
+		if plan.Archived {
+			archivedPlans = append(archivedPlans, plan)
+		}
+	}
+	if len(archivedPlans) == 0 {
+		fmt.Fprintln(cmd.Stdout, "no archived plans")
+		return nil
+	}
+	rows, err := sq.FetchAll(context.Background(), cmd.Notebrew.DB, sq.Query{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM subscription" +
+			" JOIN customer ON customer.customer_id = subscription.customer_id",
+	}, func(row *sq.Row) Row {
+		result := Row{
+			UserID: row.UUID("customer.user_id"),
+			Status: row.String("subscription.status"),
+		}
+		b := row.Bytes(nil, "subscription.items")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &result.Items)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return result
+	})
+	if err != nil {
+		return err
+	}
+	users := make(map[string]map[notebrew.ID]bool)
+	for _, row := range rows {
+		if !entitled(row.Status, false) {
+			continue
+		}
+		for _, item := range row.Items {
+			plan, ok := cmd.StripeConfig.PlanByPriceID(item.PriceID)
+			if !ok || !plan.Archived {
+				continue
+			}
+			if users[plan.Name] == nil {
+				users[plan.Name] = make(map[notebrew.ID]bool)
+			}
+			users[plan.Name][row.UserID] = true
+		}
+	}
+	for _, plan := range archivedPlans {
+		fmt.Fprintf(cmd.Stdout, "%s: %d user(s)\n", plan.Name, len(users[plan.Name]))
+	}
+	return nil
+}
+
+type StripeCouponsCmd struct {
+	Notebrew *notebrew.Notebrew
+	Stdout   io.Writer
+	Since    time.Time
+}
+
+func StripeCouponsCommand(nbrew *notebrew.Notebrew, args ...string) (*StripeCouponsCmd, error) {
+	var cmd StripeCouponsCmd
+	cmd.Notebrew = nbrew
+	var since string
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.StringVar(&since, "since", "", "Only count redemptions on or after this date (YYYY-MM-DD).")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe coupons [FLAGS]
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagset.Args(), " "))
+	}
+	if since != "" {
+		cmd.Since, err = time.Parse("2006-01-02", since)
+		if err != nil {
+			return nil, fmt.Errorf("-since: %w", err)
+		}
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripeCouponsCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	type Redemptions struct {
+		CouponCode      string
+		CouponID        string
+		PromotionCodeID string
+		Currency        string
+		Count           int64
+		AmountDiscount  int64
+	}
+	redemptions, err := sq.FetchAll(context.Background(), cmd.Notebrew.DB, sq.Query{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM coupon_redemption" +
+			" WHERE redemption_time >= {since}" +
+			" GROUP BY coupon_code, coupon_id, promotion_code_id, currency" +
+			" ORDER BY count(*) DESC",
+		Values: []any{
+			sq.Int64Param("since", cmd.Since.Unix()),
+		},
+	}, func(row *sq.Row) Redemptions {
+		return Redemptions{
+			CouponCode:      row.String("coupon_code"),
+			CouponID:        row.String("coupon_id"),
+			PromotionCodeID: row.String("promotion_code_id"),
+			Currency:        row.String("currency"),
+			Count:           row.Int64("count(*)"),
+			AmountDiscount:  row.Int64("sum(amount_discount)"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(redemptions) == 0 {
+		fmt.Fprintln(cmd.Stdout, "no redemptions")
+		return nil
+	}
+	for _, redemption := range redemptions {
+		var names []string
+		if redemption.CouponCode != "" {
+			names = append(names, "code="+redemption.CouponCode)
+		}
+		if redemption.CouponID != "" {
+			names = append(names, "coupon="+redemption.CouponID)
+		}
+		if redemption.PromotionCodeID != "" {
+			names = append(names, "promotion_code="+redemption.PromotionCodeID)
+		}
+		if len(names) == 0 {
+			names = append(names, "(unknown)")
+		}
+		fmt.Fprintf(cmd.Stdout, "%s: %d redemption(s), %d.%02d %s discounted\n",
+			strings.Join(names, " "),
+			redemption.Count,
+			redemption.AmountDiscount/100,
+			redemption.AmountDiscount%100,
+			strings.ToUpper(redemption.Currency),
+		)
+	}
+	return nil
+}
+
+type StripeCustomersCmd struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+	CustomerIDs  []string
+}
+
+func StripeCustomersCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*StripeCustomersCmd, error) {
+	var cmd StripeCustomersCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe customers
+  notebrew stripe customers [CUSTOMER_ID...]
+Lists the Stripe customers whose email does not match the email of their user.
+If customer IDs are given, their user's email and username are pushed to
+Stripe instead.`)
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	cmd.CustomerIDs = flagset.Args()
+	if len(cmd.CustomerIDs) > 0 && stripeConfig.SecretKey == "" {
+		return nil, fmt.Errorf("stripe.json: secretKey not set")
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripeCustomersCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if len(cmd.CustomerIDs) > 0 {
+		for _, customerID := range cmd.CustomerIDs {
+			userID, err := sq.FetchOne(context.Background(), cmd.Notebrew.DB, sq.Query{
+				Dialect: cmd.Notebrew.Dialect,
+				Format:  "SELECT {*} FROM customer WHERE customer_id = {customerID}",
+				Values: []any{
+					sq.StringParam("customerID", customerID),
+				},
+			}, func(row *sq.Row) notebrew.ID {
+				return row.UUID("user_id")
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", customerID, err)
+			}
+			// Forget what was last synced so that syncCustomerDetails pushes
+			// the user's details even though they haven't changed.
+			_, err = sq.Exec(context.Background(), cmd.Notebrew.DB, sq.Query{
+				Dialect: cmd.Notebrew.Dialect,
+				Format:  "UPDATE customer SET synced_email = NULL, synced_name = NULL WHERE customer_id = {customerID}",
+				Values: []any{
+					sq.StringParam("customerID", customerID),
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", customerID, err)
+			}
+			err = syncCustomerDetails(context.Background(), cmd.Notebrew, cmd.StripeConfig, userID)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.Stdout, "%s: synced\n", customerID)
+		}
+		return nil
+	}
+	type Mismatch struct {
+		CustomerID  string
+		Username    string
+		Email       string
+		StripeEmail string
+	}
+	mismatches, err := sq.FetchAll(context.Background(), cmd.Notebrew.DB, sq.Query{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM customer" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE customer.stripe_email IS NOT NULL" +
+			" AND lower(customer.stripe_email) <> lower(users.email)" +
+			" ORDER BY customer.event_time",
+	}, func(row *sq.Row) Mismatch {
+		return Mismatch{
+			CustomerID:  row.String("customer.customer_id"),
+			Username:    row.String("users.username"),
+			Email:       row.String("users.email"),
+			StripeEmail: row.String("customer.stripe_email"),
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(mismatches) == 0 {
+		fmt.Fprintln(cmd.Stdout, "no mismatched customers")
+		return nil
+	}
+	for _, mismatch := range mismatches {
+		fmt.Fprintf(cmd.Stdout, "%s: user %s has email %s, stripe has %s\n", mismatch.CustomerID, mismatch.Username, mismatch.Email, mismatch.StripeEmail)
+	}
+	return nil
+}
+
+type StripeReplayCmd struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+	Failed       bool
+	EventIDs     []string
+}
+
+func StripeReplayCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*StripeReplayCmd, error) {
+	var cmd StripeReplayCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.BoolVar(&cmd.Failed, "failed", false, "Replay all events that failed processing.")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe replay [FLAGS] [EVENT_ID...]
+  notebrew stripe replay -failed
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	cmd.EventIDs = flagset.Args()
+	if !cmd.Failed && len(cmd.EventIDs) == 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("no events specified: provide event IDs or use -failed")
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripeReplayCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	type Event struct {
+		EventID string
+		Payload string
+	}
+	var events []Event
+	rowmapper := func(row *sq.Row) Event {
+		return Event{
+			EventID: row.String("event_id"),
+			Payload: row.String("payload"),
+		}
+	}
+	if cmd.Failed {
+		failedEvents, err := sq.FetchAll(context.Background(), cmd.Notebrew.DB, sq.Query{
+			Dialect: cmd.Notebrew.Dialect,
+			Format:  "SELECT {*} FROM stripe_event WHERE status <> 'processed' ORDER BY creation_time",
+		}, rowmapper)
+		if err != nil {
+			return err
+		}
+		events = append(events, failedEvents...)
+	}
+	for _, eventID := range cmd.EventIDs {
+		event, err := sq.FetchOne(context.Background(), cmd.Notebrew.DB, sq.Query{
+			Dialect: cmd.Notebrew.Dialect,
+			Format:  "SELECT {*} FROM stripe_event WHERE event_id = {eventID}",
+			Values: []any{
+				sq.StringParam("eventID", eventID),
+			},
+		}, rowmapper)
+		if err != nil {
+			return fmt.Errorf("%s: %w", eventID, err)
+		}
+		events = append(events, event)
+	}
+	var failed []string
+	for _, event := range events {
+		var stripeEvent stripe.Event
+		err := json.Unmarshal([]byte(event.Payload), &stripeEvent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", event.EventID, err)
+		}
+		err = processStripeEvent(context.Background(), cmd.Notebrew, cmd.StripeConfig.ForLivemode(stripeEvent.Livemode), stripeEvent)
+		if err != nil {
+			failed = append(failed, event.EventID)
+			fmt.Fprintf(cmd.Stdout, "%s %s: failed: %v\n", stripeEvent.ID, stripeEvent.Type, err)
+			continue
+		}
+		fmt.Fprintf(cmd.Stdout, "%s %s: processed\n", stripeEvent.ID, stripeEvent.Type)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d event(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type StripePlansCmd struct {
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+}
+
+func StripePlansCommand(stripeConfig StripeConfig, args ...string) (*StripePlansCmd, error) {
+	var cmd StripePlansCmd
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe plans
+Fetches the plans described by Stripe product metadata, validates them and
+prints them in the same format as the plans in stripe.json.`)
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagset.Args(), " "))
+	}
+	if stripeConfig.SecretKey == "" {
+		return nil, fmt.Errorf("stripe.json: secretKey not set")
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripePlansCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	plans, err := fetchStripePlans(cmd.StripeConfig.Client())
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(cmd.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(plans)
+}
+
+type StripeReconcileCmd struct {
+	Notebrew     *notebrew.Notebrew
+	StripeConfig StripeConfig
+	Stdout       io.Writer
+	Apply        bool
+}
+
+func StripeReconcileCommand(nbrew *notebrew.Notebrew, stripeConfig StripeConfig, args ...string) (*StripeReconcileCmd, error) {
+	var cmd StripeReconcileCmd
+	cmd.Notebrew = nbrew
+	cmd.StripeConfig = stripeConfig
+	flagset := flag.NewFlagSet("", flag.ContinueOnError)
+	flagset.BoolVar(&cmd.Apply, "apply", false, "Apply the changes (without this flag the changes are only printed).")
+	flagset.Usage = func() {
+		fmt.Fprintln(flagset.Output(), `Usage:
+  notebrew stripe reconcile [FLAGS]
+Flags:`)
+		flagset.PrintDefaults()
+	}
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagset.NArg() > 0 {
+		flagset.Usage()
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flagset.Args(), " "))
+	}
+	if stripeConfig.SecretKey == "" {
+		return nil, fmt.Errorf("stripe.json: secretKey not set")
+	}
+	return &cmd, nil
+}
+
+func (cmd *StripeReconcileCmd) Run() error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	type Customer struct {
+		CustomerID   string
+		Livemode     bool
+		UserID       notebrew.ID
+		Email        string
+		SiteLimit    int64
+		StorageLimit int64
+		UserFlags    map[string]bool
+	}
+	ctx := context.Background()
+	customerFromUser := func(row *sq.Row) Customer {
+		customer := Customer{
+			UserID:       row.UUID("users.user_id"),
+			Email:        row.String("users.email"),
+			SiteLimit:    row.Int64("coalesce(users.site_limit, -1)"),
+			StorageLimit: row.Int64("coalesce(users.storage_limit, -1)"),
+		}
+		b := row.Bytes(nil, "users.user_flags")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &customer.UserFlags)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return customer
+	}
+	stripeSubscriptions := make(map[string][]*stripe.Subscription)
+	fetchTime := time.Now().Unix()
+	// Test mode subscriptions can only be listed with the test mode key.
+	stripeConfigs := []StripeConfig{cmd.StripeConfig}
+	if cmd.StripeConfig.Test != nil && cmd.StripeConfig.Test.SecretKey != "" {
+		stripeConfigs = append(stripeConfigs, *cmd.StripeConfig.Test)
+	}
+	for _, stripeConfig := range stripeConfigs {
+		iter := stripeConfig.Client().Subscriptions.List(&stripe.SubscriptionListParams{
+			Status: stripe.String("all"),
+		})
+		for iter.Next() {
+			stripeSubscription := iter.Subscription()
+			if stripeSubscription.Customer == nil {
+				continue
+			}
+			customerID := stripeSubscription.Customer.ID
+			stripeSubscriptions[customerID] = append(stripeSubscriptions[customerID], stripeSubscription)
+		}
+		err := iter.Err()
+		if err != nil {
+			return err
+		}
+	}
+	// Link customers whose checkout session completed without us finding out
+	// about it, using the userID that stripeCheckout attached to the
+	// subscription. A dry run doesn't link them, so they are kept aside to
+	// be reported along with the linked customers.
+	var unlinkedCustomers []Customer
+	for customerID, subscriptions := range stripeSubscriptions {
+		linked, err := sq.FetchExists(ctx, cmd.Notebrew.DB, sq.Query{
+			Dialect: cmd.Notebrew.Dialect,
+			Format:  "SELECT 1 FROM customer WHERE customer_id = {customerID}",
+			Values: []any{
+				sq.StringParam("customerID", customerID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if linked {
+			continue
+		}
+		var userIDString string
+		for _, subscription := range subscriptions {
+			if subscription.Metadata["userID"] != "" {
+				userIDString = subscription.Metadata["userID"]
+				break
+			}
+		}
+		if userIDString == "" {
+			fmt.Fprintf(cmd.Stdout, "%s: customer is not linked to any user\n", customerID)
+			continue
+		}
+		userID, err := notebrew.ParseID(userIDString)
+		if err != nil {
+			fmt.Fprintf(cmd.Stdout, "%s: invalid userID %q in subscription metadata\n", customerID, userIDString)
+			continue
+		}
+		fmt.Fprintf(cmd.Stdout, "%s: link to user %s\n", customerID, userID.String())
+		if !cmd.Apply {
+			unlinkedCustomers = append(unlinkedCustomers, Customer{CustomerID: customerID, Livemode: subscriptions[0].Livemode, UserID: userID})
+			continue
+		}
+		err = linkCustomer(ctx, cmd.Notebrew, customerID, userID, subscriptions[0].Livemode)
+		if err != nil {
+			return err
+		}
+	}
+	customers, err := sq.FetchAll(ctx, cmd.Notebrew.DB, sq.Query{
+		Dialect: cmd.Notebrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM customer" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" ORDER BY customer.customer_id",
+	}, func(row *sq.Row) Customer {
+		customer := customerFromUser(row)
+		customer.CustomerID = row.String("customer.customer_id")
+		customer.Livemode = !row.Bool("customer.test_mode")
+		return customer
+	})
+	if err != nil {
+		return err
+	}
+	for _, unlinkedCustomer := range unlinkedCustomers {
+		customer, err := sq.FetchOne(ctx, cmd.Notebrew.DB, sq.Query{
+			Dialect: cmd.Notebrew.Dialect,
+			Format:  "SELECT {*} FROM users WHERE users.user_id = {userID}",
+			Values: []any{
+				sq.UUIDParam("userID", unlinkedCustomer.UserID),
+			},
+		}, customerFromUser)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				fmt.Fprintf(cmd.Stdout, "%s: user %s does not exist\n", unlinkedCustomer.CustomerID, unlinkedCustomer.UserID.String())
+				continue
+			}
+			return err
+		}
+		customer.CustomerID = unlinkedCustomer.CustomerID
+		customer.Livemode = unlinkedCustomer.Livemode
+		customers = append(customers, customer)
+	}
+	slices.SortFunc(customers, func(a, b Customer) int {
+		return strings.Compare(a.CustomerID, b.CustomerID)
+	})
+	for _, customer := range customers {
+		var subscriptions []Subscription
+		for _, stripeSubscription := range stripeSubscriptions[customer.CustomerID] {
+			subscriptions = append(subscriptions, newSubscription(stripeSubscription))
+		}
+		// Test mode customers are subscribed to the prices of the test mode
+		// plans.
+		stripeConfig := cmd.StripeConfig.ForLivemode(customer.Livemode)
+		entitlement, err := resolveEntitlement(ctx, cmd.Notebrew, stripeConfig, customer.UserID, customer.CustomerID, subscriptions)
+		if err != nil {
+			return err
+		}
+		var diff []string
+		if customer.SiteLimit != entitlement.SiteLimit {
+			diff = append(diff, fmt.Sprintf("site_limit: %d => %d", customer.SiteLimit, entitlement.SiteLimit))
+		}
+		if customer.StorageLimit != entitlement.StorageLimit {
+			diff = append(diff, fmt.Sprintf("storage_limit: %d => %d", customer.StorageLimit, entitlement.StorageLimit))
+		}
+		names := make([]string, 0, len(entitlement.UserFlags))
+		for name := range entitlement.UserFlags {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if customer.UserFlags[name] != entitlement.UserFlags[name] {
+				diff = append(diff, fmt.Sprintf("user_flags.%s: %t => %t", name, customer.UserFlags[name], entitlement.UserFlags[name]))
+			}
+		}
+		if len(diff) > 0 {
+			fmt.Fprintf(cmd.Stdout, "%s (%s):\n", customer.CustomerID, customer.Email)
+			for _, line := range diff {
+				fmt.Fprintf(cmd.Stdout, "  %s\n", line)
+			}
+		}
+		if !cmd.Apply {
+			continue
+		}
+		for _, stripeSubscription := range stripeSubscriptions[customer.CustomerID] {
+			_, err := saveSubscription(ctx, cmd.Notebrew, stripeSubscription, fetchTime)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = syncEntitlement(ctx, cmd.Notebrew, stripeConfig, customer.UserID)
+		if err != nil {
+			return err
+		}
+		err = syncTeamEntitlements(ctx, cmd.Notebrew, stripeConfig, customer.CustomerID)
+		if err != nil {
+			return err
+		}
+	}
+	if !cmd.Apply {
+		fmt.Fprintln(cmd.Stdout, "(dry run: rerun with -apply to apply these changes)")
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/stripe/stripe-go/v79"
+)
+
+// TeamMember is a user invited by email to share the per-seat plan of a
+// customer. An email can only be a member of one team at a time.
+type TeamMember struct {
+	Email      string    `json:"email"`
+	CustomerID string    `json:"customerID"`
+	InviteTime time.Time `json:"inviteTime"`
+	// Joined reports whether a user with the member's email exists, as
+	// opposed to an invitee who has yet to sign up.
+	Joined bool `json:"joined"`
+	// Seated reports whether the member holds one of the seats paid for,
+	// which is what entitles them to the plan.
+	Seated bool `json:"seated"`
+	// InviteTokenHash identifies the invite sent to a member who had yet to
+	// sign up when they were invited.
+	InviteTokenHash []byte `json:"-"`
+}
+
+// getTeamMembers returns the members of a customer's team, given the number
+// of seats paid for. Members are seated in the order they were invited (after
+// the subscriber, who takes up the first seat), so that if the number of
+// seats is reduced the most recently invited members lose their seat first.
+func getTeamMembers(ctx context.Context, nbrew *notebrew.Notebrew, customerID string, seats int64) ([]TeamMember, error) {
+	members, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM team_member" +
+			" LEFT JOIN users ON users.email = team_member.email" +
+			" WHERE team_member.customer_id = {customerID}" +
+			" ORDER BY team_member.invite_time, team_member.email",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) TeamMember {
+		return TeamMember{
+			Email:           row.String("team_member.email"),
+			CustomerID:      row.String("team_member.customer_id"),
+			InviteTime:      time.Unix(row.Int64("team_member.invite_time"), 0).UTC(),
+			Joined:          row.String("users.email") != "",
+			InviteTokenHash: row.Bytes(nil, "team_member.invite_token_hash"),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		members[i].Seated = int64(i) < seats-1
+	}
+	return members, nil
+}
+
+// getTeamSubscription returns the per-seat subscription that a user holds a
+// seat on as a team member, reduced to the item of its plan so that members
+// inherit the plan but not the subscriber's add-ons. The returned ok is false
+// if the user is not seated on any team.
+func getTeamSubscription(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, userID notebrew.ID) (teamSubscription Subscription, ok bool, err error) {
+	member, err := sq.FetchOne(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM team_member" +
+			" JOIN users ON users.email = team_member.email" +
+			" WHERE users.user_id = {userID}",
+		Values: []any{
+			sq.UUIDParam("userID", userID),
+		},
+	}, func(row *sq.Row) TeamMember {
+		return TeamMember{
+			Email:      row.String("team_member.email"),
+			CustomerID: row.String("team_member.customer_id"),
+		}
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Subscription{}, false, nil
+		}
+		return Subscription{}, false, err
+	}
+	subscription, item, plan, ok, err := getPlanSubscription(ctx, nbrew, stripeConfig, member.CustomerID)
+	if err != nil {
+		return Subscription{}, false, err
+	}
+	if !ok || !plan.PerSeat {
+		return Subscription{}, false, nil
+	}
+	members, err := getTeamMembers(ctx, nbrew, member.CustomerID, item.Quantity)
+	if err != nil {
+		return Subscription{}, false, err
+	}
+	for _, teamMember := range members {
+		if teamMember.Email == member.Email && teamMember.Seated {
+			subscription.Items = []SubscriptionItem{item}
+			return subscription, true, nil
+		}
+	}
+	return Subscription{}, false, nil
+}
+
+// syncTeamEntitlements syncs the entitlement of every member of a customer's
+// team who has signed up. It is called whenever the subscriber's plan or
+// number of seats may have changed.
+//
+// Invitees who have yet to sign up were sent an invite carrying the team's
+// plan, so the invites of those who no longer have a seat are revoked.
+func syncTeamEntitlements(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig, customerID string) error {
+	var seats int64
+	_, item, plan, ok, err := getPlanSubscription(ctx, nbrew, stripeConfig, customerID)
+	if err != nil {
+		return err
+	}
+	if ok && plan.PerSeat {
+		seats = item.Quantity
+	}
+	members, err := getTeamMembers(ctx, nbrew, customerID, seats)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Joined || member.Seated || len(member.InviteTokenHash) == 0 {
+			continue
+		}
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "DELETE FROM invite WHERE invite_token_hash = {inviteTokenHash}",
+			Values: []any{
+				sq.BytesParam("inviteTokenHash", member.InviteTokenHash),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	userIDs, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM team_member" +
+			" JOIN users ON users.email = team_member.email" +
+			" WHERE team_member.customer_id = {customerID}",
+		Values: []any{
+			sq.StringParam("customerID", customerID),
+		},
+	}, func(row *sq.Row) notebrew.ID {
+		return row.UUID("users.user_id")
+	})
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		_, err := syncEntitlement(ctx, nbrew, stripeConfig, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripeTeam lets the subscriber of a per-seat plan manage their team. A GET
+// request lists the seats and members, and a POST request either invites a
+// member by email (action=invite), removes a member (action=remove) or
+// changes the number of seats (action=seats). Members who lose their seat,
+// whether removed or pushed out by a reduction in seats, revert to whatever
+// else they are entitled to.
+func stripeTeam(nbrew *notebrew.Notebrew, w http.ResponseWriter, r *http.Request, user User, stripeConfig StripeConfig) {
+	type Response struct {
+		UserID                notebrew.ID    `json:"userID"`
+		Username              string         `json:"username"`
+		TimezoneOffsetSeconds int            `json:"timezoneOffsetSeconds"`
+		DisableReason         string         `json:"disableReason"`
+		Plan                  Plan           `json:"plan"`
+		Seats                 int64          `json:"seats"`
+		Members               []TeamMember   `json:"members"`
+		PostRedirectGet       map[string]any `json:"postRedirectGet"`
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
+		nbrew.MethodNotAllowed(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20 /* 1 MB */)
+	}
+	err := r.ParseForm()
+	if err != nil {
+		nbrew.BadRequest(w, r, err)
+		return
+	}
+	currentSubscription, currentItem, currentPlan, ok, err := getPlanSubscription(r.Context(), nbrew, stripeConfig, user.CustomerID)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	if !ok || !currentPlan.PerSeat {
+		nbrew.BadRequest(w, r, fmt.Errorf("user has no per-seat plan"))
+		return
+	}
+	members, err := getTeamMembers(r.Context(), nbrew, user.CustomerID, currentItem.Quantity)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+
+	if r.Method == "POST" {
+		scheme := "https://"
+		if !nbrew.CMSDomainHTTPS {
+			scheme = "http://"
+		}
+		var postRedirectGet map[string]any
+		switch action := r.Form.Get("action"); action {
+		case "invite":
+			email := strings.TrimSpace(r.Form.Get("email"))
+			_, err := mail.ParseAddress(email)
+			if err != nil {
+				nbrew.BadRequest(w, r, fmt.Errorf("invalid email address %q", email))
+				return
+			}
+			if strings.EqualFold(email, user.Email) {
+				nbrew.BadRequest(w, r, fmt.Errorf("you already have a seat on your own team"))
+				return
+			}
+			if int64(len(members)) >= currentItem.Quantity-1 {
+				nbrew.BadRequest(w, r, fmt.Errorf("all %d seats are taken: add more seats before inviting another member", currentItem.Quantity))
+				return
+			}
+			_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "INSERT INTO team_member (email, customer_id, invite_time) VALUES ({email}, {customerID}, {inviteTime})",
+				Values: []any{
+					sq.StringParam("email", email),
+					sq.StringParam("customerID", user.CustomerID),
+					sq.Int64Param("inviteTime", time.Now().Unix()),
+				},
+			})
+			if err != nil {
+				if isKeyViolation(nbrew, err) {
+					nbrew.BadRequest(w, r, fmt.Errorf("%s is already a member of a team", email))
+					return
+				}
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			memberUserID, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "SELECT {*} FROM users WHERE email = {email}",
+				Values: []any{
+					sq.StringParam("email", email),
+				},
+			}, func(row *sq.Row) notebrew.ID {
+				return row.UUID("user_id")
+			})
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			var body string
+			if !memberUserID.IsZero() {
+				_, err := syncEntitlement(r.Context(), nbrew, stripeConfig, memberUserID)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				body = fmt.Sprintf("<p>%[1]s has added you to their team on the %[2]s plan. See your new limits at <a href='%[3]s'>%[3]s</a>.</p>",
+					template.HTMLEscapeString(user.Email), template.HTMLEscapeString(currentPlan.Name), scheme+nbrew.CMSDomain+"/users/profile/")
+			} else {
+				// The invitee signs up through a regular invite that
+				// starts them off on the team's plan.
+				entitlement := computeEntitlement(stripeConfig, []Subscription{{
+					SubscriptionID: currentSubscription.SubscriptionID,
+					Status:         currentSubscription.Status,
+					Items:          []SubscriptionItem{currentItem},
+				}}, nil, nil, nil)
+				inviteLink, inviteTokenHash, err := createInvite(r.Context(), nbrew, email, entitlement)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				// Remember which invite is the team's, so that only it is
+				// revoked if the invitee loses their seat.
+				_, err = sq.Exec(r.Context(), nbrew.DB, sq.Query{
+					Dialect: nbrew.Dialect,
+					Format:  "UPDATE team_member SET invite_token_hash = {inviteTokenHash} WHERE email = {email}",
+					Values: []any{
+						sq.BytesParam("inviteTokenHash", inviteTokenHash),
+						sq.StringParam("email", email),
+					},
+				})
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				body = fmt.Sprintf("<p>%[1]s has invited you to join their team on notebrew. Sign up at <a href='%[2]s'>%[2]s</a>.</p>",
+					template.HTMLEscapeString(user.Email), inviteLink)
+			}
+			if nbrew.Mailer != nil {
+				nbrew.Mailer.C <- notebrew.Mail{
+					MailFrom: nbrew.MailFrom,
+					RcptTo:   email,
+					Headers: []string{
+						"Subject", "You've been invited to a notebrew team",
+						"Content-Type", "text/html; charset=utf-8",
+					},
+					Body: strings.NewReader(body),
+				}
+			}
+			postRedirectGet = map[string]any{
+				"from":  "stripe/team/invite",
+				"email": email,
+			}
+		case "remove":
+			email := r.Form.Get("email")
+			var member TeamMember
+			for _, teamMember := range members {
+				if teamMember.Email == email {
+					member = teamMember
+					break
+				}
+			}
+			if member.Email == "" {
+				nbrew.BadRequest(w, r, fmt.Errorf("%s is not a member of your team", email))
+				return
+			}
+			_, err := sq.Exec(r.Context(), nbrew.DB, sq.Query{
+				Dialect: nbrew.Dialect,
+				Format:  "DELETE FROM team_member WHERE email = {email} AND customer_id = {customerID}",
+				Values: []any{
+					sq.StringParam("email", member.Email),
+					sq.StringParam("customerID", user.CustomerID),
+				},
+			})
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			if member.Joined {
+				memberUserID, err := sq.FetchOne(r.Context(), nbrew.DB, sq.Query{
+					Dialect: nbrew.Dialect,
+					Format:  "SELECT {*} FROM users WHERE email = {email}",
+					Values: []any{
+						sq.StringParam("email", member.Email),
+					},
+				}, func(row *sq.Row) notebrew.ID {
+					return row.UUID("user_id")
+				})
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+				_, err = syncEntitlement(r.Context(), nbrew, stripeConfig, memberUserID)
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+			} else if len(member.InviteTokenHash) > 0 {
+				// Revoke the invite so that the team's plan can't be
+				// claimed by signing up after being removed.
+				_, err := sq.Exec(r.Context(), nbrew.DB, sq.Query{
+					Dialect: nbrew.Dialect,
+					Format:  "DELETE FROM invite WHERE invite_token_hash = {inviteTokenHash}",
+					Values: []any{
+						sq.BytesParam("inviteTokenHash", member.InviteTokenHash),
+					},
+				})
+				if err != nil {
+					nbrew.GetLogger(r.Context()).Error(err.Error())
+					nbrew.InternalServerError(w, r, err)
+					return
+				}
+			}
+			postRedirectGet = map[string]any{
+				"from":  "stripe/team/remove",
+				"email": member.Email,
+			}
+		case "seats":
+			seats, err := strconv.ParseInt(r.Form.Get("seats"), 10, 64)
+			if err != nil || seats < 1 || seats > 1000 {
+				nbrew.BadRequest(w, r, fmt.Errorf("invalid seats %q", r.Form.Get("seats")))
+				return
+			}
+			if seats == currentItem.Quantity {
+				http.Redirect(w, r, "/stripe/team/", http.StatusSeeOther)
+				return
+			}
+			stripeClient, err := customerClient(r.Context(), nbrew, stripeConfig, user.CustomerID)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			_, err = stripeClient.SubscriptionItems.Update(currentItem.ItemID, &stripe.SubscriptionItemParams{
+				Quantity:          stripe.Int64(seats),
+				ProrationBehavior: stripe.String("create_prorations"),
+			})
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			// Don't wait for the customer.subscription.updated event, so
+			// that members gain or lose their seat right away.
+			fetchTime := time.Now().Unix()
+			stripeSubscription, err := stripeClient.Subscriptions.Get(currentSubscription.SubscriptionID, nil)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			_, err = saveSubscription(r.Context(), nbrew, stripeSubscription, fetchTime)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			err = syncTeamEntitlements(r.Context(), nbrew, stripeConfig, user.CustomerID)
+			if err != nil {
+				nbrew.GetLogger(r.Context()).Error(err.Error())
+				nbrew.InternalServerError(w, r, err)
+				return
+			}
+			postRedirectGet = map[string]any{
+				"from":  "stripe/team/seats",
+				"seats": seats,
+			}
+		default:
+			nbrew.BadRequest(w, r, fmt.Errorf("invalid action %q", action))
+			return
+		}
+		err = nbrew.SetFlashSession(w, r, map[string]any{
+			"postRedirectGet": postRedirectGet,
+		})
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+			nbrew.InternalServerError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/stripe/team/", http.StatusSeeOther)
+		return
+	}
+
+	var response Response
+	_, err = nbrew.GetFlashSession(w, r, &response)
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+	}
+	response.UserID = user.UserID
+	response.Username = user.Username
+	response.TimezoneOffsetSeconds = user.TimezoneOffsetSeconds
+	response.DisableReason = user.DisableReason
+	response.Plan = currentPlan
+	response.Seats = currentItem.Quantity
+	response.Members = members
+	if r.Form.Has("api") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(&response)
+		if err != nil {
+			nbrew.GetLogger(r.Context()).Error(err.Error())
+		}
+		return
+	}
+	referer := nbrew.GetReferer(r)
+	funcMap := map[string]any{
+		"stylesCSS":      func() template.CSS { return template.CSS(notebrew.StylesCSS) },
+		"baselineJS":     func() template.JS { return template.JS(notebrew.BaselineJS) },
+		"referer":        func() string { return referer },
+		"float64ToInt64": func(n float64) int64 { return int64(n) },
+		"formatTime": func(t time.Time, layout string, offset int) string {
+			return t.In(time.FixedZone("", offset)).Format(layout)
+		},
+	}
+	tmpl, err := template.New("team.html").Funcs(funcMap).ParseFS(RuntimeFS, "embed/team.html")
+	if err != nil {
+		nbrew.GetLogger(r.Context()).Error(err.Error())
+		nbrew.InternalServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", nbrew.ContentSecurityPolicy)
+	nbrew.ExecuteTemplate(w, r, tmpl, &response)
+}
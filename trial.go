@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/notebrew"
+	"github.com/bokwoon95/notebrew/sq"
+	"github.com/bokwoon95/notebrew/stacktrace"
+)
+
+// runTrialReminders emails users whose free trial is about to end to let
+// them know when they will be charged. Each trial is reminded about only
+// once, and trials that are set to be canceled are not reminded about.
+func runTrialReminders(ctx context.Context, nbrew *notebrew.Notebrew, stripeConfig StripeConfig) error {
+	if nbrew.Mailer == nil {
+		return nil
+	}
+	type Trial struct {
+		SubscriptionID string
+		Email          string
+		Items          []SubscriptionItem
+		TrialEnd       time.Time
+	}
+	reminderDays := stripeConfig.TrialReminderDays
+	if reminderDays <= 0 {
+		reminderDays = 3
+	}
+	now := time.Now()
+	trials, err := sq.FetchAll(ctx, nbrew.DB, sq.Query{
+		Dialect: nbrew.Dialect,
+		Format: "SELECT {*}" +
+			" FROM subscription" +
+			" JOIN customer ON customer.customer_id = subscription.customer_id" +
+			" JOIN users ON users.user_id = customer.user_id" +
+			" WHERE subscription.status = 'trialing'" +
+			" AND subscription.trial_end > {now}" +
+			" AND subscription.trial_end <= {reminderTime}" +
+			" AND subscription.trial_reminder_time IS NULL" +
+			" AND coalesce(subscription.cancel_at, 0) = 0",
+		Values: []any{
+			sq.Int64Param("now", now.Unix()),
+			sq.Int64Param("reminderTime", now.AddDate(0, 0, reminderDays).Unix()),
+		},
+	}, func(row *sq.Row) Trial {
+		trial := Trial{
+			SubscriptionID: row.String("subscription.subscription_id"),
+			Email:          row.String("users.email"),
+			TrialEnd:       time.Unix(row.Int64("subscription.trial_end"), 0).UTC(),
+		}
+		b := row.Bytes(nil, "subscription.items")
+		if len(b) > 0 {
+			err := json.Unmarshal(b, &trial.Items)
+			if err != nil {
+				panic(stacktrace.New(err))
+			}
+		}
+		return trial
+	})
+	if err != nil {
+		return err
+	}
+	scheme := "https://"
+	if !nbrew.CMSDomainHTTPS {
+		scheme = "http://"
+	}
+	profileURL := scheme + nbrew.CMSDomain + "/users/profile/"
+	for _, trial := range trials {
+		planDescription := "your notebrew plan"
+		for _, item := range trial.Items {
+			plan, ok := stripeConfig.PlanByPriceID(item.PriceID)
+			if !ok {
+				continue
+			}
+			planDescription = "the notebrew " + plan.Name + " plan"
+			price, _ := plan.PriceByID(item.PriceID)
+			if price.Price != "" {
+				planDescription += " (" + price.Price + ")"
+			}
+			break
+		}
+		nbrew.Mailer.C <- notebrew.Mail{
+			MailFrom: nbrew.MailFrom,
+			RcptTo:   trial.Email,
+			Headers: []string{
+				"Subject", "Your notebrew free trial is ending soon",
+				"Content-Type", "text/html; charset=utf-8",
+			},
+			Body: strings.NewReader(fmt.Sprintf(
+				"<p>Your free trial ends on %[1]s, after which you will be charged for %[2]s."+
+					" If you don't want to continue, cancel your subscription at <a href='%[3]s'>%[3]s</a> before then.</p>",
+				trial.TrialEnd.Format("2006-01-02"),
+				planDescription,
+				profileURL,
+			)),
+		}
+		_, err := sq.Exec(ctx, nbrew.DB, sq.Query{
+			Dialect: nbrew.Dialect,
+			Format:  "UPDATE subscription SET trial_reminder_time = {trialReminderTime} WHERE subscription_id = {subscriptionID}",
+			Values: []any{
+				sq.Int64Param("trialReminderTime", now.Unix()),
+				sq.StringParam("subscriptionID", trial.SubscriptionID),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}